@@ -0,0 +1,191 @@
+package apierr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+//Error is a failure from the catalog below. Code is stable and is what clients should branch on,
+//Title and Detail are for people and may be reworded
+type Error struct {
+	Status int
+	Code   string
+	Title  string
+	//Detail explains this occurrence, such as which limit was exceeded
+	Detail string
+	//Fields lists the invalid fields of a request that failed validation
+	Fields []FieldError
+	cause  error
+	v1     *v1Response
+}
+
+//v1Response is how a failure was reported to version 1 clients before the catalog
+type v1Response struct {
+	status  int
+	message string
+	data    interface{}
+	hasData bool
+}
+
+//FieldError describes why one field of a request is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//Problem is implemented by errors of other packages that know which catalog error they are reported as
+type Problem interface {
+	Problem() *Error
+}
+
+var catalog []*Error
+
+func newError(status int, code, title string) *Error {
+	e := &Error{Status: status, Code: code, Title: title}
+	catalog = append(catalog, e)
+	return e
+}
+
+var (
+	BadRequest            = newError(http.StatusBadRequest, "bad_request", "The request is invalid")
+	ValidationFailed      = newError(http.StatusBadRequest, "validation_failed", "Some fields are invalid")
+	InvalidPlatform       = newError(http.StatusBadRequest, "invalid_platform", "Invalid platform")
+	Unauthenticated       = newError(http.StatusUnauthorized, "unauthenticated", "A valid token is required")
+	InvalidCredentials    = newError(http.StatusUnauthorized, "invalid_credentials", "Invalid login details")
+	WrongPassword         = newError(http.StatusUnauthorized, "wrong_password", "Wrong old password")
+	InvalidResetToken     = newError(http.StatusUnauthorized, "invalid_reset_token", "Invalid Token")
+	ResetTokenExpired     = newError(http.StatusUnauthorized, "reset_token_expired", "Token time is expired")
+	InvalidSupportKey     = newError(http.StatusUnauthorized, "invalid_support_key", "A valid support key is required")
+	SessionEnded          = newError(http.StatusUnauthorized, "session_ended", "The session has ended, sign in again")
+	Forbidden             = newError(http.StatusForbidden, "forbidden", "You are not allowed to do this")
+	InvalidLink           = newError(http.StatusForbidden, "invalid_link", "The link is invalid or has expired")
+	AccountSuspended      = newError(http.StatusForbidden, "account_suspended", "The account is suspended")
+	PasswordResetRequired = newError(http.StatusForbidden, "password_reset_required", "The password must be reset before signing in again")
+	NotFound              = newError(http.StatusNotFound, "not_found", "Not found")
+	UserNotFound          = newError(http.StatusNotFound, "user_not_found", "User not found")
+	PropertyNotFound      = newError(http.StatusNotFound, "property_not_found", "Property not found")
+	ImageNotFound         = newError(http.StatusNotFound, "image_not_found", "Image not found")
+	DocumentNotFound      = newError(http.StatusNotFound, "document_not_found", "Document not found")
+	FileNotFound          = newError(http.StatusNotFound, "file_not_found", "File not found")
+	SessionNotFound       = newError(http.StatusNotFound, "session_not_found", "Session not found")
+	EmailNotFound         = newError(http.StatusNotFound, "email_not_found", "Email not found")
+	EmailTaken            = newError(http.StatusConflict, "email_taken", "Email taken")
+	ManagesProperties     = newError(http.StatusConflict, "manages_properties", "The user still manages properties")
+	VersionConflict       = newError(http.StatusConflict, "version_conflict", "The document was modified concurrently")
+	PreconditionFailed    = newError(http.StatusPreconditionFailed, "precondition_failed", "Property has changed since it was fetched")
+	PayloadTooLarge       = newError(http.StatusRequestEntityTooLarge, "payload_too_large", "The upload is too large")
+	UnsupportedMediaType  = newError(http.StatusUnsupportedMediaType, "unsupported_media_type", "The file type is not accepted")
+	UnsafeUpload          = newError(http.StatusUnprocessableEntity, "unsafe_upload", "The upload was rejected by the virus scanner")
+	Internal              = newError(http.StatusInternalServerError, "internal_error", "Internal server error")
+	Unavailable           = newError(http.StatusServiceUnavailable, "unavailable", "Not ready")
+)
+
+//Catalog returns every catalog error, for documentation
+func Catalog() []*Error {
+	return append([]*Error{}, catalog...)
+}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return e.Detail
+	}
+	return e.Title
+}
+
+//Unwrap returns the error that caused a server error
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+//Is matches errors with the same code, so errors.Is(err, apierr.UserNotFound) holds for copies made with Withf
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+//Cause returns the underlying error to log, or e itself when there is none
+func (e *Error) Cause() error {
+	if e.cause != nil {
+		return e.cause
+	}
+	return e
+}
+
+//Withf returns a copy of e with a detail explaining this occurrence
+func (e *Error) Withf(format string, args ...interface{}) *Error {
+	copied := *e
+	copied.Detail = fmt.Sprintf(format, args...)
+	return &copied
+}
+
+//WithFields returns a copy of e listing invalid fields
+func (e *Error) WithFields(fields ...FieldError) *Error {
+	copied := *e
+	copied.Fields = append(append([]FieldError{}, e.Fields...), fields...)
+	return &copied
+}
+
+//Wrap returns a copy of e caused by err. The cause is logged but never shown to clients
+func (e *Error) Wrap(err error) *Error {
+	copied := *e
+	copied.cause = err
+	return &copied
+}
+
+//V1 returns a copy of e reported to version 1 clients with the status and message they were sent
+//before the catalog. Version 2 clients are sent e as it is
+func (e *Error) V1(status int, message string) *Error {
+	copied := *e
+	legacy := v1Response{}
+	if e.v1 != nil {
+		legacy = *e.v1
+	}
+	legacy.status, legacy.message = status, message
+	copied.v1 = &legacy
+	return &copied
+}
+
+//V1Data returns a copy of e reported to version 1 clients with the data they were sent before the catalog
+func (e *Error) V1Data(data interface{}) *Error {
+	copied := *e
+	legacy := v1Response{}
+	if e.v1 != nil {
+		legacy = *e.v1
+	}
+	legacy.data, legacy.hasData = data, true
+	copied.v1 = &legacy
+	return &copied
+}
+
+//V1Response returns the status, message and data version 1 clients are sent for e. Data is nil and
+//ok false unless V1Data set it, in which case callers should send it instead of the field errors
+func (e *Error) V1Response() (status int, message string, data interface{}, ok bool) {
+	status, message = e.Status, e.Error()
+	if e.v1 == nil {
+		return status, message, nil, false
+	}
+	if e.v1.status != 0 {
+		status, message = e.v1.status, e.v1.message
+	}
+	return status, message, e.v1.data, e.v1.hasData
+}
+
+//Field returns the error of one invalid field
+func Field(field, code, message string) FieldError {
+	return FieldError{Field: field, Code: code, Message: message}
+}
+
+//From returns the catalog error err is reported as. Errors that aren't from the catalog are internal errors
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var p Problem
+	if errors.As(err, &p) {
+		return p.Problem()
+	}
+	return Internal.Wrap(err)
+}
@@ -0,0 +1,596 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	//Development is the default profile for running the service locally
+	Development = "development"
+	//Test is the profile used by the test suite
+	Test = "test"
+	//Production is the profile used for deployments
+	Production = "production"
+)
+
+const (
+	//SMTPMailer delivers emails through the configured sender account
+	SMTPMailer = "smtp"
+	//FakeMailer records emails in memory, it is refused in production
+	FakeMailer = "fake"
+	//CaptureMailer writes emails to MailCaptureDir for local development, it is refused in production
+	CaptureMailer = "capture"
+	//CryptoRandom draws codes and tokens from crypto/rand
+	CryptoRandom = "crypto"
+	//FixedRandom makes codes and tokens deterministic, it is refused in production
+	FixedRandom = "fixed"
+)
+
+const (
+	//TLSImplicit connects to the smtp server over tls, usually on port 465
+	TLSImplicit = "implicit"
+	//TLSStartTLS upgrades a plain smtp connection with STARTTLS, usually on port 587
+	TLSStartTLS = "starttls"
+	//TLSNone talks plain smtp, only for local relays and mail catchers
+	TLSNone = "none"
+)
+
+const (
+	//LocalStorage keeps uploads on the local disk below StorageLocalDir
+	LocalStorage = "local"
+	//S3Storage keeps uploads in an S3 compatible bucket
+	S3Storage = "s3"
+)
+
+const (
+	//NoScanner accepts uploads without scanning them
+	NoScanner = "none"
+	//ClamAVScanner scans uploads with clamd at ClamAVAddress
+	ClamAVScanner = "clamav"
+)
+
+//Config holds every setting the service reads at startup
+type Config struct {
+	Profile             string
+	Port                string
+	Host                string
+	RootDir             string
+	SecretKey           string
+	MongoURL            string
+	EmailSender         string
+	EmailSenderPassword string
+	EmailTemplatesDir   string
+	Mailer              string
+	MailCaptureDir      string
+	SMTPHost            string
+	SMTPPort            int
+	SMTPTLS             string
+	SMTPUsername        string
+	SMTPPassword        string
+	OutboxPollInterval  time.Duration
+	OutboxMaxAttempts   int
+	SupportAPIKey       string
+	StorageBackend      string
+	StorageLocalDir     string
+	StoragePrivateDir   string
+	S3Endpoint          string
+	S3Region            string
+	S3Bucket            string
+	S3PrivateBucket     string
+	S3AccessKey         string
+	S3SecretKey         string
+	S3UseSSL            bool
+	MediaSigningKey     string
+	DocumentURLTTL      time.Duration
+	//DocumentRetention is how long replaced document versions are kept, zero keeps them forever
+	DocumentRetention     time.Duration
+	DocumentPruneInterval time.Duration
+	UploadScanner         string
+	ClamAVAddress         string
+	UploadMaxRequest      int64
+	RandomSource          string
+	LogLevel              string
+	//MetricsToken is the bearer token scrapers send for /metrics. It is required in production, elsewhere
+	//the endpoint is open when it is blank
+	MetricsToken string
+	//TrustedProxies are the addresses and CIDR ranges of the load balancers whose X-Forwarded-For and
+	//X-Real-Ip headers are believed, the client address of requests from anywhere else is the connection's
+	TrustedProxies []string
+	//TrustedPlatform is the header a hosting platform puts the client address in, such as CF-Connecting-IP.
+	//It is only safe when the platform is the only way in
+	TrustedPlatform string
+	//AuditKey keys the hashes chaining the audit log, so entries can't be forged without it. Changing it
+	//breaks the verification of the entries already written. Outside production it is derived from
+	//SecretKey when blank
+	AuditKey string
+	//OTLPEndpoint is the url spans are exported to over OTLP/http, spans are not exported when it is blank
+	OTLPEndpoint     string
+	ServiceName      string
+	TraceSampleRatio float64
+	//HTTPReadHeaderTimeout, HTTPReadTimeout, HTTPWriteTimeout and HTTPIdleTimeout bound the phases of a request,
+	//the read and write timeouts must leave room for the largest upload and download
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	//ShutdownTimeout is how long in-flight requests are given to finish once the server is asked to stop
+	ShutdownTimeout time.Duration
+	//PasswordMinLength and PasswordMinClasses are the shortest password accepted and how many of
+	//lowercase letters, uppercase letters, digits and symbols it has to mix
+	PasswordMinLength  int
+	PasswordMinClasses int
+	//PasswordHistory is how many of a user's latest passwords can't be chosen again, zero allows reuse
+	PasswordHistory int
+	//BreachedPasswordsFile lists the SHA-1 hashes of leaked passwords, one per line sorted by hash, which
+	//can't be used. No password is rejected as breached when it is blank
+	BreachedPasswordsFile string
+}
+
+//source is a lookup function over one layer of configuration
+type source func(key string) (string, bool)
+
+//Load builds a Config from, in increasing order of precedence, the optional .env file
+//(or the file given with -config), the profile file .env.<profile>, the process environment
+//and command line flags. Flags are registered on fs so callers can add their own before Load parses args.
+//Secrets are deliberately not accepted as flags since they would show up in the process list
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	file := fs.String("config", "", "path to an env file with configuration, defaults to .env when present")
+	profile := fs.String("profile", "", "configuration profile: development, test or production")
+	port := fs.String("port", "", "port to listen on")
+	host := fs.String("host", "", "public host name used in links and docs")
+	rootDir := fs.String("root-dir", "", "directory holding the public media folder")
+	mongoURL := fs.String("mongo-url", "", "mongodb connection string")
+	mailer := fs.String("mailer", "", "email backend: smtp, capture or fake")
+	randomSource := fs.String("random-source", "", "random source for codes and tokens: crypto or fixed")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	layers := []source{}
+	flags := map[string]string{
+		"PROFILE":       *profile,
+		"PORT":          *port,
+		"HOST":          *host,
+		"ROOTDIR":       *rootDir,
+		"MONGO_URL":     *mongoURL,
+		"MAILER":        *mailer,
+		"RANDOM_SOURCE": *randomSource,
+	}
+	layers = append(layers, func(key string) (string, bool) {
+		v, ok := flags[key]
+		return v, ok && v != ""
+	})
+	layers = append(layers, os.LookupEnv)
+
+	base, err := readEnvFile(*file, *file != "")
+	if err != nil {
+		return nil, err
+	}
+	lookup := func(key string) string {
+		for _, layer := range layers {
+			if v, ok := layer(key); ok {
+				return v
+			}
+		}
+		return base[key]
+	}
+
+	cfg := &Config{Profile: strings.ToLower(lookup("PROFILE"))}
+	if cfg.Profile == "" {
+		cfg.Profile = Development
+	}
+
+	profileFile, err := readEnvFile(fmt.Sprintf(".env.%s", cfg.Profile), false)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range profileFile {
+		base[key] = value
+	}
+
+	cfg.Port = lookup("PORT")
+	cfg.Host = lookup("HOST")
+	cfg.RootDir = lookup("ROOTDIR")
+	cfg.SecretKey = lookup("SECRET_KEY")
+	cfg.MongoURL = lookup("MONGO_URL")
+	cfg.EmailSender = lookup("EMAIL_SENDER")
+	cfg.EmailSenderPassword = lookup("EMAIL_SENDER_PASSWORD")
+	cfg.EmailTemplatesDir = lookup("EMAIL_TEMPLATES_DIR")
+	cfg.Mailer = strings.ToLower(lookup("MAILER"))
+	cfg.MailCaptureDir = lookup("MAIL_CAPTURE_DIR")
+	cfg.SMTPHost = lookup("SMTP_HOST")
+	cfg.SMTPTLS = strings.ToLower(lookup("SMTP_TLS"))
+	cfg.SMTPUsername = lookup("SMTP_USERNAME")
+	cfg.SMTPPassword = lookup("SMTP_PASSWORD")
+	cfg.SupportAPIKey = lookup("SUPPORT_API_KEY")
+	cfg.StorageBackend = strings.ToLower(lookup("STORAGE_BACKEND"))
+	cfg.StorageLocalDir = lookup("STORAGE_LOCAL_DIR")
+	cfg.S3Endpoint = lookup("S3_ENDPOINT")
+	cfg.S3Region = lookup("S3_REGION")
+	cfg.S3Bucket = lookup("S3_BUCKET")
+	cfg.S3PrivateBucket = lookup("S3_PRIVATE_BUCKET")
+	cfg.StoragePrivateDir = lookup("STORAGE_PRIVATE_DIR")
+	cfg.MediaSigningKey = lookup("MEDIA_SIGNING_KEY")
+	cfg.AuditKey = lookup("AUDIT_KEY")
+	cfg.UploadScanner = strings.ToLower(lookup("UPLOAD_SCANNER"))
+	cfg.ClamAVAddress = lookup("CLAMAV_ADDRESS")
+	if maxRequest := lookup("UPLOAD_MAX_REQUEST_MB"); maxRequest != "" {
+		mb, err := strconv.ParseInt(maxRequest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("UPLOAD_MAX_REQUEST_MB must be a number, got %q", maxRequest)
+		}
+		cfg.UploadMaxRequest = mb << 20
+	}
+	if ttl := lookup("DOCUMENT_URL_TTL"); ttl != "" {
+		if cfg.DocumentURLTTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("DOCUMENT_URL_TTL must be a duration such as 5m, got %q", ttl)
+		}
+	}
+	if days := lookup("DOCUMENT_RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return nil, fmt.Errorf("DOCUMENT_RETENTION_DAYS must be a number, got %q", days)
+		}
+		cfg.DocumentRetention = time.Duration(n) * 24 * time.Hour
+	}
+	if interval := lookup("DOCUMENT_PRUNE_INTERVAL"); interval != "" {
+		if cfg.DocumentPruneInterval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("DOCUMENT_PRUNE_INTERVAL must be a duration such as 1h, got %q", interval)
+		}
+	}
+	for _, timeout := range []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", &cfg.HTTPReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", &cfg.HTTPReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", &cfg.HTTPWriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", &cfg.HTTPIdleTimeout},
+		{"SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout},
+	} {
+		if value := lookup(timeout.key); value != "" {
+			if *timeout.value, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("%s must be a duration such as 30s, got %q", timeout.key, value)
+			}
+		}
+	}
+	cfg.S3AccessKey = lookup("S3_ACCESS_KEY")
+	cfg.S3SecretKey = lookup("S3_SECRET_KEY")
+	if useSSL := lookup("S3_USE_SSL"); useSSL != "" {
+		if cfg.S3UseSSL, err = strconv.ParseBool(useSSL); err != nil {
+			return nil, fmt.Errorf("S3_USE_SSL must be true or false, got %q", useSSL)
+		}
+	}
+	if interval := lookup("OUTBOX_POLL_INTERVAL"); interval != "" {
+		if cfg.OutboxPollInterval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("OUTBOX_POLL_INTERVAL must be a duration such as 5s, got %q", interval)
+		}
+	}
+	if attempts := lookup("OUTBOX_MAX_ATTEMPTS"); attempts != "" {
+		if cfg.OutboxMaxAttempts, err = strconv.Atoi(attempts); err != nil {
+			return nil, fmt.Errorf("OUTBOX_MAX_ATTEMPTS must be a number, got %q", attempts)
+		}
+	}
+	if port := lookup("SMTP_PORT"); port != "" {
+		if cfg.SMTPPort, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("SMTP_PORT must be a number, got %q", port)
+		}
+	}
+	cfg.RandomSource = strings.ToLower(lookup("RANDOM_SOURCE"))
+	cfg.LogLevel = strings.ToLower(lookup("LOG_LEVEL"))
+	cfg.MetricsToken = lookup("METRICS_TOKEN")
+	for _, proxy := range strings.Split(lookup("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES must be comma separated addresses or CIDR ranges, got %q", proxy)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
+	}
+	cfg.TrustedPlatform = lookup("TRUSTED_PLATFORM")
+	cfg.OTLPEndpoint = lookup("OTEL_EXPORTER_OTLP_ENDPOINT")
+	cfg.ServiceName = lookup("OTEL_SERVICE_NAME")
+	cfg.TraceSampleRatio = 1
+	if ratio := lookup("OTEL_TRACES_SAMPLER_ARG"); ratio != "" {
+		if cfg.TraceSampleRatio, err = strconv.ParseFloat(ratio, 64); err != nil {
+			return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be a number, got %q", ratio)
+		}
+	}
+	cfg.PasswordMinLength = 10
+	cfg.PasswordMinClasses = 3
+	cfg.PasswordHistory = 5
+	for _, setting := range []struct {
+		key   string
+		value *int
+	}{
+		{"PASSWORD_MIN_LENGTH", &cfg.PasswordMinLength},
+		{"PASSWORD_MIN_CHARACTER_CLASSES", &cfg.PasswordMinClasses},
+		{"PASSWORD_HISTORY", &cfg.PasswordHistory},
+	} {
+		if value := lookup(setting.key); value != "" {
+			if *setting.value, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("%s must be a number, got %q", setting.key, value)
+			}
+		}
+	}
+	cfg.BreachedPasswordsFile = lookup("BREACHED_PASSWORDS_FILE")
+	cfg.applyDefaults()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+//readEnvFile reads key/value pairs from an env file. A missing file is only an error when required
+func readEnvFile(path string, required bool) (map[string]string, error) {
+	if path == "" {
+		path = ".env"
+	}
+	if _, err := os.Stat(path); err != nil {
+		if required {
+			return nil, fmt.Errorf("config file %s can't be read: %v", path, err)
+		}
+		return map[string]string{}, nil
+	}
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s is malformed: %v", path, err)
+	}
+	return values, nil
+}
+
+func (cfg *Config) applyDefaults() {
+	if cfg.Port == "" {
+		cfg.Port = "8080"
+	}
+	if cfg.Mailer == "" {
+		cfg.Mailer = SMTPMailer
+	}
+	if cfg.EmailTemplatesDir == "" {
+		cfg.EmailTemplatesDir = filepath.Join(cfg.RootDir, "templates", "email")
+	}
+	if cfg.MailCaptureDir == "" {
+		cfg.MailCaptureDir = filepath.Join(cfg.RootDir, "mail")
+	}
+	if cfg.SMTPHost == "" {
+		cfg.SMTPHost = "smtp.gmail.com"
+	}
+	if cfg.SMTPTLS == "" {
+		cfg.SMTPTLS = TLSImplicit
+	}
+	if cfg.SMTPPort == 0 {
+		switch cfg.SMTPTLS {
+		case TLSStartTLS:
+			cfg.SMTPPort = 587
+		case TLSNone:
+			cfg.SMTPPort = 25
+		default:
+			cfg.SMTPPort = 465
+		}
+	}
+	if cfg.StorageBackend == "" {
+		cfg.StorageBackend = LocalStorage
+	}
+	if cfg.StorageLocalDir == "" {
+		cfg.StorageLocalDir = filepath.Join(cfg.RootDir, "public")
+	}
+	if cfg.StoragePrivateDir == "" {
+		cfg.StoragePrivateDir = filepath.Join(cfg.RootDir, "private")
+	}
+	if cfg.S3PrivateBucket == "" && cfg.S3Bucket != "" {
+		cfg.S3PrivateBucket = cfg.S3Bucket + "-private"
+	}
+	if cfg.MediaSigningKey == "" && cfg.Profile != Production && cfg.SecretKey != "" {
+		cfg.MediaSigningKey = derivedKey(cfg.SecretKey, "media url signing")
+	}
+	if cfg.AuditKey == "" && cfg.Profile != Production && cfg.SecretKey != "" {
+		cfg.AuditKey = derivedKey(cfg.SecretKey, "audit log chaining")
+	}
+	if cfg.DocumentURLTTL == 0 {
+		cfg.DocumentURLTTL = 5 * time.Minute
+	}
+	if cfg.DocumentPruneInterval == 0 {
+		cfg.DocumentPruneInterval = time.Hour
+	}
+	if cfg.UploadScanner == "" {
+		cfg.UploadScanner = NoScanner
+	}
+	if cfg.ClamAVAddress == "" {
+		cfg.ClamAVAddress = "unix:/var/run/clamav/clamd.ctl"
+	}
+	if cfg.UploadMaxRequest == 0 {
+		cfg.UploadMaxRequest = 100 << 20
+	}
+	if cfg.OutboxPollInterval == 0 {
+		cfg.OutboxPollInterval = 5 * time.Second
+	}
+	if cfg.OutboxMaxAttempts == 0 {
+		cfg.OutboxMaxAttempts = 8
+	}
+	if cfg.SMTPUsername == "" && cfg.SMTPPassword == "" {
+		cfg.SMTPUsername = cfg.EmailSender
+		cfg.SMTPPassword = cfg.EmailSenderPassword
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if cfg.HTTPReadHeaderTimeout == 0 {
+		cfg.HTTPReadHeaderTimeout = 10 * time.Second
+	}
+	if cfg.HTTPReadTimeout == 0 {
+		cfg.HTTPReadTimeout = 2 * time.Minute
+	}
+	if cfg.HTTPWriteTimeout == 0 {
+		cfg.HTTPWriteTimeout = 2 * time.Minute
+	}
+	if cfg.HTTPIdleTimeout == 0 {
+		cfg.HTTPIdleTimeout = 2 * time.Minute
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 30 * time.Second
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "properly"
+	}
+	if cfg.RandomSource == "" {
+		cfg.RandomSource = CryptoRandom
+	}
+	if cfg.RootDir == "" {
+		if dir, err := os.Getwd(); err == nil {
+			cfg.RootDir = dir
+		}
+	}
+	if cfg.MongoURL == "" && cfg.Profile != Production {
+		cfg.MongoURL = "mongodb://localhost:27017/"
+	}
+	if cfg.Host == "" && cfg.Profile != Production {
+		cfg.Host = fmt.Sprintf("localhost:%s", cfg.Port)
+	}
+}
+
+//derivedKey derives the key used for purpose from secret with HKDF, so that leaking the key of one
+//purpose doesn't give away secret or the keys of the others
+func derivedKey(secret, purpose string) string {
+	key := make([]byte, sha256.Size)
+	io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte("properly "+purpose)), key)
+	return hex.EncodeToString(key)
+}
+
+//Validate checks that every required setting is present for the configured profile
+func (cfg *Config) Validate() error {
+	problems := []string{}
+	switch cfg.Profile {
+	case Development, Test, Production:
+	default:
+		problems = append(problems, fmt.Sprintf("PROFILE must be one of %s, %s or %s, got %q", Development, Test, Production, cfg.Profile))
+	}
+	if cfg.SecretKey == "" {
+		problems = append(problems, "SECRET_KEY is required to sign authentication tokens")
+	} else if cfg.Profile == Production && len(cfg.SecretKey) < 32 {
+		problems = append(problems, "SECRET_KEY must be at least 32 characters in production")
+	}
+	if cfg.Profile == Production {
+		//one leaked key mustn't allow forging tokens, media urls and audit entries all at once
+		if cfg.MediaSigningKey == "" || cfg.MediaSigningKey == cfg.SecretKey {
+			problems = append(problems, "MEDIA_SIGNING_KEY is required in production and must differ from SECRET_KEY")
+		}
+		if cfg.AuditKey == "" || cfg.AuditKey == cfg.SecretKey || cfg.AuditKey == cfg.MediaSigningKey {
+			problems = append(problems, "AUDIT_KEY is required in production and must differ from SECRET_KEY and MEDIA_SIGNING_KEY")
+		}
+	}
+	if cfg.MongoURL == "" {
+		problems = append(problems, "MONGO_URL is required in production")
+	}
+	if cfg.Host == "" {
+		problems = append(problems, "HOST is required in production, it is used in password reset links")
+	}
+	if cfg.Profile == Production && cfg.EmailSender == "" {
+		problems = append(problems, "EMAIL_SENDER is required in production, it is the From address of every email")
+	}
+	if cfg.Profile == Production && cfg.MetricsToken == "" {
+		problems = append(problems, "METRICS_TOKEN is required in production, /metrics would be public without it")
+	}
+	if cfg.RootDir == "" {
+		problems = append(problems, "ROOTDIR could not be determined, set it explicitly")
+	}
+	switch cfg.Mailer {
+	case SMTPMailer, CaptureMailer, FakeMailer:
+	default:
+		problems = append(problems, fmt.Sprintf("MAILER must be %s, %s or %s, got %q", SMTPMailer, CaptureMailer, FakeMailer, cfg.Mailer))
+	}
+	switch cfg.SMTPTLS {
+	case TLSImplicit, TLSStartTLS, TLSNone:
+	default:
+		problems = append(problems, fmt.Sprintf("SMTP_TLS must be %s, %s or %s, got %q", TLSImplicit, TLSStartTLS, TLSNone, cfg.SMTPTLS))
+	}
+	switch cfg.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL must be debug, info, warn or error, got %q", cfg.LogLevel))
+	}
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		problems = append(problems, fmt.Sprintf("OTEL_TRACES_SAMPLER_ARG must be between 0 and 1, got %v", cfg.TraceSampleRatio))
+	}
+	if cfg.RandomSource != CryptoRandom && cfg.RandomSource != FixedRandom {
+		problems = append(problems, fmt.Sprintf("RANDOM_SOURCE must be %s or %s, got %q", CryptoRandom, FixedRandom, cfg.RandomSource))
+	}
+	switch cfg.StorageBackend {
+	case LocalStorage:
+		if cfg.StoragePrivateDir == cfg.StorageLocalDir {
+			problems = append(problems, "STORAGE_PRIVATE_DIR must differ from STORAGE_LOCAL_DIR or documents would be served publicly")
+		}
+	case S3Storage:
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+			problems = append(problems, "S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required with STORAGE_BACKEND=s3")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("STORAGE_BACKEND must be %s or %s, got %q", LocalStorage, S3Storage, cfg.StorageBackend))
+	}
+	if cfg.StorageBackend == S3Storage && cfg.S3PrivateBucket == cfg.S3Bucket {
+		problems = append(problems, "S3_PRIVATE_BUCKET must differ from S3_BUCKET or documents would be served publicly")
+	}
+	if cfg.UploadScanner != NoScanner && cfg.UploadScanner != ClamAVScanner {
+		problems = append(problems, fmt.Sprintf("UPLOAD_SCANNER must be %s or %s, got %q", NoScanner, ClamAVScanner, cfg.UploadScanner))
+	}
+	if cfg.UploadMaxRequest < 0 {
+		problems = append(problems, "UPLOAD_MAX_REQUEST_MB must be positive")
+	}
+	if cfg.HTTPReadHeaderTimeout < 0 || cfg.HTTPReadTimeout < 0 || cfg.HTTPWriteTimeout < 0 || cfg.HTTPIdleTimeout < 0 || cfg.ShutdownTimeout < 0 {
+		problems = append(problems, "HTTP_*_TIMEOUT and SHUTDOWN_TIMEOUT must be positive")
+	}
+	if cfg.DocumentURLTTL < 0 {
+		problems = append(problems, "DOCUMENT_URL_TTL must be positive")
+	}
+	if cfg.DocumentRetention < 0 || cfg.DocumentPruneInterval < 0 {
+		problems = append(problems, "DOCUMENT_RETENTION_DAYS and DOCUMENT_PRUNE_INTERVAL must be positive")
+	}
+	if cfg.OutboxPollInterval < 0 || cfg.OutboxMaxAttempts < 1 {
+		problems = append(problems, "OUTBOX_POLL_INTERVAL must be positive and OUTBOX_MAX_ATTEMPTS at least 1")
+	}
+	if cfg.Profile == Production && cfg.Mailer != SMTPMailer {
+		problems = append(problems, fmt.Sprintf("MAILER=%s doesn't deliver emails and can't be used in production", cfg.Mailer))
+	}
+	if cfg.Profile == Production && cfg.SMTPTLS == TLSNone {
+		problems = append(problems, "SMTP_TLS=none would send credentials in clear text and can't be used in production")
+	}
+	if _, err := os.Stat(cfg.EmailTemplatesDir); err != nil {
+		problems = append(problems, fmt.Sprintf("EMAIL_TEMPLATES_DIR %s can't be read: %v", cfg.EmailTemplatesDir, err))
+	}
+	if cfg.PasswordMinLength < 8 || cfg.PasswordMinLength > 128 {
+		problems = append(problems, fmt.Sprintf("PASSWORD_MIN_LENGTH must be between 8 and 128, got %d", cfg.PasswordMinLength))
+	}
+	if cfg.PasswordMinClasses < 1 || cfg.PasswordMinClasses > 4 {
+		problems = append(problems, fmt.Sprintf("PASSWORD_MIN_CHARACTER_CLASSES must be between 1 and 4, got %d", cfg.PasswordMinClasses))
+	}
+	if cfg.PasswordHistory < 0 {
+		problems = append(problems, "PASSWORD_HISTORY must be positive")
+	}
+	if cfg.BreachedPasswordsFile != "" {
+		if _, err := os.Stat(cfg.BreachedPasswordsFile); err != nil {
+			problems = append(problems, fmt.Sprintf("BREACHED_PASSWORDS_FILE %s can't be read: %v", cfg.BreachedPasswordsFile, err))
+		}
+	}
+	if cfg.Profile == Production && cfg.RandomSource == FixedRandom {
+		problems = append(problems, "RANDOM_SOURCE=fixed is a test double and can't be used in production")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid %s configuration:\n  - %s", cfg.Profile, strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
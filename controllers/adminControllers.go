@@ -0,0 +1,367 @@
+package controllers
+
+import (
+	"net/http"
+	"properlyauth/apierr"
+	"properlyauth/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//checkAdmin authenticates the request and makes sure it comes from an admin
+func checkAdmin(c *gin.Context) (*models.User, bool) {
+	admin, ok := authenticate(c)
+	if !ok {
+		return nil, false
+	}
+	if admin.Type != models.Admin {
+		models.Fail(c, apierr.Forbidden.Withf("Only admins can manage users"))
+		return nil, false
+	}
+	return admin, true
+}
+
+//managedUser returns the user named by the id path parameter. Admins can't lock themselves out,
+//so when operation would, it is refused on their own account
+func managedUser(c *gin.Context, admin *models.User, operation string) (*models.User, bool) {
+	user, _ := models.FetchUserByID(c.Request.Context(), param(c, "id", "id"))
+	if user == nil {
+		models.Fail(c, apierr.UserNotFound)
+		return nil, false
+	}
+	if operation != "" && user.ID == admin.ID {
+		models.Fail(c, apierr.Forbidden.Withf("Admins can't %s their own account", operation))
+		return nil, false
+	}
+	return user, true
+}
+
+// ListUsers godoc
+// @Summary lists and searches users, newest first. Only admins can manage users
+// @Description q matches part of the email, first name or last name, ignoring case
+// @Tags admin
+// @Produce  json,application/problem+json
+// @Param  q query string false "text to search for"
+// @Param  type query string false "user type" Enums(manager, landlord, tenant, vendor, admin)
+// @Param  suspended query bool false "only suspended users when true, only active ones when false"
+// @Param  page query int false "page number, from 1" default(1)
+// @Param  per_page query int false "users per page, at most 100" default(20)
+// @Success 200 {object} models.SuccessRes{data=models.UserPage}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/users [get]
+// @Security ApiKeyAuth
+func ListUsers(c *gin.Context) {
+	if _, ok := checkAdmin(c); !ok {
+		return
+	}
+	query := models.UserSearch{}
+	if !validRequest(c, c.ShouldBindQuery(&query), "user search") {
+		return
+	}
+	if query.Page == 0 {
+		query.Page = 1
+	}
+	if query.PerPage == 0 {
+		query.PerPage = 20
+	}
+
+	filter := models.UserFilter{Search: strings.TrimSpace(query.Query), Type: query.Type, Suspended: query.Suspended}
+	users, total, err := models.FetchUsers(c.Request.Context(), filter, query.Page, query.PerPage)
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	page := models.UserPage{Users: make([]models.Account, 0, len(users)), Page: query.Page, PerPage: query.PerPage, Total: total}
+	for i := range users {
+		page.Users = append(page.Users, users[i].Account())
+	}
+	models.Success(c, http.StatusOK, "Users", page)
+}
+
+// UserAccount godoc
+// @Summary returns a user's account. Only admins can manage users
+// @Tags admin
+// @Produce  json,application/problem+json
+// @Param  id path string true "user id"
+// @Success 200 {object} models.SuccessRes{data=models.Account}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/users/{id} [get]
+// @Security ApiKeyAuth
+func UserAccount(c *gin.Context) {
+	admin, ok := checkAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := managedUser(c, admin, "")
+	if !ok {
+		return
+	}
+	models.Success(c, http.StatusOK, "User account", user.Account())
+}
+
+// UserProperties godoc
+// @Summary returns the properties a user manages, owns or rents. Only admins can manage users
+// @Tags admin
+// @Produce  json,application/problem+json
+// @Param  id path string true "user id"
+// @Success 200 {object} models.SuccessRes{data=[]models.Property}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/users/{id}/properties [get]
+// @Security ApiKeyAuth
+func UserProperties(c *gin.Context) {
+	admin, ok := checkAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := managedUser(c, admin, "")
+	if !ok {
+		return
+	}
+	properties, err := models.FetchUserProperties(c.Request.Context(), user.ID)
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	models.Success(c, http.StatusOK, "User properties", properties)
+}
+
+// ChangeUserType godoc
+// @Summary changes the type of a user. Only admins can manage users
+// @Description The change is recorded in the audit log. Admins can't change their own type
+// @Tags admin
+// @Accept  json
+// @Produce  json,application/problem+json
+// @Param  id path string true "user id"
+// @Param  details body models.ChangeUserType true "new type"
+// @Success 200 {object} models.SuccessRes{data=models.Account}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/users/{id}/type [put]
+// @Security ApiKeyAuth
+func ChangeUserType(c *gin.Context) {
+	admin, ok := checkAdmin(c)
+	if !ok {
+		return
+	}
+	data := models.ChangeUserType{}
+	if !bindJSON(c, &data, "user type") {
+		return
+	}
+	user, ok := managedUser(c, admin, "change the type of")
+	if !ok {
+		return
+	}
+	if user.Type == data.Type {
+		models.Success(c, http.StatusOK, "Nothing was updated", user.Account())
+		return
+	}
+
+	before := user.Type
+	if err := models.SetUserType(c.Request.Context(), user, data.Type); err != nil {
+		models.Fail(c, updateError(err))
+		return
+	}
+	audit(c, models.AuditUserTypeChanged, user.ID, "", map[string]string{"type": before}, map[string]string{"type": user.Type})
+	models.Success(c, http.StatusOK, "User type changed", user.Account())
+}
+
+// SuspendUser godoc
+// @Summary suspends a user. Only admins can manage users
+// @Description Suspended users can't sign in and their tokens are refused with account_suspended until they are reactivated.
+// @Description Suspending a suspended user updates the reason. The suspension is recorded in the audit log
+// @Tags admin
+// @Accept  json
+// @Produce  json,application/problem+json
+// @Param  id path string true "user id"
+// @Param  details body models.SuspendUser true "why the user is suspended"
+// @Success 200 {object} models.SuccessRes{data=models.Account}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/users/{id}/suspension [put]
+// @Security ApiKeyAuth
+func SuspendUser(c *gin.Context) {
+	admin, ok := checkAdmin(c)
+	if !ok {
+		return
+	}
+	data := models.SuspendUser{}
+	if !bindJSON(c, &data, "suspension") {
+		return
+	}
+	user, ok := managedUser(c, admin, "suspend")
+	if !ok {
+		return
+	}
+
+	before := map[string]string{"suspended": strconv.FormatBool(user.Suspended), "suspension_reason": user.SuspensionReason}
+	if !user.Suspended {
+		user.Suspended = true
+		user.SuspendedAt = time.Now().Unix()
+	}
+	user.SuspensionReason = strings.TrimSpace(data.Reason)
+	if err := updateUser(c.Request.Context(), user); err != nil {
+		models.Fail(c, updateError(err))
+		return
+	}
+	after := map[string]string{"suspended": "true", "suspension_reason": user.SuspensionReason}
+	audit(c, models.AuditUserSuspended, user.ID, "", before, after)
+	models.Success(c, http.StatusOK, "User suspended", user.Account())
+}
+
+// ReactivateUser godoc
+// @Summary lifts the suspension of a user. Only admins can manage users
+// @Description The reactivation is recorded in the audit log
+// @Tags admin
+// @Produce  json,application/problem+json
+// @Param  id path string true "user id"
+// @Success 200 {object} models.SuccessRes{data=models.Account}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/users/{id}/suspension [delete]
+// @Security ApiKeyAuth
+func ReactivateUser(c *gin.Context) {
+	admin, ok := checkAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := managedUser(c, admin, "")
+	if !ok {
+		return
+	}
+	if !user.Suspended {
+		models.Success(c, http.StatusOK, "User isn't suspended", user.Account())
+		return
+	}
+
+	before := map[string]string{"suspended": "true", "suspension_reason": user.SuspensionReason}
+	user.Suspended = false
+	user.SuspendedAt = 0
+	user.SuspensionReason = ""
+	if err := updateUser(c.Request.Context(), user); err != nil {
+		models.Fail(c, updateError(err))
+		return
+	}
+	audit(c, models.AuditUserReactivated, user.ID, "", before, map[string]string{"suspended": "false", "suspension_reason": ""})
+	models.Success(c, http.StatusOK, "User reactivated", user.Account())
+}
+
+// ForcePasswordReset godoc
+// @Summary makes a user reset their password. Only admins can manage users
+// @Description The user is sent a password reset email and, until they set a new password with it, can't sign in
+// @Description and their tokens are refused with password_reset_required. The reset is recorded in the audit log
+// @Tags admin
+// @Produce  json,application/problem+json
+// @Param  id path string true "user id"
+// @Param  X-Client-Platform header string false "platform the user resets their password on, web or mobile, web when left out" Enums(web, mobile)
+// @Success 200 {object} models.SuccessRes{data=models.Account}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/users/{id}/password-reset [post]
+// @Security ApiKeyAuth
+func ForcePasswordReset(c *gin.Context) {
+	platform, err := getPlatform(c)
+	if err != nil {
+		return
+	}
+	admin, ok := checkAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := managedUser(c, admin, "force a password reset on")
+	if !ok {
+		return
+	}
+
+	//the email is queued first so a user is never locked out without a way to reset their password
+	if _, err := sendPasswordReset(c, user, platform); err != nil {
+		models.Fail(c, err)
+		return
+	}
+	before := map[string]string{"password_reset_required": strconv.FormatBool(user.PasswordResetRequired)}
+	user.PasswordResetRequired = true
+	if err := updateUser(c.Request.Context(), user); err != nil {
+		models.Fail(c, updateError(err))
+		return
+	}
+	audit(c, models.AuditUserPasswordResetForced, user.ID, "", before, map[string]string{"password_reset_required": "true"})
+	models.Success(c, http.StatusOK, "Password reset email sent", user.Account())
+}
+
+// DeleteUserAccount godoc
+// @Summary deletes a user for good. Only admins can manage users
+// @Description Their tokens stop working right away and they are removed as a landlord or tenant from every property.
+// @Description Managers of properties can't be deleted, nor can admins delete their own account. The deletion is recorded in the audit log
+// @Tags admin
+// @Produce  json,application/problem+json
+// @Param  id path string true "user id"
+// @Success 200 {object} models.SuccessRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/users/{id} [delete]
+// @Security ApiKeyAuth
+func DeleteUserAccount(c *gin.Context) {
+	admin, ok := checkAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := managedUser(c, admin, "delete")
+	if !ok {
+		return
+	}
+	managed, err := models.CountManagedProperties(c.Request.Context(), user.ID)
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	if managed > 0 {
+		models.Fail(c, apierr.ManagesProperties.Withf("The user manages %d properties, which must be deleted first", managed))
+		return
+	}
+	//memberships go first so a failed delete can be retried without leaving properties pointing at no one
+	if _, err := models.RemovePropertyMember(c.Request.Context(), user.ID); err != nil {
+		models.Fail(c, err)
+		return
+	}
+	if err := models.DeleteUser(c.Request.Context(), user); err != nil {
+		models.Fail(c, err)
+		return
+	}
+	models.TakeOutToken(c.Request.Context(), user.Email)
+	if err := models.DeleteUserSessions(c.Request.Context(), user.ID); err != nil {
+		models.Fail(c, err)
+		return
+	}
+	audit(c, models.AuditUserDeleted, user.ID, "", map[string]string{"email": user.Email, "type": user.Type}, nil)
+	models.Success(c, http.StatusOK, "User deleted", nil)
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"properlyauth/logging"
+	"properlyauth/metrics"
+	"properlyauth/models"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//audit appends to the audit log that the authenticated user did action to target, changing the fields
+//in before to the values in after. property is the property the event concerns, if any. Requests
+//without a token are recorded as made by an anonymous actor. The change is already made when it is
+//audited, so an entry that can't be appended is logged and counted for alerting but doesn't fail the request
+func audit(c *gin.Context, action, target, property string, before, after map[string]string) {
+	actor := c.GetString(logging.UserIDKey)
+	if actor == "" {
+		actor = models.AnonymousActor
+	}
+	entry := &models.AuditEntry{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Property:  property,
+		Before:    before,
+		After:     after,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		RequestID: c.GetString(logging.RequestIDKey),
+	}
+	if err := models.InsertAuditEntry(c.Request.Context(), entry); err != nil {
+		metrics.AuditWriteFailed()
+		logging.FromContext(c).Error("appending to the audit log failed",
+			slog.String("action", action), slog.String("target", target), slog.String("actor", actor),
+			slog.String("error", err.Error()))
+	}
+}
+
+//auditChange appends to the audit log the fields that differ between before and after. Nothing is
+//appended when nothing changed
+func auditChange(c *gin.Context, action, target, property string, before, after map[string]string) {
+	before, after = models.ChangedFields(before, after)
+	if len(after) == 0 {
+		return
+	}
+	audit(c, action, target, property, before, after)
+}
+
+// ListAuditEntries godoc
+// @Summary reads the audit log, latest entries first. Only admins can read it
+// @Description user matches the entries the user made or was the target of. from and to are RFC 3339 times
+// @Tags admin
+// @Produce  json,application/problem+json
+// @Param  property query string false "property id"
+// @Param  user query string false "user id"
+// @Param  action query string false "action, such as property.tenant_added"
+// @Param  from query string false "earliest time, such as 2021-03-01T00:00:00Z"
+// @Param  to query string false "latest time"
+// @Param  page query int false "page number, from 1" default(1)
+// @Param  per_page query int false "entries per page, at most 200" default(50)
+// @Success 200 {object} models.SuccessRes{data=models.AuditPage}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/audit [get]
+// @Security ApiKeyAuth
+func ListAuditEntries(c *gin.Context) {
+	if _, ok := checkAdmin(c); !ok {
+		return
+	}
+	query := models.AuditSearch{}
+	if !validRequest(c, c.ShouldBindQuery(&query), "audit search") {
+		return
+	}
+	if query.Page == 0 {
+		query.Page = 1
+	}
+	if query.PerPage == 0 {
+		query.PerPage = 50
+	}
+
+	filter := models.AuditFilter{
+		Property: strings.TrimSpace(query.Property),
+		User:     strings.TrimSpace(query.User),
+		Action:   strings.TrimSpace(query.Action),
+	}
+	if !query.From.IsZero() {
+		filter.From = query.From.Unix()
+	}
+	if !query.To.IsZero() {
+		filter.To = query.To.Unix()
+	}
+	entries, total, err := models.FetchAuditEntries(c.Request.Context(), filter, query.Page, query.PerPage)
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	models.Success(c, http.StatusOK, "Audit entries", models.AuditPage{Entries: entries, Page: query.Page, PerPage: query.PerPage, Total: total})
+}
+
+// VerifyAuditLog godoc
+// @Summary checks that the audit log hasn't been tampered with. Only admins can read it
+// @Description Walks the hash chain of the whole log and reports the first entry that was changed, removed or inserted afterwards
+// @Tags admin
+// @Produce  json,application/problem+json
+// @Success 200 {object} models.SuccessRes{data=models.AuditVerification}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/admin/audit/verification [get]
+// @Security ApiKeyAuth
+func VerifyAuditLog(c *gin.Context) {
+	if _, ok := checkAdmin(c); !ok {
+		return
+	}
+	verification, err := models.VerifyAuditLog(c.Request.Context())
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	models.Success(c, http.StatusOK, "Audit log verified", verification)
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"properlyauth/apierr"
+	"properlyauth/config"
+	"properlyauth/database"
+	"properlyauth/logging"
+	"properlyauth/models"
+	"properlyauth/storage"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//readinessTimeout bounds all readiness checks together so a hung dependency can't hang the probe
+const readinessTimeout = 3 * time.Second
+
+//storageCheckInterval is how long a successful storage write check is trusted, so frequent probes
+//from every instance don't each write to the bucket
+const storageCheckInterval = 30 * time.Second
+
+var (
+	//readinessProbeKey is written to and deleted from both storages to check that they accept writes.
+	//It is per instance so one instance's delete can't race another's write
+	readinessProbeKey = probeKey()
+
+	storageCheckMutex sync.Mutex
+	storageCheckedAt  time.Time
+)
+
+//probeKey names the readiness object of this instance after its host and process
+func probeKey() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("health/readiness-probe-%s-%d", host, os.Getpid())
+}
+
+// Healthz godoc
+// @Summary reports that the process is up
+// @Description Liveness probe. It doesn't check dependencies, see /readyz
+// @Tags health
+// @Produce  json
+// @Success 200 {object} models.HTTPRes
+// @Router /healthz [get]
+func Healthz(c *gin.Context) {
+	models.Success(c, http.StatusOK, "OK", nil)
+}
+
+// Readyz godoc
+// @Summary reports whether the instance can serve traffic
+// @Description Readiness probe. Checks that Mongo answers, that storage accepts writes and that email delivery is configured
+// @Tags health
+// @Produce  json
+// @Success 200 {object} models.HTTPRes{data=map[string]string} "ok for every check"
+// @Failure 503 {object} models.HTTPRes{data=map[string]string} "failing for the checks that failed"
+// @Router /readyz [get]
+func Readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := []struct {
+		name string
+		err  error
+	}{
+		{"mongo", database.Ping(ctx)},
+		{"storage", storageWritable(ctx)},
+		{"mail", mailConfigured()},
+	}
+	//the probe is unauthenticated so failures are only detailed in the logs
+	results := map[string]string{}
+	failing := []apierr.FieldError{}
+	for _, check := range checks {
+		results[check.name] = "ok"
+		if check.err != nil {
+			results[check.name] = "failing"
+			failing = append(failing, apierr.Field(check.name, "failing", check.name+" is failing"))
+			logging.FromContext(c).Warn("readiness check failed", slog.String("check", check.name), slog.String("error", check.err.Error()))
+		}
+	}
+	if len(failing) > 0 {
+		models.Fail(c, apierr.Unavailable.WithFields(failing...).V1Data(results))
+		return
+	}
+	models.Success(c, http.StatusOK, "Ready", results)
+}
+
+//storageWritable writes and deletes a small object in public and private storage. A success is
+//reused for storageCheckInterval
+func storageWritable(ctx context.Context) error {
+	storageCheckMutex.Lock()
+	defer storageCheckMutex.Unlock()
+	if time.Since(storageCheckedAt) < storageCheckInterval {
+		return nil
+	}
+	for _, store := range []storage.Storage{storage.Default(), storage.Private()} {
+		if store == nil {
+			return fmt.Errorf("storage is not configured")
+		}
+		probe := []byte("ok")
+		if err := store.Put(ctx, readinessProbeKey, bytes.NewReader(probe), int64(len(probe)), "text/plain"); err != nil {
+			return err
+		}
+		if err := store.Delete(ctx, readinessProbeKey); err != nil {
+			return err
+		}
+	}
+	storageCheckedAt = time.Now()
+	return nil
+}
+
+//mailConfigured checks that the configured mailer has what it needs to deliver email
+func mailConfigured() error {
+	switch cfg.Mailer {
+	case config.SMTPMailer:
+		if cfg.SMTPHost == "" || cfg.EmailSender == "" {
+			return fmt.Errorf("SMTP_HOST and EMAIL_SENDER are required to send email over smtp")
+		}
+	case config.CaptureMailer:
+		if cfg.MailCaptureDir == "" {
+			return fmt.Errorf("MAIL_CAPTURE_DIR is required to capture email")
+		}
+	}
+	return nil
+}
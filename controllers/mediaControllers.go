@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"properlyauth/apierr"
+	"properlyauth/models"
+	"properlyauth/storage"
+	"properlyauth/upload"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//mediaCacheControl lets browsers and proxies keep public media for a day
+const mediaCacheControl = "public, max-age=86400"
+
+//streamObject writes the object stored under key, answering range and conditional requests.
+//disposition is inline or attachment and name the file name clients save it under
+func streamObject(c *gin.Context, store storage.Storage, key, disposition, name string) {
+	object, info, err := store.Get(c.Request.Context(), key)
+	if err == storage.ErrNotFound || err == storage.ErrInvalidKey {
+		models.Fail(c, apierr.FileNotFound)
+		return
+	}
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	defer object.Close()
+
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	//uploaded files are never run as a page or script, even if a browser is talked into treating them as one
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+	if info.ETag != "" {
+		c.Header("ETag", fmt.Sprintf(`"%s"`, strings.Trim(info.ETag, `"`)))
+	}
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime, object)
+}
+
+// ServeMedia godoc
+// @Summary streams an uploaded media file from storage
+// @Description Only files used as a property or profile image are served. Supports range requests, and answers If-None-Match and If-Modified-Since with 304.
+// @Description Images can be requested resized with the variant parameter, and as lossless WebP by adding .webp to the variant.
+// @Description Images uploaded before variants were generated are served at their original size
+// @Tags media
+// @Produce  octet-stream,application/problem+json
+// @Param  filename path string true "media file name"
+// @Param  variant query string false "resized copy to send" Enums(thumbnail, medium, large, thumbnail.webp, medium.webp, large.webp)
+// @Success 200 {file} file
+// @Success 206 {file} file
+// @Success 304 "the file hasn't changed"
+// @Failure 400 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/media/{filename} [get]
+func ServeMedia(c *gin.Context) {
+	filename := c.Param("filename")
+	if filename == "" || filename != path.Base(filename) || strings.HasPrefix(filename, ".") {
+		models.Fail(c, apierr.FileNotFound)
+		return
+	}
+	key := storage.MediaKey(filename)
+	known, err := models.IsKnownMedia(c.Request.Context(), key)
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	if !known {
+		models.Fail(c, apierr.FileNotFound)
+		return
+	}
+	variant := c.Query("variant")
+	if variant == "" {
+		c.Header("Cache-Control", mediaCacheControl)
+		streamObject(c, storage.Default(), key, "inline", path.Base(key))
+		return
+	}
+	name, webp, ok := upload.ParseVariant(variant)
+	if !ok {
+		models.Fail(c, apierr.BadRequest.Withf("Unknown variant %s", variant))
+		return
+	}
+
+	//images stored without the variant asked for fall back to the variant in their own format, then to the image itself
+	candidates := []string{upload.VariantKey(key, name, webp), upload.VariantKey(key, name, false), key}
+	variantKey := key
+	for _, candidate := range candidates {
+		if _, err := storage.Default().Stat(c.Request.Context(), candidate); err != storage.ErrNotFound {
+			variantKey = candidate
+			break
+		}
+	}
+	c.Header("Cache-Control", mediaCacheControl)
+	streamObject(c, storage.Default(), variantKey, "inline", path.Base(variantKey))
+}
+
+// DocumentURL godoc
+// @Summary returns a short lived signed url to download a property document
+// @Description Only the property's manager, landlords and tenants can get one. The url needs no Authorization header so it works in img tags and mobile clients
+// @Tags media
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  documentId path string true "document id as listed in the property documents"
+// @Param  version query int false "version number, the current version when left out"
+// @Success 200 {object} models.SuccessRes{data=models.DocumentLink}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/documents/{documentId}/url [get]
+// @Security ApiKeyAuth
+func DocumentURL(c *gin.Context) {
+	_, err := getPlatform(c)
+	if err != nil {
+		return
+	}
+	userFetch, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	property, _ := models.FetchPropertyByID(c.Request.Context(), param(c, "id", "id"))
+	if property == nil || !canViewProperty(userFetch, property) {
+		failProperty(c, apierr.PropertyNotFound)
+		return
+	}
+
+	index := property.DocumentIndex(param(c, "documentId", "document"))
+	if index < 0 {
+		failProperty(c, apierr.DocumentNotFound)
+		return
+	}
+	document := property.Documents[index]
+	version := document.Current()
+	if number := c.Query("version"); number != "" {
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			failProperty(c, apierr.BadRequest.Withf("version must be a number"))
+			return
+		}
+		var found bool
+		if version, found = document.Version(n); !found {
+			failProperty(c, apierr.DocumentNotFound.Withf("Document version not found"))
+			return
+		}
+	}
+
+	servePath := "/v1/serve/document/"
+	if strings.HasPrefix(c.FullPath(), "/v2/") {
+		servePath = "/v2/documents"
+	}
+	url := storage.SignedURL([]byte(cfg.MediaSigningKey), servePath, version.Key, cfg.DocumentURLTTL)
+	models.Success(c, http.StatusOK, "Document url", models.DocumentLink{
+		URL:       url,
+		ExpiresIn: int64(cfg.DocumentURLTTL.Seconds()),
+		Version:   version.Number,
+	})
+}
+
+// ServeDocument godoc
+// @Summary streams a private document for a url signed by GET /v2/properties/{id}/documents/{documentId}/url
+// @Description The document is sent as an attachment named as uploaded. Links to deleted or pruned versions stop working even before they expire
+// @Tags media
+// @Produce  octet-stream,application/problem+json
+// @Param  key query string true "document key"
+// @Param  expires query string true "unix time the url expires at"
+// @Param  signature query string true "url signature"
+// @Success 200 {file} file
+// @Success 206 {file} file
+// @Success 304 "the file hasn't changed"
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/documents [get]
+func ServeDocument(c *gin.Context) {
+	key := c.Query("key")
+	if !storage.VerifySignature([]byte(cfg.MediaSigningKey), key, c.Query("expires"), c.Query("signature")) {
+		models.Fail(c, apierr.InvalidLink)
+		return
+	}
+	version, err := models.FindDocumentVersion(c.Request.Context(), key)
+	if err == mongo.ErrNoDocuments {
+		models.Fail(c, apierr.FileNotFound)
+		return
+	}
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	name := version.Name
+	if name == "" {
+		name = path.Base(key)
+	}
+	c.Header("Cache-Control", "private, no-store")
+	streamObject(c, storage.Private(), key, "attachment", name)
+}
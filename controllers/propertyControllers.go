@@ -1,23 +1,24 @@
 package controllers
 
 import (
+	"context"
 	"fmt"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
+	"properlyauth/apierr"
 	"properlyauth/models"
-	"properlyauth/utils"
+	"properlyauth/storage"
+	"properlyauth/upload"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	struct2map "github.com/haibeey/struct2Map"
-	"github.com/mitchellh/mapstructure"
+	"github.com/gin-gonic/gin/binding"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func updateProperty(property *models.Property) error {
+func updateProperty(ctx context.Context, property *models.Property) error {
 	uB, err := bson.Marshal(property)
 	if err != nil {
 		return err
@@ -27,7 +28,8 @@ func updateProperty(property *models.Property) error {
 	if err != nil {
 		return err
 	}
-	err = models.UpdateProperty(property, bson.D{{Key: "$set", Value: update}})
+	delete(update, "version")
+	err = models.UpdateProperty(ctx, property, bson.D{{Key: "$set", Value: update}})
 	if err != nil {
 		return err
 	}
@@ -35,25 +37,113 @@ func updateProperty(property *models.Property) error {
 	return nil
 }
 
-func handleMediaUploads(c *gin.Context, nameOf string, form *multipart.Form) ([]string, error) {
-	files := form.File[nameOf]
-	names := []string{}
-	rootDir := os.Getenv("ROOTDIR")
-	errors := []error{}
-	for _, file := range files {
-		filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), filepath.Base(file.Filename))
-		err := c.SaveUploadedFile(file, fmt.Sprintf("%s/public/media/%s", rootDir, filename))
-		if err != nil {
-			errors = append(errors, err)
+//failProperty reports err like models.Fail. Version 1 clients of property routes were sent an empty
+//object as the data of failures without field errors, and still are
+func failProperty(c *gin.Context, err error) {
+	problem := apierr.From(err)
+	if _, _, _, ok := problem.V1Response(); !ok && len(problem.Fields) == 0 {
+		problem = problem.V1Data(struct{}{})
+	}
+	models.Fail(c, problem)
+}
+
+//limitUploadBody caps the size of a multipart request before it is parsed
+func limitUploadBody(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.UploadMaxRequest)
+}
+
+//uploadErrorResponse reports a rejected upload as the error the pipeline chose, and anything else as a server error
+func uploadErrorResponse(c *gin.Context, field string, err error) {
+	problem := apierr.From(err)
+	if uploadErr, ok := err.(*upload.Error); ok {
+		problem = problem.WithFields(apierr.Field(field, problem.Code, uploadErr.Error()))
+	}
+	failProperty(c, problem)
+}
+
+//handleMediaUploads runs every file of the form field nameOf through the upload pipeline.
+//Private files go to private storage and can only be downloaded through a signed url
+func handleMediaUploads(c *gin.Context, nameOf string, form *multipart.Form, policy upload.Policy, private bool) ([]*upload.File, error) {
+	store, prefix := storage.Default(), storage.MediaPrefix
+	if private {
+		store, prefix = storage.Private(), storage.DocumentPrefix
+	}
+	return upload.Default().SaveAll(c.Request.Context(), form.File[nameOf], policy, store, prefix)
+}
+
+//mediaDetails reads the optional captions and categories sent along with images and documents.
+//The nth caption belongs to the nth image and the nth category to the nth document
+func mediaDetails(c *gin.Context, form *multipart.Form) ([]string, []string, bool) {
+	captions, categories := form.Value["captions"], form.Value["categories"]
+	for _, caption := range captions {
+		if len(caption) > maxCaptionLength {
+			failProperty(c, apierr.BadRequest.Withf("Captions can't be longer than %d characters", maxCaptionLength))
+			return nil, nil, false
+		}
+	}
+	for _, category := range categories {
+		if !models.IsDocumentCategory(category) {
+			failProperty(c, apierr.BadRequest.Withf("Document category must be one of %s", strings.Join(models.DocumentCategories, ", ")))
+			return nil, nil, false
+		}
+	}
+	return captions, categories, true
+}
+
+//appendImages adds uploaded images missing from the property's gallery, with the caption sent at the same position.
+//The first image becomes the cover when the property has none
+func appendImages(property *models.Property, files []*upload.File, captions []string) {
+	for i, file := range files {
+		if property.ImageIndex(file.Key) >= 0 {
+			continue
+		}
+		image := file.Image()
+		if i < len(captions) {
+			image.Caption = captions[i]
+		}
+		property.Images = append(property.Images, image)
+	}
+	if property.CoverImage == "" && len(property.Images) > 0 {
+		property.CoverImage = property.Images[0].Key
+	}
+}
+
+//appendDocuments adds uploaded documents, filed under the category sent at the same position, as new documents
+//whose first version was uploaded by uploader. Files already attached as a document's current version are skipped
+func appendDocuments(property *models.Property, files []*upload.File, categories []string, uploader string) {
+	for i, file := range files {
+		if documentWithCurrentKey(property, file.Key) {
 			continue
 		}
-		names = append(names, filename)
+		document := models.Document{ID: primitive.NewObjectID().Hex(), Name: file.Name}
+		if i < len(categories) {
+			document.Category = categories[i]
+		}
+		document.AddVersion(documentVersion(file, uploader))
+		property.Documents = append(property.Documents, document)
 	}
+}
 
-	if len(errors) > 0 {
-		return names, errors[0]
+//documentWithCurrentKey reports whether a document of the property currently holds the file stored under key
+func documentWithCurrentKey(property *models.Property, key string) bool {
+	for _, document := range property.Documents {
+		if document.Current().Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+//documentVersion describes an uploaded file as a document version
+func documentVersion(file *upload.File, uploader string) models.DocumentVersion {
+	return models.DocumentVersion{
+		Key:        file.Key,
+		Name:       file.Name,
+		Size:       file.Size,
+		SHA256:     file.SHA256,
+		UploadedBy: uploader,
+		UploadedAt: time.Now().Unix(),
 	}
-	return names, nil
 }
 
 func checkUser(c *gin.Context) (*models.User, string, bool) {
@@ -61,98 +151,136 @@ func checkUser(c *gin.Context) (*models.User, string, bool) {
 	if err != nil {
 		return nil, "", false
 	}
-	res, err := utils.DecodeJWT(c)
-	if err != nil {
-		models.NewResponse(c, http.StatusUnauthorized, err, nil)
-		return nil, "", false
-	}
-
-	userFetch, _ := models.FetchUserByCriterion("id", res["user_id"])
-
-	if userFetch == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("user not found"), struct{}{})
+	userFetch, ok := authenticate(c)
+	if !ok {
 		return nil, "", false
 	}
 
 	if userFetch.Type != models.Manager {
-		models.NewResponse(c, http.StatusUnauthorized, fmt.Errorf("Only managers can create and change properties"), userFetch)
+		message := "Only managers can create and change properties"
+		failProperty(c, apierr.Forbidden.Withf("%s", message).V1(http.StatusUnauthorized, message).V1Data(userFetch))
 		return nil, "", false
 	}
 
 	return userFetch, platform, true
 }
 
-func augmentProperty(c *gin.Context, typed, operation string, f func(map[string]string, string)) {
-	_, _, ok := checkUser(c)
+//augmentProperty adds or removes a landlord or tenant and records it in the audit log as action
+func augmentProperty(c *gin.Context, typed, operation, action string) {
+	manager, _, ok := checkUser(c)
 	if !ok {
 		return
 	}
 
 	data := models.AddLandlord{}
-	c.ShouldBindJSON(&data)
-
-	errorResponse, err := utils.MissingDataResponse(data)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, false)
-		return
-	}
-
-	if len(errorResponse) > 0 {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("You provided invalid %s property details", operation), errorResponse)
+	if !bindJSON(c, &data, operation+" property") {
 		return
 	}
 
-	property, _ := models.FetchPropertyByCriterion("id", data.PropertyID)
-	if property == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("Property not found"), data)
+	property, ok := ownedProperty(c, manager, data.PropertyID, apierr.PropertyNotFound.V1Data(data))
+	if !ok {
 		return
 	}
 
-	userFetch, _ := models.FetchUserByCriterion("id", data.UserID)
+	userFetch, _ := models.FetchUserByID(c.Request.Context(), data.UserID)
 
 	if userFetch == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("user to %s not found", operation), struct{}{})
+		failProperty(c, apierr.UserNotFound.Withf("user to %s not found", operation))
 		return
 	}
 
 	if userFetch.Type != typed {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("Can't not %s non %s to property using this endpoint", operation, typed), struct{}{})
+		failProperty(c, apierr.UserNotFound.Withf("Can't not %s non %s to property using this endpoint", operation, typed))
 		return
 	}
 
+	field := "tenants"
 	if typed == models.Landlord {
-		f(property.Landlord, userFetch.ID)
-	} else if typed == models.Tenant {
-		f(property.Tenants, userFetch.ID)
+		field = "landlord"
 	}
 
-	updateProperty(property)
+	err := models.SetPropertyMember(c.Request.Context(), property.ID, field, userFetch.ID, operation == "add")
+	if err != nil {
+		failProperty(c, updateError(err))
+		return
+	}
+	audit(c, action, userFetch.ID, property.ID, nil, nil)
 
-	models.NewResponse(c, http.StatusOK, fmt.Errorf("New %s added to this property", typed), struct{}{})
+	if operation == "add" {
+		models.Success(c, http.StatusOK, fmt.Sprintf("New %s added to this property", typed), struct{}{})
+	} else {
+		models.Success(c, http.StatusOK, fmt.Sprintf("The %s was removed from this property", typed), struct{}{})
+	}
+}
 
+//propertyFields are the details of property recorded in the audit log when they change
+func propertyFields(property *models.Property) map[string]string {
+	return map[string]string{"name": property.Name, "type": property.Type, "address": property.Address, "status": property.Status}
+}
+
+//canViewProperty reports whether user manages, owns or rents the property
+func canViewProperty(user *models.User, property *models.Property) bool {
+	if user.ID == property.CreatedBy {
+		return true
+	}
+	_, isLandlord := property.Landlord[user.ID]
+	_, isTenant := property.Tenants[user.ID]
+	return isLandlord || isTenant
+}
+
+//matchesETag reports whether an If-Match or If-None-Match header value matches etag. If-Match asks
+//for the strong comparison, under which weak tags never match, If-None-Match for the weak one
+func matchesETag(header, etag string, strong bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
 }
 
 // CreateProperty godoc
-// @Summary endpoint to Create a property. Only manager are capable of creating property
-// @Description
-// @Tags accounts
-// @Accept  json
-// @Param  details body models.CreateProperty true "useraccountdetails"
-// @Produce  json
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /create/property/ [put]
+// @Summary creates a property. Only managers can create properties
+// @Description Send the property details as form fields along with its images and optionally its documents.
+// @Description Repeat the images, documents, captions and categories fields to send several; the nth caption belongs
+// @Description to the nth image and the nth category to the nth document. The first image becomes the cover
+// @Tags properties
+// @Accept  multipart/form-data
+// @Produce  json,application/problem+json
+// @Param  name formData string true "property name"
+// @Param  type formData string true "property type, such as flat or duplex"
+// @Param  address formData string true "property address"
+// @Param  images formData file true "jpeg, png or webp image"
+// @Param  documents formData file false "pdf, jpeg, png, docx, xlsx or odt document, kept in private storage"
+// @Param  captions formData string false "caption of the image at the same position"
+// @Param  categories formData string false "category of the document at the same position" Enums(lease, inspection, certificate)
+// @Success 201 {object} models.SuccessRes{data=models.Property}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 413 {object} models.ProblemRes
+// @Failure 415 {object} models.ProblemRes
+// @Failure 422 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties [post]
 // @Security ApiKeyAuth
 func CreateProperty(c *gin.Context) {
 	userFetch, _, ok := checkUser(c)
 	if !ok {
 		return
 	}
+	limitUploadBody(c)
 	form, err := c.MultipartForm()
 	if err != nil {
-		models.NewResponse(c, http.StatusBadRequest, err, struct{}{})
+		failProperty(c, apierr.BadRequest.Withf("%s", err))
 		return
 	}
 
@@ -161,31 +289,37 @@ func CreateProperty(c *gin.Context) {
 		Type:    strings.Join(form.Value["type"], "\n"),
 		Address: strings.Join(form.Value["address"], "\n"),
 	}
-	_, isError := errorReponses(c, &data, "Create Property")
-	if isError {
+	if !validRequest(c, binding.Validator.ValidateStruct(&data), "Create Property") {
+		return
+	}
+
+	captions, categories, ok := mediaDetails(c, form)
+	if !ok {
 		return
 	}
 
-	images, err := handleMediaUploads(c, "images", form)
+	images, err := handleMediaUploads(c, "images", form, upload.ImagePolicy, false)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, struct{}{})
+		uploadErrorResponse(c, "images", err)
 		return
 	}
 
-	if len(images)<=0{
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("No image provided"), struct{}{})
+	if len(images) <= 0 {
+		failProperty(c, apierr.BadRequest.Withf("No image provided"))
 		return
 	}
 
-	documents, err := handleMediaUploads(c, "documents", form)
+	documents, err := handleMediaUploads(c, "documents", form, upload.DocumentPolicy, true)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, struct{}{})
+		uploadErrorResponse(c, "documents", err)
 		return
 	}
 
 	property := models.Property{}
-	property.Documents = documents
-	property.Images = images
+	property.Documents = []models.Document{}
+	property.Images = []models.Image{}
+	appendDocuments(&property, documents, categories, userFetch.ID)
+	appendImages(&property, images, captions)
 	property.Address = data.Address
 	property.Name = data.Name
 	property.Type = data.Type
@@ -195,152 +329,189 @@ func CreateProperty(c *gin.Context) {
 	property.CreatedBy = userFetch.ID
 	property.Status = "created"
 
-	if err := models.InsertProperty(&property); err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, struct{}{})
+	if err := models.InsertProperty(c.Request.Context(), &property); err != nil {
+		failProperty(c, err)
 		return
 	}
+	audit(c, models.AuditPropertyCreated, property.ID, property.ID, nil, propertyFields(&property))
 
-	models.NewResponse(c, http.StatusCreated, fmt.Errorf("New Property Created"), property)
+	models.Success(c, http.StatusCreated, "New Property Created", property)
 }
 
 // UpdatePropertyRoute godoc
-// @Summary endpoint to edit a property field. Only manager are capable of updating property
-// @Description
-// @Tags accounts
+// @Summary changes the details of a property. Only the manager who created the property can change it
+// @Description Fields left out are kept as they are. Responds with what changed, by field, and the new ETag
+// @Tags properties
 // @Accept  json
-// @Param  details body models.CreateProperty true "useraccountdetails"
-// @Produce  json
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /update/property/ [put]
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  details body models.UpdatePropertyModel true "property fields to change"
+// @Success 200 {object} models.SuccessRes{data=models.FieldChanges}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id} [patch]
 // @Security ApiKeyAuth
 func UpdatePropertyRoute(c *gin.Context) {
-	_, _, ok := checkUser(c)
+	manager, _, ok := checkUser(c)
 	if !ok {
 		return
 	}
 
 	data := models.UpdatePropertyModel{}
-	c.ShouldBindJSON(&data)
-
-	property, _ := models.FetchPropertyByCriterion("id", data.ID)
-	if property == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("Property not found"), data)
+	if !bindJSON(c, &data, "property update") {
 		return
 	}
-	data.ID = ""
-	errorResponse, err := utils.MissingDataResponse(data)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, false)
+
+	property, ok := ownedProperty(c, manager, data.ID, apierr.PropertyNotFound.V1Data(data))
+	if !ok {
 		return
 	}
 
-	v, err := struct2map.Struct2Map(&data)
+	before := propertyFields(property)
+	response := models.FieldChanges{}
+	setField(response, "name", &property.Name, data.Name)
+	setField(response, "type", &property.Type, data.Type)
+	setField(response, "address", &property.Address, data.Address)
+
+	if len(response) <= 0 {
+		models.Success(c, http.StatusOK, "Nothing was updated", response)
+		return
+	}
+	err := updateProperty(c.Request.Context(), property)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, false)
+		failProperty(c, updateError(err))
 		return
 	}
+	auditChange(c, models.AuditPropertyUpdated, property.ID, property.ID, before, propertyFields(property))
 
-	mapToUpdate := make(map[string]interface{})
-	response := make(map[string]interface{})
-	for key, value := range v {
-		_, ok := errorResponse[key]
-		if !ok {
-			mapToUpdate[key] = value
-			response[key] = []string{fmt.Sprintf("%s has been updated to %s", key, value)}
-		}
-	}
+	c.Header("ETag", property.ETag())
+	models.Success(c, http.StatusOK, "Property updated", response)
 
-	if len(response) <= 0 {
-		models.NewResponse(c, http.StatusOK, fmt.Errorf("Nothing was updated"), response)
+}
+
+// GetProperty godoc
+// @Summary returns a property. Only its manager, landlords and tenants can view it
+// @Description Responds with an ETag; send it back in If-None-Match to get a 304 when nothing changed
+// @Tags properties
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-None-Match header string false "ETag of the revision the client has"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Success 304 "the property hasn't changed"
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id} [get]
+// @Security ApiKeyAuth
+func GetProperty(c *gin.Context) {
+	_, err := getPlatform(c)
+	if err != nil {
 		return
 	}
-	data.ID = property.ID
-	mapstructure.Decode(mapToUpdate, property)
-	err = updateProperty(property)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, response)
+	userFetch, ok := authenticate(c)
+	if !ok {
 		return
 	}
 
-	models.NewResponse(c, http.StatusOK, fmt.Errorf("User profile update"), response)
+	property, _ := models.FetchPropertyByID(c.Request.Context(), param(c, "id", "id"))
+	if property == nil || !canViewProperty(userFetch, property) {
+		failProperty(c, apierr.PropertyNotFound)
+		return
+	}
 
+	c.Header("ETag", property.ETag())
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" && matchesETag(ifNoneMatch, property.ETag(), false) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	models.Success(c, http.StatusOK, "Property", property)
 }
 
 // AddLandlordToProperty godoc
-// @Summary endpoint to add a landloard to a property. Only manager are capable of adding landlord property
-// @Description
-// @Tags accounts
+// @Summary makes a landlord one of a property's landlords. Only the manager who created the property can change it
+// @Tags properties
 // @Accept  json
-// @Param  details body models.AddLandlord true "useraccountdetails"
-// @Produce  json
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /property/add-landlord/ [put]
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  details body models.AddLandlord true "landlord to add"
+// @Success 200 {object} models.SuccessRes{data=object}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/landlords [post]
 // @Security ApiKeyAuth
 func AddLandlordToProperty(c *gin.Context) {
-	augmentProperty(c, models.Landlord, "add", func(m map[string]string, id string) {
-		m[id] = id
-	})
+	augmentProperty(c, models.Landlord, "add", models.AuditPropertyLandlordAdded)
 }
 
 // RemoveLandlordFromProperty godoc
-// @Summary endpoint to remove a landloard from a property. Only manager are capable of adding landlord property
-// @Description
-// @Tags accounts
-// @Accept  json
-// @Param  details body models.AddLandlord true "useraccountdetails"
-// @Produce  json
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /property/remove-landlord/ [put]
+// @Summary removes a landlord from a property. Only the manager who created the property can change it
+// @Tags properties
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  userId path string true "landlord user id"
+// @Success 200 {object} models.SuccessRes{data=object}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/landlords/{userId} [delete]
 // @Security ApiKeyAuth
 func RemoveLandlordFromProperty(c *gin.Context) {
-	augmentProperty(c, models.Landlord, "remove", func(m map[string]string, id string) {
-		delete(m, id)
-	})
+	augmentProperty(c, models.Landlord, "remove", models.AuditPropertyLandlordRemoved)
 }
 
 // AddTenantToProperty godoc
-// @Summary endpoint to add a tenant to a property. Only manager are capable of adding landlord property
-// @Description
-// @Tags accounts
+// @Summary makes a tenant one of a property's tenants. Only the manager who created the property can change it
+// @Tags properties
 // @Accept  json
-// @Param  details body models.AddLandlord true "useraccountdetails"
-// @Produce  json
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /property/add-tenant/ [put]
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  details body models.AddLandlord true "tenant to add"
+// @Success 200 {object} models.SuccessRes{data=object}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/tenants [post]
 // @Security ApiKeyAuth
 func AddTenantToProperty(c *gin.Context) {
-	augmentProperty(c, models.Tenant, "add", func(m map[string]string, id string) {
-		m[id] = id
-	})
+	augmentProperty(c, models.Tenant, "add", models.AuditPropertyTenantAdded)
 }
 
 // RemoveTenantFromProperty godoc
-// @Summary endpoint to remove a tanent from a property. Only manager are capable of adding landlord property
-// @Description
-// @Tags accounts
-// @Accept  json
-// @Param  details body models.AddLandlord true "useraccountdetails"
-// @Produce  json
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /property/remove-tenant/ [put]
+// @Summary removes a tenant from a property. Only the manager who created the property can change it
+// @Tags properties
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  userId path string true "tenant user id"
+// @Success 200 {object} models.SuccessRes{data=object}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/tenants/{userId} [delete]
 // @Security ApiKeyAuth
 func RemoveTenantFromProperty(c *gin.Context) {
-	augmentProperty(c, models.Tenant, "remove", func(m map[string]string, id string) {
-		delete(m, id)
-	})
+	augmentProperty(c, models.Tenant, "remove", models.AuditPropertyTenantRemoved)
 }
@@ -0,0 +1,515 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"properlyauth/apierr"
+	"properlyauth/logging"
+	"properlyauth/models"
+	"properlyauth/storage"
+	"properlyauth/upload"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//maxCaptionLength is the longest caption an image can have
+const maxCaptionLength = 500
+
+//managedProperty fetches the property with id for the manager who created it, honouring If-Match
+func managedProperty(c *gin.Context, id string) (*models.User, *models.Property, bool) {
+	userFetch, _, ok := checkUser(c)
+	if !ok {
+		return nil, nil, false
+	}
+	property, ok := ownedProperty(c, userFetch, id, apierr.PropertyNotFound)
+	return userFetch, property, ok
+}
+
+//ownedProperty fetches the property with id when manager created it, honouring If-Match. It fails
+//with notFound when there is no such property or another manager created it
+func ownedProperty(c *gin.Context, manager *models.User, id string, notFound *apierr.Error) (*models.Property, bool) {
+	property, _ := models.FetchPropertyByID(c.Request.Context(), id)
+	if property == nil || property.CreatedBy != manager.ID {
+		failProperty(c, notFound)
+		return nil, false
+	}
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" && !matchesETag(ifMatch, property.ETag(), true) {
+		c.Header("ETag", property.ETag())
+		failProperty(c, apierr.PreconditionFailed)
+		return nil, false
+	}
+	return property, true
+}
+
+//savePropertyMedia stores the changed property, records the change in the audit log as action and responds with it.
+//It reports whether the property was stored
+func savePropertyMedia(c *gin.Context, property *models.Property, message, action string, before, after map[string]string) bool {
+	if err := updateProperty(c.Request.Context(), property); err != nil {
+		failProperty(c, updateError(err))
+		return false
+	}
+	audit(c, action, property.ID, property.ID, before, after)
+	c.Header("ETag", property.ETag())
+	models.Success(c, http.StatusOK, message, property)
+	return true
+}
+
+//fileKeys lists the storage keys of files, comma separated, for the audit log
+func fileKeys(files []*upload.File) string {
+	keys := make([]string, 0, len(files))
+	for _, file := range files {
+		keys = append(keys, file.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+//imageKeys lists the keys of images, comma separated, for the audit log
+func imageKeys(images []models.Image) string {
+	keys := make([]string, 0, len(images))
+	for _, image := range images {
+		keys = append(keys, image.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+//removeStoredFiles deletes the files of a removed image or document unless another property or user still refers to them.
+//The property no longer lists them so failures are only logged
+func removeStoredFiles(c *gin.Context, store storage.Storage, key string, variants map[string]models.ImageVariant) {
+	references, err := models.MediaReferences(c.Request.Context(), key)
+	if err != nil {
+		logging.FromContext(c).Error("counting media references failed", slog.String("key", key), slog.String("error", err.Error()))
+		return
+	}
+	if references > 0 {
+		return
+	}
+	keys := []string{key}
+	for _, variant := range variants {
+		keys = append(keys, variant.Key, variant.WebP)
+	}
+	for _, key := range keys {
+		if err := store.Delete(c.Request.Context(), key); err != nil && err != storage.ErrNotFound {
+			logging.FromContext(c).Error("deleting a removed file failed", slog.String("key", key), slog.String("error", err.Error()))
+		}
+	}
+}
+
+//discardUploads deletes the files stored for a change that couldn't be saved, such as one refused
+//with a version conflict. Files another property or user refers to are kept
+func discardUploads(c *gin.Context, store storage.Storage, files []*upload.File) {
+	for _, file := range files {
+		removeStoredFiles(c, store, file.Key, file.Image().Variants)
+	}
+}
+
+// AddPropertyImages godoc
+// @Summary appends images to a property's gallery. Only the manager who created the property can change it
+// @Description Repeat the images field to send several, and optionally the captions field with a caption per image in the same order.
+// @Description The first image becomes the cover when the property has none
+// @Tags property media
+// @Accept  multipart/form-data
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  images formData file true "jpeg, png or webp image"
+// @Param  captions formData string false "caption of the image at the same position"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 413 {object} models.ProblemRes
+// @Failure 415 {object} models.ProblemRes
+// @Failure 422 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/images [post]
+// @Security ApiKeyAuth
+func AddPropertyImages(c *gin.Context) {
+	_, property, ok := managedProperty(c, param(c, "id", "id"))
+	if !ok {
+		return
+	}
+	limitUploadBody(c)
+	form, err := c.MultipartForm()
+	if err != nil {
+		failProperty(c, apierr.BadRequest.Withf("%s", err))
+		return
+	}
+	captions, _, ok := mediaDetails(c, form)
+	if !ok {
+		return
+	}
+	images, err := handleMediaUploads(c, "images", form, upload.ImagePolicy, false)
+	if err != nil {
+		uploadErrorResponse(c, "images", err)
+		return
+	}
+	if len(images) <= 0 {
+		failProperty(c, apierr.BadRequest.Withf("No image provided"))
+		return
+	}
+
+	appendImages(property, images, captions)
+	if !savePropertyMedia(c, property, "Images added", models.AuditPropertyImagesAdded, nil, map[string]string{"images": fileKeys(images)}) {
+		discardUploads(c, storage.Default(), images)
+	}
+}
+
+// AddPropertyDocuments godoc
+// @Summary attaches documents to a property. Only the manager who created the property can change it
+// @Description Repeat the documents field to send several, and optionally the categories field with a category per document in the same order
+// @Tags property media
+// @Accept  multipart/form-data
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  documents formData file true "pdf, jpeg, png, docx, xlsx or odt document"
+// @Param  categories formData string false "category of the document at the same position" Enums(lease, inspection, certificate)
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 413 {object} models.ProblemRes
+// @Failure 415 {object} models.ProblemRes
+// @Failure 422 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/documents [post]
+// @Security ApiKeyAuth
+func AddPropertyDocuments(c *gin.Context) {
+	userFetch, property, ok := managedProperty(c, param(c, "id", "id"))
+	if !ok {
+		return
+	}
+	limitUploadBody(c)
+	form, err := c.MultipartForm()
+	if err != nil {
+		failProperty(c, apierr.BadRequest.Withf("%s", err))
+		return
+	}
+	_, categories, ok := mediaDetails(c, form)
+	if !ok {
+		return
+	}
+	files, err := handleMediaUploads(c, "documents", form, upload.DocumentPolicy, true)
+	if err != nil {
+		uploadErrorResponse(c, "documents", err)
+		return
+	}
+	if len(files) <= 0 {
+		failProperty(c, apierr.BadRequest.Withf("No document provided"))
+		return
+	}
+
+	appendDocuments(property, files, categories, userFetch.ID)
+	if !savePropertyMedia(c, property, "Documents added", models.AuditPropertyDocumentsAdded, nil, map[string]string{"documents": fileKeys(files)}) {
+		discardUploads(c, storage.Private(), files)
+	}
+}
+
+// DeletePropertyImage godoc
+// @Summary removes an image from a property's gallery and deletes its files
+// @Description Files shared with another property or user are kept. Removing the cover makes the next image the cover
+// @Tags property media
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  key path string true "image key as listed in the property images, such as media/3f2a.jpg"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/images/{key} [delete]
+// @Security ApiKeyAuth
+func DeletePropertyImage(c *gin.Context) {
+	_, property, ok := managedProperty(c, param(c, "id", "id"))
+	if !ok {
+		return
+	}
+	index := property.ImageIndex(param(c, "key", "key"))
+	if index < 0 {
+		failProperty(c, apierr.ImageNotFound)
+		return
+	}
+
+	removed := property.Images[index]
+	property.Images = append(property.Images[:index], property.Images[index+1:]...)
+	if property.CoverImage == removed.Key {
+		property.CoverImage = ""
+		if len(property.Images) > 0 {
+			property.CoverImage = property.Images[0].Key
+		}
+	}
+	if savePropertyMedia(c, property, "Image removed", models.AuditPropertyImageRemoved, map[string]string{"image": removed.Key}, nil) {
+		removeStoredFiles(c, storage.Default(), removed.Key, removed.Variants)
+	}
+}
+
+// DeletePropertyDocument godoc
+// @Summary removes a document from a property and deletes the files of all its versions
+// @Description Files shared with another property are kept
+// @Tags property media
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  documentId path string true "document id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/documents/{documentId} [delete]
+// @Security ApiKeyAuth
+func DeletePropertyDocument(c *gin.Context) {
+	_, property, ok := managedProperty(c, param(c, "id", "id"))
+	if !ok {
+		return
+	}
+	index := property.DocumentIndex(param(c, "documentId", "document"))
+	if index < 0 {
+		failProperty(c, apierr.DocumentNotFound)
+		return
+	}
+
+	removed := property.Documents[index]
+	property.Documents = append(property.Documents[:index], property.Documents[index+1:]...)
+	before := map[string]string{"document": removed.ID, "name": removed.Name}
+	if savePropertyMedia(c, property, "Document removed", models.AuditPropertyDocumentRemoved, before, nil) {
+		for _, version := range removed.Versions {
+			removeStoredFiles(c, storage.Private(), version.Key, nil)
+		}
+	}
+}
+
+// AddDocumentVersion godoc
+// @Summary uploads a new version of a property document, such as a renewed lease or certificate
+// @Description Earlier versions stay downloadable until the retention policy prunes them
+// @Tags property media
+// @Accept  multipart/form-data
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  documentId path string true "document id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  document formData file true "pdf, jpeg, png, docx, xlsx or odt document"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 413 {object} models.ProblemRes
+// @Failure 415 {object} models.ProblemRes
+// @Failure 422 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/documents/{documentId}/versions [post]
+// @Security ApiKeyAuth
+func AddDocumentVersion(c *gin.Context) {
+	userFetch, property, ok := managedProperty(c, param(c, "id", "id"))
+	if !ok {
+		return
+	}
+	index := property.DocumentIndex(param(c, "documentId", "document"))
+	if index < 0 {
+		failProperty(c, apierr.DocumentNotFound)
+		return
+	}
+	limitUploadBody(c)
+	_, fileHeader, err := c.Request.FormFile("document")
+	if err != nil {
+		failProperty(c, apierr.ValidationFailed.Withf("%s", err).WithFields(apierr.Field("document", "missing", "document file error")))
+		return
+	}
+	file, err := upload.Default().Save(c.Request.Context(), fileHeader, upload.DocumentPolicy, storage.Private(), storage.DocumentPrefix)
+	if err != nil {
+		uploadErrorResponse(c, "document", err)
+		return
+	}
+	document := &property.Documents[index]
+	if document.Current().SHA256 == file.SHA256 {
+		failProperty(c, apierr.BadRequest.Withf("The file is the same as the current version"))
+		return
+	}
+	before := map[string]string{"document": document.ID, "version": strconv.Itoa(document.Current().Number)}
+	document.AddVersion(documentVersion(file, userFetch.ID))
+	after := map[string]string{"document": document.ID, "version": strconv.Itoa(document.Current().Number)}
+	if !savePropertyMedia(c, property, "Document version added", models.AuditPropertyDocumentVersioned, before, after) {
+		discardUploads(c, storage.Private(), []*upload.File{file})
+	}
+}
+
+// SetPropertyCover godoc
+// @Summary makes one of a property's images its cover image
+// @Tags property media
+// @Accept  json
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  details body models.PropertyMedia true "image key"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/cover [put]
+// @Security ApiKeyAuth
+func SetPropertyCover(c *gin.Context) {
+	data := models.PropertyMedia{}
+	if _, isError := errorReponses(c, &data, "cover image"); isError {
+		return
+	}
+	_, property, ok := managedProperty(c, data.PropertyID)
+	if !ok {
+		return
+	}
+	if property.ImageIndex(data.Key) < 0 {
+		failProperty(c, apierr.ImageNotFound)
+		return
+	}
+	before := map[string]string{"cover_image": property.CoverImage}
+	property.CoverImage = data.Key
+	savePropertyMedia(c, property, "Cover image set", models.AuditPropertyCoverChanged, before, map[string]string{"cover_image": property.CoverImage})
+}
+
+// ReorderPropertyImages godoc
+// @Summary reorders a property's gallery
+// @Description Keys must list every image of the property exactly once, in the new order
+// @Tags property media
+// @Accept  json
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  details body models.ReorderImages true "image keys"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/images/order [put]
+// @Security ApiKeyAuth
+func ReorderPropertyImages(c *gin.Context) {
+	data := models.ReorderImages{}
+	if _, isError := errorReponses(c, &data, "image order"); isError {
+		return
+	}
+	_, property, ok := managedProperty(c, data.PropertyID)
+	if !ok {
+		return
+	}
+	if len(data.Keys) != len(property.Images) {
+		failProperty(c, apierr.BadRequest.Withf("Keys must list all %d images of the property", len(property.Images)))
+		return
+	}
+
+	ordered := []models.Image{}
+	seen := map[string]bool{}
+	for _, key := range data.Keys {
+		index := property.ImageIndex(key)
+		if index < 0 || seen[key] {
+			failProperty(c, apierr.BadRequest.Withf("Keys must list all %d images of the property", len(property.Images)))
+			return
+		}
+		seen[key] = true
+		ordered = append(ordered, property.Images[index])
+	}
+	before := map[string]string{"images": imageKeys(property.Images)}
+	property.Images = ordered
+	savePropertyMedia(c, property, "Images reordered", models.AuditPropertyImagesReordered, before, map[string]string{"images": imageKeys(property.Images)})
+}
+
+// CaptionPropertyImage godoc
+// @Summary sets or clears the caption of a property image
+// @Tags property media
+// @Accept  json
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  key path string true "image key as listed in the property images, such as media/3f2a.jpg"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  details body models.ImageCaption true "caption"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/images/{key} [patch]
+// @Security ApiKeyAuth
+func CaptionPropertyImage(c *gin.Context) {
+	data := models.ImageCaption{}
+	if !bindJSON(c, &data, "caption") {
+		return
+	}
+	data.Caption = strings.TrimSpace(data.Caption)
+	_, property, ok := managedProperty(c, data.PropertyID)
+	if !ok {
+		return
+	}
+	index := property.ImageIndex(data.Key)
+	if index < 0 {
+		failProperty(c, apierr.ImageNotFound)
+		return
+	}
+	before := map[string]string{"image": data.Key, "caption": property.Images[index].Caption}
+	property.Images[index].Caption = data.Caption
+	after := map[string]string{"image": data.Key, "caption": data.Caption}
+	savePropertyMedia(c, property, "Caption updated", models.AuditPropertyImageCaptioned, before, after)
+}
+
+// CategorizePropertyDocument godoc
+// @Summary files a property document under a category
+// @Description A blank category leaves the document uncategorized
+// @Tags property media
+// @Accept  json
+// @Produce  json,application/problem+json
+// @Param  id path string true "property id"
+// @Param  documentId path string true "document id"
+// @Param  If-Match header string false "ETag returned by GET /v2/properties/{id}"
+// @Param  details body models.DocumentCategory true "category"
+// @Success 200 {object} models.SuccessRes{data=models.Property}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 412 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/properties/{id}/documents/{documentId} [patch]
+// @Security ApiKeyAuth
+func CategorizePropertyDocument(c *gin.Context) {
+	data := models.DocumentCategory{}
+	if !bindJSON(c, &data, "category") {
+		return
+	}
+	_, property, ok := managedProperty(c, data.PropertyID)
+	if !ok {
+		return
+	}
+	index := property.DocumentIndex(data.DocumentID)
+	if index < 0 {
+		failProperty(c, apierr.DocumentNotFound)
+		return
+	}
+	before := map[string]string{"document": data.DocumentID, "category": property.Documents[index].Category}
+	property.Documents[index].Category = data.Category
+	after := map[string]string{"document": data.DocumentID, "category": data.Category}
+	savePropertyMedia(c, property, "Document category updated", models.AuditPropertyDocumentCategory, before, after)
+}
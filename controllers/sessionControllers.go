@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"properlyauth/apierr"
+	"properlyauth/logging"
+	"properlyauth/mailer"
+	"properlyauth/models"
+	"properlyauth/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//sessionIDKey is the context key of the session the request's token was issued for
+const sessionIDKey = "properly.session_id"
+
+//startSession records a session for user on the device the request comes from and returns a token
+//tied to it. The user is emailed when they sign in from a device they never used before. Devices are
+//remembered from the first sign in after they started to be, so that one isn't reported as new
+func startSession(c *gin.Context, user *models.User, platform string) (string, bool) {
+	ctx := c.Request.Context()
+	now := time.Now().Unix()
+	session := &models.Session{
+		UserID:     user.ID,
+		Platform:   platform,
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+		Device:     models.DeviceKey(platform, c.Request.UserAgent()),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	newDevice, err := models.RememberDevice(ctx, user.ID, session.Device)
+	if err != nil {
+		models.Fail(c, err)
+		return "", false
+	}
+	if err := models.InsertSession(ctx, session); err != nil {
+		models.Fail(c, err)
+		return "", false
+	}
+	token, err := utils.CreateToken(user.ID, session.ID)
+	if err != nil {
+		models.Fail(c, err)
+		return "", false
+	}
+	if newDevice {
+		notifyNewDevice(c, user, session)
+	}
+	return token, true
+}
+
+//notifyNewDevice emails user that they signed in from a new device. Signing in doesn't fail when the
+//email can't be queued
+func notifyNewDevice(c *gin.Context, user *models.User, session *models.Session) {
+	emailData := map[string]string{
+		"FirstName": user.FirstName,
+		"Platform":  session.Platform,
+		"UserAgent": session.UserAgent,
+		"IP":        session.IP,
+		"Time":      time.Unix(session.CreatedAt, 0).UTC().Format("2006-01-02 15:04 UTC"),
+	}
+	if _, err := mailer.Enqueue(c.Request.Context(), user.Email, getLocale(c), "new_device_signin", emailData); err != nil {
+		logging.FromContext(c).Error("queuing the new device email failed", slog.String("session", session.ID), slog.String("error", err.Error()))
+	}
+}
+
+//activeSession checks that the session id a token was issued for is still active and notes that it
+//was used. Tokens issued before sessions were recorded work until their user signs out everywhere.
+//It costs every authenticated request a lookup of the session by primary key, and a write at most
+//once per SessionTouchInterval. The lookup isn't cached so a revoked token stops working right away
+//on every instance
+func activeSession(c *gin.Context, user *models.User, id string) bool {
+	if id == "" {
+		if user.SignedOutAt != 0 {
+			models.Fail(c, apierr.SessionEnded)
+			return false
+		}
+		return true
+	}
+	session, _ := models.FetchSession(c.Request.Context(), id)
+	if session == nil || session.UserID != user.ID || !session.Active() {
+		models.Fail(c, apierr.SessionEnded)
+		return false
+	}
+	if err := models.TouchSession(c.Request.Context(), session, time.Now()); err != nil {
+		logging.FromContext(c).Warn("updating when a session was last seen failed", slog.String("session", session.ID), slog.String("error", err.Error()))
+	}
+	c.Set(sessionIDKey, session.ID)
+	return true
+}
+
+// ListSessions godoc
+// @Summary lists where the signed in user is signed in, the most recently used session first
+// @Description current is set on the session of the token the request was made with
+// @Tags accounts
+// @Produce  json,application/problem+json
+// @Success 200 {object} models.SuccessRes{data=[]models.SessionInfo}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/users/me/sessions [get]
+// @Security ApiKeyAuth
+func ListSessions(c *gin.Context) {
+	if _, err := getPlatform(c); err != nil {
+		return
+	}
+	user, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	sessions, err := models.FetchUserSessions(c.Request.Context(), user.ID)
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	current := c.GetString(sessionIDKey)
+	infos := make([]models.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, models.SessionInfo{Session: session, Current: session.ID == current})
+	}
+	models.Success(c, http.StatusOK, "Sessions", infos)
+}
+
+// RevokeSession godoc
+// @Summary signs the signed in user out of one of their sessions
+// @Description The token of the session stops working right away. Revoking the current session signs out
+// @Tags accounts
+// @Produce  json,application/problem+json
+// @Param  id path string true "session id"
+// @Success 200 {object} models.SuccessRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/users/me/sessions/{id} [delete]
+// @Security ApiKeyAuth
+func RevokeSession(c *gin.Context) {
+	if _, err := getPlatform(c); err != nil {
+		return
+	}
+	user, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	id := param(c, "id", "id")
+	if err := models.RevokeSession(c.Request.Context(), user.ID, id); err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = apierr.SessionNotFound
+		}
+		models.Fail(c, err)
+		return
+	}
+	audit(c, models.AuditUserSessionRevoked, user.ID, "", nil, map[string]string{"session": id})
+	models.Success(c, http.StatusOK, "Session revoked", nil)
+}
+
+// RevokeAllSessions godoc
+// @Summary signs the signed in user out everywhere
+// @Description Every token of the user stops working right away, the one the request was made with included
+// @Tags accounts
+// @Produce  json,application/problem+json
+// @Success 200 {object} models.SuccessRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/users/me/sessions [delete]
+// @Security ApiKeyAuth
+func RevokeAllSessions(c *gin.Context) {
+	if _, err := getPlatform(c); err != nil {
+		return
+	}
+	user, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	signedOutAt := time.Now().Unix()
+	if err := models.UpdateUser(c.Request.Context(), user, bson.D{{Key: "$set", Value: bson.M{"signedoutat": signedOutAt}}}); err != nil {
+		models.Fail(c, updateError(err))
+		return
+	}
+	user.SignedOutAt = signedOutAt
+	revoked, err := models.RevokeUserSessions(c.Request.Context(), user.ID)
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	audit(c, models.AuditUserSignedOutEverywhere, user.ID, "", nil, map[string]string{"sessions": strconv.FormatInt(revoked, 10)})
+	models.Success(c, http.StatusOK, "Signed out everywhere", nil)
+}
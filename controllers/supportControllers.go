@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"properlyauth/apierr"
+	"properlyauth/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+//checkSupport verifies the support api key sent in X-Support-Key
+func checkSupport(c *gin.Context) bool {
+	key := c.GetHeader("X-Support-Key")
+	if cfg.SupportAPIKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(cfg.SupportAPIKey)) != 1 {
+		models.Fail(c, apierr.InvalidSupportKey)
+		return false
+	}
+	return true
+}
+
+// OutboxStatus godoc
+// @Summary returns the delivery status of the latest queued emails for support staff
+// @Description Filter by recipient email and status. Email bodies are never returned
+// @Tags support
+// @Produce  json,application/problem+json
+// @Param  email query string false "recipient email"
+// @Param  status query string false "delivery status" Enums(pending, sending, sent, dead)
+// @Success 200 {object} models.SuccessRes{data=[]models.OutboxEmail}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/support/outbox [get]
+// @Security SupportKey
+func OutboxStatus(c *gin.Context) {
+	if !checkSupport(c) {
+		return
+	}
+	emails, err := models.FetchOutboxEmails(c.Request.Context(), c.Query("email"), c.Query("status"), 50)
+	if err != nil {
+		models.Fail(c, err)
+		return
+	}
+	models.Success(c, http.StatusOK, "Email delivery status", emails)
+}
+
+// OutboxEmailStatus godoc
+// @Summary returns the delivery status of a queued email for support staff
+// @Description Email bodies are never returned
+// @Tags support
+// @Produce  json,application/problem+json
+// @Param  id path string true "outbox email id"
+// @Success 200 {object} models.SuccessRes{data=models.OutboxEmail}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/support/outbox/{id} [get]
+// @Security SupportKey
+func OutboxEmailStatus(c *gin.Context) {
+	if !checkSupport(c) {
+		return
+	}
+	email, _ := models.FetchOutboxEmailByID(c.Request.Context(), c.Param("id"))
+	if email == nil {
+		models.Fail(c, apierr.EmailNotFound)
+		return
+	}
+	models.Success(c, http.StatusOK, "Email delivery status", email)
+}
+
+// RequeueOutboxEmail godoc
+// @Summary puts a dead lettered email back in the delivery queue
+// @Tags support
+// @Produce  json,application/problem+json
+// @Param  id path string true "outbox email id"
+// @Success 200 {object} models.SuccessRes{data=models.OutboxEmail}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/support/outbox/{id}/requeue [post]
+// @Security SupportKey
+func RequeueOutboxEmail(c *gin.Context) {
+	if !checkSupport(c) {
+		return
+	}
+	email, _ := models.FetchOutboxEmailByID(c.Request.Context(), c.Param("id"))
+	if email == nil {
+		models.Fail(c, apierr.EmailNotFound)
+		return
+	}
+	if email.Status != models.OutboxDead {
+		models.Fail(c, apierr.BadRequest.Withf("Only dead emails can be requeued, this one is %s", email.Status))
+		return
+	}
+	if err := models.RequeueOutboxEmail(c.Request.Context(), email); err != nil {
+		models.Fail(c, err)
+		return
+	}
+	models.Success(c, http.StatusOK, "Email requeued", email)
+}
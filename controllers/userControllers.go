@@ -1,34 +1,90 @@
 package controllers
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"properlyauth/apierr"
+	"properlyauth/config"
+	"properlyauth/logging"
+	"properlyauth/mailer"
+	"properlyauth/metrics"
 	"properlyauth/models"
+	"properlyauth/password"
+	"properlyauth/storage"
+	"properlyauth/upload"
 	"properlyauth/utils"
+	"properlyauth/validation"
 	"strings"
 	"time"
 
-	"github.com/badoux/checkmail"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 
 	struct2map "github.com/haibeey/struct2Map"
-	"github.com/mitchellh/mapstructure"
 )
 
+var cfg = &config.Config{}
+
+//Configure sets the configuration the handlers use for links and media storage
+func Configure(c *config.Config) {
+	cfg = c
+}
+
+//PlatformHeader is the header clients name their platform, web or mobile, in.
+//Version 1 routes also accept it as the platform query parameter
+const PlatformHeader = "X-Client-Platform"
+
+//defaultPlatformKey is the context key of the platform assumed when a request doesn't name one
+const defaultPlatformKey = "properly.default_platform"
+
+//DefaultPlatform makes requests that don't name their platform come from platform.
+//Without it the platform is required
+func DefaultPlatform(platform string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(defaultPlatformKey, platform)
+		c.Next()
+	}
+}
+
 func getPlatform(c *gin.Context) (string, error) {
-	query := c.Request.URL.Query()
-	platform, ok := query["platform"]
+	platform := c.GetHeader(PlatformHeader)
+	if platform == "" {
+		platform = c.Query("platform")
+	}
+	if platform == "" {
+		platform = c.GetString(defaultPlatformKey)
+	}
+	platform = strings.TrimSpace(platform)
 
-	if !ok || len(platform) <= 0 {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("Invalid platform"), nil)
+	if platform == "" {
+		models.Fail(c, apierr.InvalidPlatform)
 		return "", fmt.Errorf("No query sent for platform type sent")
 	}
-	return strings.Trim(platform[0], " "), nil
+	return platform, nil
+}
+
+//param returns the path parameter name of version 2 routes, or the query parameter key
+//version 1 routes send it in instead
+func param(c *gin.Context, name, key string) string {
+	if value := c.Param(name); value != "" {
+		return strings.TrimPrefix(value, "/")
+	}
+	return c.Query(key)
+}
+
+//getLocale returns the first language the client asked for in Accept-Language
+func getLocale(c *gin.Context) string {
+	accept := c.GetHeader("Accept-Language")
+	if i := strings.IndexAny(accept, ",;"); i >= 0 {
+		accept = accept[:i]
+	}
+	return strings.TrimSpace(accept)
 }
 
 func errorReponses(c *gin.Context, data interface{}, api string) (string, bool) {
@@ -36,17 +92,175 @@ func errorReponses(c *gin.Context, data interface{}, api string) (string, bool)
 	if err != nil {
 		return platform, true
 	}
+	return platform, !bindJSON(c, data, api)
+}
 
-	c.ShouldBindJSON(&data)
-	errorReponse, err := utils.MissingDataResponse(data)
-	if len(errorReponse) > 0 {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("You provided invalid %s details", api), errorReponse)
-		return platform, true
+//normalizer is implemented by request models that tidy up what clients send before it is checked
+type normalizer interface {
+	Normalize()
+}
+
+//bindJSON decodes the request body into data, fills in the fields version 2 routes carry in
+//their path and checks the result against the model's binding tags. Path parameters win over
+//the body. An empty body is checked as an empty request so the client learns which fields are required
+func bindJSON(c *gin.Context, data interface{}, api string) bool {
+	err := json.NewDecoder(c.Request.Body).Decode(data)
+	if err == io.EOF {
+		err = nil
+	}
+	if n, ok := data.(normalizer); ok && err == nil {
+		n.Normalize()
+	}
+	if err == nil {
+		params := map[string][]string{}
+		for _, p := range c.Params {
+			params[p.Key] = []string{strings.TrimPrefix(p.Value, "/")}
+		}
+		err = binding.Uri.BindUri(params, data)
 	}
-	return platform, false
+	return validRequest(c, err, api)
 }
 
-func updateUser(user *models.User) error {
+//validRequest responds with the field errors in err, or a bad request when the body couldn't be read
+func validRequest(c *gin.Context, err error, api string) bool {
+	if err == nil {
+		return true
+	}
+	if fields := validation.Errors(err, getLocale(c)); len(fields) > 0 {
+		models.Fail(c, apierr.ValidationFailed.Withf("You provided invalid %s details", api).WithFields(fields...))
+		return false
+	}
+	models.Fail(c, apierr.BadRequest.Withf("Couldn't read the %s details: %s", api, err))
+	return false
+}
+
+//setField copies value into field when the client sent it and notes the change in response
+func setField(response models.FieldChanges, name string, field *string, value *string) {
+	if value == nil {
+		return
+	}
+	*field = *value
+	response[name] = []string{fmt.Sprintf("%s has been updated to %s", name, *value)}
+}
+
+//acceptablePassword responds with the ways plain breaks the password policy for user
+func acceptablePassword(c *gin.Context, user *models.User, plain string) bool {
+	problems, err := password.Check(getLocale(c), plain, user.RecentPasswords(), user.Email, user.FirstName, user.LastName)
+	if err != nil {
+		models.Fail(c, err)
+		return false
+	}
+	if len(problems) > 0 {
+		models.Fail(c, apierr.ValidationFailed.Withf("Your password doesn't meet the password policy").WithFields(problems...))
+		return false
+	}
+	return true
+}
+
+//setPassword changes user's password and remembers it so it isn't chosen again too soon.
+//A password reset forced by an admin is done once a new password is set
+func setPassword(user *models.User, plain string) {
+	history := user.RecentPasswords()
+	user.Password = utils.SHA256Hash(plain)
+	user.PasswordHistory = password.Remember(history, user.Password)
+	user.PasswordResetRequired = false
+}
+
+//authenticate returns the user the request's token was issued to. Tokens of sessions that were revoked
+//are refused, as are suspended accounts and accounts waiting for a forced password reset
+func authenticate(c *gin.Context) (*models.User, bool) {
+	res, err := utils.DecodeJWT(c)
+	if err != nil {
+		models.Fail(c, apierr.Unauthenticated.Withf("%s", err))
+		return nil, false
+	}
+	userFetch, _ := models.FetchUserByID(c.Request.Context(), res["user_id"])
+	if userFetch == nil {
+		models.Fail(c, apierr.UserNotFound.V1(http.StatusNotFound, "user not found"))
+		return nil, false
+	}
+	if !activeSession(c, userFetch, res["session_id"]) {
+		return nil, false
+	}
+	if err := accountLocked(userFetch); err != nil {
+		models.Fail(c, err)
+		return nil, false
+	}
+	return userFetch, true
+}
+
+//accountLocked returns why user can't sign in or use their token, or nil when they can
+func accountLocked(user *models.User) *apierr.Error {
+	if user.Suspended {
+		return apierr.AccountSuspended
+	}
+	if user.PasswordResetRequired {
+		return apierr.PasswordResetRequired
+	}
+	return nil
+}
+
+//sendPasswordReset saves a reset token for user and emails it to them. Web clients get a link to
+//the reset page, mobile clients a six digit code to type in. It returns the token
+func sendPasswordReset(c *gin.Context, user *models.User, platform string) (string, error) {
+	token := ""
+	emailData := map[string]string{"FirstName": user.FirstName}
+	template := "reset_password_web"
+
+	if platform == "mobile" {
+		token = utils.GenerateRandomDigit(6)
+		template = "reset_password_mobile"
+	} else {
+		token = utils.GenerateRandomDigit(15)
+		token = base64.StdEncoding.EncodeToString([]byte(token))
+		emailData["Link"] = fmt.Sprintf("http://%s/reset/password/?token=%s&&platform=web", cfg.Host, token)
+	}
+	emailData["Token"] = token
+	if err := models.SaveToken(c.Request.Context(), user.Email, token, platform); err != nil {
+		return "", err
+	}
+
+	if _, err := mailer.Enqueue(c.Request.Context(), user.Email, getLocale(c), template, emailData); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//userResponse is user as sent to its owner, without its password hashes, along with token when
+//they just signed up or in. Version 1 responses keep the field names of the User struct
+func userResponse(c *gin.Context, user *models.User, token string) (interface{}, error) {
+	if models.APIVersion(c) >= 2 {
+		if token == "" {
+			return user.Profile(), nil
+		}
+		return models.SignedInProfile{Profile: user.Profile(), Token: token}, nil
+	}
+	v, err := struct2map.Struct2Map(user)
+	if err != nil {
+		return nil, err
+	}
+	delete(v, "Password")
+	delete(v, "PasswordHistory")
+	if token != "" {
+		v["token"] = token
+	}
+	return v, nil
+}
+
+//profileFields are the fields of user that profile updates can change, as recorded in the audit log
+func profileFields(user *models.User) map[string]string {
+	return map[string]string{"firstname": user.FirstName, "lastname": user.LastName, "dob": user.Dob, "phonenumber": user.PhoneNumber}
+}
+
+//updateError maps an error from a versioned update to the catalog error it is reported as
+func updateError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return apierr.NotFound.V1(http.StatusNotFound, err.Error())
+	}
+	return err
+}
+
+func updateUser(ctx context.Context, user *models.User) error {
 	uB, err := bson.Marshal(user)
 	if err != nil {
 		return err
@@ -56,7 +270,8 @@ func updateUser(user *models.User) error {
 	if err != nil {
 		return err
 	}
-	err = models.UpdateUser(user, bson.D{{Key: "$set", Value: update}})
+	delete(update, "version")
+	err = models.UpdateUser(ctx, user, bson.D{{Key: "$set", Value: update}})
 	if err != nil {
 		return err
 	}
@@ -65,156 +280,122 @@ func updateUser(user *models.User) error {
 }
 
 // SignUp godoc
-// @Summary is the endpoint for user signup.
-// A user send a his/her phone number to this endpoint to receive token
-// @Description SignUp user with email or name
+// @Summary creates a user account and signs it in
+// @Description The password must meet the password policy. Field errors are listed in errors. The token is tied to the first session of the user
+// @Tags accounts
 // @Accept  json
-// @Produce  json
-// @Param  userDetails body models.SignUpData true "useraccountdetails"
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /signup/ [post]
+// @Produce  json,application/problem+json
+// @Param  X-Client-Platform header string false "web or mobile, web when left out" Enums(web, mobile)
+// @Param  userDetails body models.SignUpData true "account details"
+// @Success 201 {object} models.SuccessRes{data=models.SignedInProfile}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/users [post]
 func SignUp(c *gin.Context) {
 	data := models.SignUpData{}
-	_, isError := errorReponses(c, &data, "signup")
+	platform, isError := errorReponses(c, &data, "signup")
 	if isError {
 		return
 	}
-	if data.Password != data.ConfirmPassword {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("Passwords does not match"), struct{}{})
-		return
-	}
-	user := &models.User{}
-	switch strings.ToLower(strings.Trim(data.Type, " ")) {
-	case "manager":
-		user.Type = models.Manager
-	case "landlord":
-		user.Type = models.Landlord
-	case "tenant":
-		user.Type = models.Tenant
-	case "vendor":
-		user.Type = models.Vendor
-	default:
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("You have inputed invalid user type"), struct{}{})
-		return
-
-	}
-	if err := checkmail.ValidateFormat(data.Email); err != nil {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("Not a valid email"), struct{}{})
-		return
-	}
 
-	userFound, err := models.FetchUserByCriterion("email", data.Email)
+	userFound, err := models.FetchUserByCriterion(c.Request.Context(), "email", data.Email)
 	if err != nil && err != mongo.ErrNoDocuments {
-		models.NewResponse(c, http.StatusInternalServerError, err, nil)
+		models.Fail(c, err)
 		return
 	}
 	if userFound != nil {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("Email taken"), struct{}{})
+		models.Fail(c, apierr.EmailTaken.V1(http.StatusBadRequest, "Email taken").V1Data(struct{}{}))
 		return
 	}
 
+	user := &models.User{}
+	user.Type = data.Type
 	user.Email = data.Email
 	user.FirstName = data.FirstName
 	user.LastName = data.LastName
-	user.Password = utils.SHA256Hash(data.Password)
+	if !acceptablePassword(c, user, data.Password) {
+		return
+	}
+	setPassword(user, data.Password)
 	user.CreatedAt = time.Now().Unix()
 	user.PUMCCode = utils.GeneratePUMCCode(6)
-	if err := models.InsertUser(user); err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, fmt.Errorf("Something went wrong while inserting user"), struct{}{})
+	if err := models.InsertUser(c.Request.Context(), user); err != nil {
+		models.Fail(c, err)
 		return
 	}
+	c.Set(logging.UserIDKey, user.ID)
+	audit(c, models.AuditUserCreated, user.ID, "", nil, map[string]string{"email": user.Email, "type": user.Type})
 
-	token, err := utils.CreateToken(user.ID)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, fmt.Errorf("Error creating token"), struct{}{})
+	token, ok := startSession(c, user, platform)
+	if !ok {
 		return
 	}
-	v, err := struct2map.Struct2Map(user)
+	v, err := userResponse(c, user, token)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, struct{}{})
+		models.Fail(c, err)
 		return
 	}
-	delete(v, "Password")
-	v["token"] = token
-	models.NewResponse(c, http.StatusCreated, fmt.Errorf("New User Created"), v)
+	models.Success(c, http.StatusCreated, "New User Created", v)
 }
 
 // ResetPassword godoc
-// @Summary ResetPassword send link/token to user depending on the platform
-// @Description user to reset link or tokne to user mail
+// @Summary sends a password reset email
+// @Description Web clients get a link to the reset page, mobile clients a six digit code to type in
 // @Tags accounts
 // @Accept  json
-// @Produce  json
-// @Param userDetails body  body models.ResetPassword true "useraccountdetails"
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /reset/update-password/ [post]
-// @Security ApiKeyAuth
+// @Produce  json,application/problem+json
+// @Param  X-Client-Platform header string false "web or mobile, web when left out" Enums(web, mobile)
+// @Param  userDetails body models.ResetPassword true "account email"
+// @Success 200 {object} models.SuccessRes
+// @Failure 400 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/password-resets [post]
 func ResetPassword(c *gin.Context) {
 	data := models.ResetPassword{}
 	platform, isError := errorReponses(c, &data, "Reset Password")
 	if isError {
 		return
 	}
-	userFound, _ := models.FetchUserByCriterion("email", data.Email)
+	userFound, _ := models.FetchUserByCriterion(c.Request.Context(), "email", data.Email)
 
 	if userFound == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("User not found"), nil)
+		models.Fail(c, apierr.UserNotFound)
 		return
 	}
 
-	body := ``
-	token := ""
-
-	if platform == "mobile" {
-		token = utils.GenerateRandomDigit(6)
-		body = fmt.Sprintf(`
-			<h1>Reset Password request</h1>
-			<p>Your password reset code is %s</p>
-		`, token)
-		if err := models.SaveToken(data.Email, token, platform); err != nil {
-			models.NewResponse(c, http.StatusInternalServerError, fmt.Errorf("Error generating token"), nil)
-			return
-		}
-	} else {
-		token = utils.GenerateRandomDigit(15)
-		token = base64.StdEncoding.EncodeToString([]byte(token))
-		body = fmt.Sprintf(`
-		<h1>Reset Password request</h1>
-		<a href="%s">Password Reset Link</a>
-		`, fmt.Sprintf("http://%s/reset/password/?token=%s&&platform=web", os.Getenv("HOST"), token))
-		if err := models.SaveToken(data.Email, token, platform); err != nil {
-			models.NewResponse(c, http.StatusInternalServerError, fmt.Errorf("Error generating token"), nil)
-			return
-		}
+	token, err := sendPasswordReset(c, userFound, platform)
+	if err != nil {
+		models.Fail(c, err)
+		return
 	}
+	audit(c, models.AuditUserPasswordResetRequested, userFound.ID, "", nil, map[string]string{"platform": platform})
 
-	if err := utils.SendMail(data.Email, "Password Reset from Properly", body); err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, nil)
+	//anyone who knows an email address can ask for a reset, so only version 1 clients, which always
+	//got the token back, still do; the others have to read it from the email
+	if models.APIVersion(c) == 1 {
+		models.Success(c, http.StatusOK, "Reset email sent", models.PasswordReset{Token: token})
 		return
 	}
-
-	models.NewResponse(c, http.StatusOK, fmt.Errorf("Reset email sent"), struct{ Token string }{Token: token})
-	return
+	models.Success(c, http.StatusOK, "Reset email sent", nil)
 }
 
 // ChangePasswordAuth godoc
-// @Summary ChangePasswordAuth changes a user password for an authorized user
-// @Description user to change user password via mail
+// @Summary changes the password of the signed in user
+// @Description The new password must meet the password policy and differ from the latest ones
 // @Tags accounts
 // @Accept  json
-// @Produce  json
-// @Param userDetails body models.ChangeUserPassword true "userdetails"
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /user/change-password/ [post]
+// @Produce  json,application/problem+json
+// @Param  userDetails body models.ChangeUserPassword true "current and new password"
+// @Success 200 {object} models.SuccessRes{data=bool}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/users/me/password [put]
 // @Security ApiKeyAuth
 func ChangePasswordAuth(c *gin.Context) {
 	data := models.ChangeUserPassword{}
@@ -223,318 +404,279 @@ func ChangePasswordAuth(c *gin.Context) {
 		return
 	}
 
-	res, err := utils.DecodeJWT(c)
-	if err != nil {
-		models.NewResponse(c, http.StatusUnauthorized, err, false)
+	userFetch, ok := authenticate(c)
+	if !ok {
 		return
 	}
 
-	userFetch, _ := models.FetchUserByCriterion("id", res["user_id"])
-
-	if userFetch == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("User not found"), false)
+	if userFetch.Password != utils.SHA256Hash(data.OldPassword) {
+		models.Fail(c, apierr.WrongPassword)
 		return
 	}
-
-	if userFetch.Password != utils.SHA256Hash(data.OldPassword) {
-		models.NewResponse(c, http.StatusUnauthorized, fmt.Errorf("Wrong old password"), nil)
+	if !acceptablePassword(c, userFetch, data.Password) {
 		return
 	}
 
-	userFetch.Password = utils.SHA256Hash(data.Password)
+	setPassword(userFetch, data.Password)
 
-	err = updateUser(userFetch)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, false)
+	if err := updateUser(c.Request.Context(), userFetch); err != nil {
+		models.Fail(c, updateError(err))
 		return
 	}
-	models.NewResponse(c, http.StatusOK, fmt.Errorf("Password changed"), true)
+	audit(c, models.AuditUserPasswordChanged, userFetch.ID, "", nil, nil)
+	models.Success(c, http.StatusOK, "Password changed", true)
 }
 
 // ChangePasswordFromToken godoc
-// @Summary ChangePasswordFromToken changes user password from token sent along
-// @Description user to change user password via mail
+// @Summary sets a new password with the token of a password reset email
+// @Description Tokens expire after 30 minutes. The new password must meet the password policy and differ from the latest ones
 // @Tags accounts
 // @Accept  json
-// @Produce  json
-// @Param userDetails body models.ChangeUserPasswordFromToken true "userdetails"
-// @Success 201 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /reset/validate-token/ [post]
-// @Security ApiKeyAuth
+// @Produce  json,application/problem+json
+// @Param  userDetails body models.ChangeUserPasswordFromToken true "account email, reset token and new password"
+// @Success 200 {object} models.SuccessRes
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/password-resets/confirmation [post]
 func ChangePasswordFromToken(c *gin.Context) {
-	var email string
-	var password string
-
 	data := models.ChangeUserPasswordFromToken{}
 	_, isError := errorReponses(c, &data, "Update password")
 	if isError {
 		return
 	}
 
-	tokenData, err := models.FetchToken(data.Email)
+	tokenData, err := models.FetchToken(c.Request.Context(), data.Email)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, struct{}{})
+		models.Fail(c, err)
 		return
 	}
 
 	if time.Now().Unix()-tokenData["time"].(int64) > 1800 {
-		models.NewResponse(c, http.StatusUnauthorized, fmt.Errorf("Token time is expired"), nil)
+		models.Fail(c, apierr.ResetTokenExpired)
 		return
 	}
 	token, ok := tokenData["value"]
 
 	if !ok || token != data.Token {
-		models.NewResponse(c, http.StatusUnauthorized, fmt.Errorf("Invalid Token"), nil)
+		models.Fail(c, apierr.InvalidResetToken)
 		return
 	}
-	email = data.Email
-	password = data.Password
 
-	userFetch, _ := models.FetchUserByCriterion("email", email)
+	userFetch, _ := models.FetchUserByCriterion(c.Request.Context(), "email", data.Email)
 	if userFetch == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("User not found"), nil)
+		models.Fail(c, apierr.UserNotFound)
+		return
+	}
+	if !acceptablePassword(c, userFetch, data.Password) {
 		return
 	}
 
-	userFetch.Password = utils.SHA256Hash(password)
-	err = updateUser(userFetch)
+	setPassword(userFetch, data.Password)
+	err = updateUser(c.Request.Context(), userFetch)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, false)
+		models.Fail(c, updateError(err))
 		return
 	}
-	models.TakeOutToken(data.Email)
-	models.NewResponse(c, http.StatusOK, fmt.Errorf("Password changed"), nil)
+	models.TakeOutToken(c.Request.Context(), data.Email)
+	c.Set(logging.UserIDKey, userFetch.ID)
+	audit(c, models.AuditUserPasswordReset, userFetch.ID, "", nil, nil)
+	models.Success(c, http.StatusOK, "Password changed", nil)
 
 }
 
 // SignIn godoc
-// @Summary SignIn is used to login a user
-// @Description login a user
+// @Summary signs a user in
+// @Description Unknown emails and wrong passwords are both reported as invalid_credentials. Suspended accounts are refused
+// @Description with account_suspended and accounts an admin asked to reset their password with password_reset_required.
+// @Description Every sign in starts a session. Users are emailed when they sign in from a platform and browser or app they never used before
 // @Tags accounts
 // @Accept  json
-// @Produce  json
-// @Param userDetails body models.LoginData true "useraccountdetails"
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /login/ [post]
-// @Security ApiKeyAuth
+// @Produce  json,application/problem+json
+// @Param  X-Client-Platform header string false "web or mobile, web when left out" Enums(web, mobile)
+// @Param  userDetails body models.LoginData true "email and password"
+// @Success 200 {object} models.SuccessRes{data=models.SignedInProfile}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/sessions [post]
 func SignIn(c *gin.Context) {
 	data := models.LoginData{}
-	_, isError := errorReponses(c, &data, "Login")
+	platform, isError := errorReponses(c, &data, "Login")
 	if isError {
+		metrics.LoginFailed("invalid_request")
 		return
 	}
 
-	if err := checkmail.ValidateFormat(data.Email); err != nil {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("Not a valid email"), struct{ Email []string }{Email: []string{"Invalid Email"}})
-		return
-	}
-
-	userFound, err := models.FetchUserByCriterion("email", data.Email)
+	userFound, err := models.FetchUserByCriterion(c.Request.Context(), "email", data.Email)
 
 	if err != nil && err != mongo.ErrNoDocuments {
-		models.NewResponse(c, http.StatusInternalServerError, err, nil)
+		models.Fail(c, err)
 		return
 	}
 
 	if userFound == nil {
-		models.NewResponse(c, http.StatusUnauthorized, fmt.Errorf("Invalid login details"), nil)
+		metrics.LoginFailed("unknown_user")
+		models.Fail(c, apierr.InvalidCredentials)
 		return
 	}
 
 	if userFound.Password != utils.SHA256Hash(data.Password) {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("Incorrect  Login details"), nil)
+		metrics.LoginFailed("wrong_password")
+		models.Fail(c, apierr.InvalidCredentials.V1(http.StatusBadRequest, "Incorrect  Login details"))
+		return
+	}
+	if err := accountLocked(userFound); err != nil {
+		metrics.LoginFailed(err.Code)
+		models.Fail(c, err)
 		return
 	}
 
-	token, err := utils.CreateToken(userFound.ID)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, fmt.Errorf("Error creating token"), nil)
+	token, ok := startSession(c, userFound, platform)
+	if !ok {
 		return
 	}
-	v, err := struct2map.Struct2Map(userFound)
+	v, err := userResponse(c, userFound, token)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, nil)
+		models.Fail(c, err)
 		return
 	}
-	delete(v, "Password")
-	v["token"] = token
-	models.NewResponse(c, http.StatusOK, fmt.Errorf("User signed in"), v)
+	metrics.LoginSucceeded()
+	models.Success(c, http.StatusOK, "User signed in", v)
 }
 
 // UserProfile godoc
-// @Summary returns the user profile
-// @Description
+// @Summary returns the profile of the signed in user
 // @Tags accounts
-// @Accept  json
-// @Produce  json
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /user/ [get]
+// @Produce  json,application/problem+json
+// @Success 200 {object} models.SuccessRes{data=models.Profile}
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/users/me [get]
 // @Security ApiKeyAuth
 func UserProfile(c *gin.Context) {
 	_, err := getPlatform(c)
 	if err != nil {
 		return
 	}
-	res, err := utils.DecodeJWT(c)
-	if err != nil {
-		models.NewResponse(c, http.StatusUnauthorized, err, nil)
-		return
-	}
-	userFetch, _ := models.FetchUserByCriterion("id", res["user_id"])
-
-	if userFetch == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("user not found"), nil)
+	userFetch, ok := authenticate(c)
+	if !ok {
 		return
 	}
 
-	v, err := struct2map.Struct2Map(userFetch)
-
+	v, err := userResponse(c, userFetch, "")
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, nil)
+		models.Fail(c, err)
 		return
 	}
-	delete(v, "Password")
 
-	models.NewResponse(c, http.StatusOK, fmt.Errorf("User profile"), v)
+	models.Success(c, http.StatusOK, "User profile", v)
 }
 
 // UpdateProfile godoc
-// @Summary endpoint to update user profile
-// @Description
+// @Summary changes the profile of the signed in user
+// @Description Fields left out are kept as they are. dob and phonenumber are cleared when sent blank.
+// @Description Responds with what changed, by field
 // @Tags accounts
 // @Accept  json
-// @Param  userDetails body models.UpdateUserModel true "useraccountdetails"
-// @Produce  json
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /user/update/ [put]
+// @Produce  json,application/problem+json
+// @Param  userDetails body models.UpdateUserModel true "profile fields to change"
+// @Success 200 {object} models.SuccessRes{data=models.FieldChanges}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/users/me [patch]
 // @Security ApiKeyAuth
 func UpdateProfile(c *gin.Context) {
 	_, err := getPlatform(c)
 	if err != nil {
 		return
 	}
-	res, err := utils.DecodeJWT(c)
-	if err != nil {
-		models.NewResponse(c, http.StatusUnauthorized, err, nil)
+	userFetch, ok := authenticate(c)
+	if !ok {
 		return
 	}
 	data := models.UpdateUserModel{}
-	c.ShouldBindJSON(&data)
-	errorResponse, err := utils.MissingDataResponse(data)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, nil)
+	if !bindJSON(c, &data, "profile") {
 		return
 	}
 
-	userFetch, _ := models.FetchUserByCriterion("id", res["user_id"])
+	before := profileFields(userFetch)
+	response := models.FieldChanges{}
+	setField(response, "firstname", &userFetch.FirstName, data.FirstName)
+	setField(response, "lastname", &userFetch.LastName, data.LastName)
+	setField(response, "dob", &userFetch.Dob, data.Dob)
+	setField(response, "phonenumber", &userFetch.PhoneNumber, data.PhoneNumber)
 
-	if userFetch == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("user not found"), nil)
-		return
-	}
-
-	v, err := struct2map.Struct2Map(&data)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, nil)
+	if len(response) <= 0 {
+		models.Success(c, http.StatusOK, "Nothing was updated", response)
 		return
 	}
-
-	mapToUpdate := make(map[string]interface{})
-	response := make(map[string]interface{})
-	for key, value := range v {
-		_, ok := errorResponse[key]
-		if !ok {
-			mapToUpdate[key] = value
-			response[key] = []string{fmt.Sprintf("%s has been updated to %s", key, value)}
-		}
-	}
-
-	mapstructure.Decode(mapToUpdate, userFetch)
-	err = updateUser(userFetch)
+	err = updateUser(c.Request.Context(), userFetch)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, false)
+		models.Fail(c, updateError(err))
 		return
 	}
-
-	if len(response) <= 0 {
-		models.NewResponse(c, http.StatusOK, fmt.Errorf("Nothing was updated"), response)
-	} else {
-		models.NewResponse(c, http.StatusOK, fmt.Errorf("User profile update"), response)
-	}
+	auditChange(c, models.AuditUserProfileUpdated, userFetch.ID, "", before, profileFields(userFetch))
+	models.Success(c, http.StatusOK, "User profile update", response)
 
 }
 
 // UpdateProfileImage godoc
-// @Summary endpoint to update user profile
-// @Description
+// @Summary replaces the profile image of the signed in user
 // @Tags accounts
-// @Accept  multipart/form-data;
-// @Produce  json
-// @Param  userDetails body models.ProfileImage true "useraccountdetails"
-// @Success 200 {object} models.HTTPRes
-// @Failure 400 {object} models.HTTPRes
-// @Failure 404 {object} models.HTTPRes
-// @Failure 500 {object} models.HTTPRes
-// @Router /user/update-profile-image/ [put]
+// @Accept  multipart/form-data
+// @Produce  json,application/problem+json
+// @Param  image formData file true "jpeg, png or webp image"
+// @Success 200 {object} models.SuccessRes{data=bool}
+// @Failure 400 {object} models.ProblemRes
+// @Failure 401 {object} models.ProblemRes
+// @Failure 403 {object} models.ProblemRes
+// @Failure 404 {object} models.ProblemRes
+// @Failure 409 {object} models.ProblemRes
+// @Failure 413 {object} models.ProblemRes
+// @Failure 415 {object} models.ProblemRes
+// @Failure 422 {object} models.ProblemRes
+// @Failure 500 {object} models.ProblemRes
+// @Router /v2/users/me/profile-image [put]
 // @Security ApiKeyAuth
 func UpdateProfileImage(c *gin.Context) {
 	_, err := getPlatform(c)
 	if err != nil {
 		return
 	}
-	res, err := utils.DecodeJWT(c)
-	if err != nil {
-		models.NewResponse(c, http.StatusUnauthorized, err, nil)
-		return
-	}
-	userFetch, _ := models.FetchUserByCriterion("id", res["user_id"])
-
-	if userFetch == nil {
-		models.NewResponse(c, http.StatusNotFound, fmt.Errorf("user not found"), nil)
+	userFetch, ok := authenticate(c)
+	if !ok {
 		return
 	}
 
-	file, fileHeader, err := c.Request.FormFile("image")
+	limitUploadBody(c)
+	_, fileHeader, err := c.Request.FormFile("image")
 	if err != nil {
-		models.NewResponse(c, http.StatusBadRequest, err, struct{ Image []string }{Image: []string{"image file error"}})
-		return
-	}
-	buff := make([]byte, 512)
-	_, err = file.Read(buff)
-	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, nil)
-		return
-	}
-	rootDir := os.Getenv("ROOTDIR")
-	filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), filepath.Base(fileHeader.Filename))
-	filetype := http.DetectContentType(buff)
-	if filetype != "image/jpeg" && filetype != "image/png" {
-		models.NewResponse(c, http.StatusBadRequest, fmt.Errorf("The provided file format is not allowed. Please upload a JPEG or PNG image"), struct{}{})
+		models.Fail(c, apierr.ValidationFailed.Withf("%s", err).WithFields(apierr.Field("image", "missing", "image file error")).V1Data(struct{ Image []string }{Image: []string{"image file error"}}))
 		return
 	}
-	err = c.SaveUploadedFile(fileHeader, fmt.Sprintf("%s/public/media/%s", rootDir, filename))
+	file, err := upload.Default().Save(c.Request.Context(), fileHeader, upload.ProfileImagePolicy, storage.Default(), storage.MediaPrefix)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, struct{}{})
+		uploadErrorResponse(c, "Image", err)
 		return
 	}
-	userFetch.ProfileImageURL = filename
+	before := map[string]string{"profile_image_url": userFetch.ProfileImageURL}
+	userFetch.ProfileImageURL = file.Key
 
-	err = updateUser(userFetch)
+	err = updateUser(c.Request.Context(), userFetch)
 	if err != nil {
-		models.NewResponse(c, http.StatusInternalServerError, err, false)
+		models.Fail(c, updateError(err))
 		return
 	}
-	models.NewResponse(c, http.StatusOK, fmt.Errorf("Profile image updated"), true)
+	auditChange(c, models.AuditUserProfileUpdated, userFetch.ID, "", before, map[string]string{"profile_image_url": userFetch.ProfileImageURL})
+	models.Success(c, http.StatusOK, "Profile image updated", true)
 }
@@ -3,12 +3,14 @@ package database
 import (
 	"context"
 	"log"
-	"os"
+	"properlyauth/config"
 	"sync"
 	"time"
 
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 const (
@@ -16,6 +18,50 @@ const (
 	DbName = "properly"
 )
 
+var mongoURL = "mongodb://localhost:27017/"
+
+//Configure sets the connection string used for new clients
+func Configure(cfg *config.Config) {
+	if len(cfg.MongoURL) > 0 {
+		mongoURL = cfg.MongoURL
+	}
+}
+
+var monitors []*event.CommandMonitor
+
+//AddMonitor has every client created afterwards report its commands to m. Monitors must be added
+//before the first client is taken from the pool
+func AddMonitor(m *event.CommandMonitor) {
+	monitors = append(monitors, m)
+}
+
+//commandMonitor fans the command events out to every added monitor
+func commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
+
 //DB returns mongodb connecter struct
 type DB struct {
 	client     *mongo.Client
@@ -33,11 +79,11 @@ func (db *DB) GetClient() *mongo.Client {
 	return db.client
 }
 func newDB() *DB {
-	mongourl := os.Getenv("MONGO_URL")
-	if len(mongourl) <= 0 {
-		mongourl = "mongodb://localhost:27017/"
+	opts := options.Client().ApplyURI(mongoURL)
+	if len(monitors) > 0 {
+		opts.SetMonitor(commandMonitor())
 	}
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongourl))
+	client, err := mongo.NewClient(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -51,20 +97,40 @@ func newDB() *DB {
 	return &DB{client: client, ctx: &ctx, cancelFunc: cancelFunc}
 }
 
-//MongoDBPool objects
-var mongoDBPool = sync.Pool{
-	New: func() interface{} {
-		return newDB()
-	},
-}
+var (
+	shared      *DB
+	sharedMutex sync.Mutex
+)
 
-//GetMongoDB returns  a DB instnace from a pool of them
+//GetMongoDB returns the DB shared by the application, connecting it on first use.
+//The client is safe for concurrent use and pools its own connections
 func GetMongoDB() *DB {
-	db := mongoDBPool.Get().(*DB)
-	return db
+	sharedMutex.Lock()
+	defer sharedMutex.Unlock()
+	if shared == nil {
+		shared = newDB()
+	}
+	return shared
 }
 
-//PutDBBack returns a used object back to the pool
-func PutDBBack(db *DB) {
-	mongoDBPool.Put(db)
+//PutDBBack is called once a DB from GetMongoDB is no longer used. The DB is shared so there is nothing to give back
+func PutDBBack(db *DB) {}
+
+//Ping checks that the primary answers before ctx is done
+func Ping(ctx context.Context) error {
+	return GetMongoDB().GetClient().Ping(ctx, readpref.Primary())
+}
+
+//Close disconnects the shared client, waiting for operations in progress until ctx is done.
+//The next call to GetMongoDB connects again
+func Close(ctx context.Context) error {
+	sharedMutex.Lock()
+	defer sharedMutex.Unlock()
+	if shared == nil {
+		return nil
+	}
+	db := shared
+	shared = nil
+	db.Done()
+	return db.client.Disconnect(ctx)
 }
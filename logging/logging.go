@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"properlyauth/config"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	//RequestIDHeader carries the request id in requests and responses
+	RequestIDHeader = "X-Request-ID"
+	//RequestIDKey holds the request id in the gin context
+	RequestIDKey = "request_id"
+	//UserIDKey holds the id of the authenticated user in the gin context
+	UserIDKey = "user_id"
+)
+
+//Configure makes a JSON logger writing to stdout at the level in cfg the default logger.
+//Messages written with the standard log package go through it too
+func Configure(cfg *config.Config) {
+	level := slog.LevelInfo
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+}
+
+//FromContext returns the default logger annotated with the request id, route, user and trace of the request
+func FromContext(c *gin.Context) *slog.Logger {
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	logger := slog.Default().With(
+		slog.String(RequestIDKey, c.GetString(RequestIDKey)),
+		slog.String("method", c.Request.Method),
+		slog.String("route", route),
+		slog.String(UserIDKey, c.GetString(UserIDKey)),
+	)
+	if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+		logger = logger.With(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return logger
+}
+
+//Middleware gives every request an id, taken from X-Request-ID when the client sent a usable one,
+//recovers from panics and logs one line per request. Server errors are logged with the error the
+//handler attached to the context. Query strings are never logged since signed urls carry secrets in them
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(RequestIDKey, id)
+		c.Header(RequestIDHeader, id)
+
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				c.Error(fmt.Errorf("panic: %v", recovered))
+				FromContext(c).Error("panic", slog.String("stack", string(debug.Stack())))
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+					"code":       http.StatusInternalServerError,
+					"message":    "Internal server error",
+					"data":       nil,
+					"error":      "internal_error",
+					RequestIDKey: id,
+				})
+			}
+
+			status := c.Writer.Status()
+			attrs := []any{
+				slog.Int("status", status),
+				slog.Int64("latency_ms", time.Since(start).Milliseconds()),
+				slog.Int("bytes", c.Writer.Size()),
+				slog.String("client_ip", c.ClientIP()),
+			}
+			logger := FromContext(c)
+			switch {
+			case status >= http.StatusInternalServerError:
+				errMessage := "unknown error"
+				if last := c.Errors.Last(); last != nil {
+					errMessage = last.Error()
+				}
+				logger.Error("request failed", append(attrs, slog.String("error", errMessage))...)
+			case status >= http.StatusBadRequest:
+				logger.Warn("request rejected", attrs...)
+			default:
+				logger.Info("request", attrs...)
+			}
+		}()
+		c.Next()
+	}
+}
+
+//validRequestID accepts ids of up to 128 letters, digits, dashes, dots and underscores, so a client
+//can't inject anything into logs or headers through it
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,200 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"properlyauth/config"
+	"sync"
+	"time"
+
+	gomail "gopkg.in/mail.v2"
+)
+
+//Message is a multipart email with an html body and its plain text alternative
+type Message struct {
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+//Mailer delivers a message
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+var (
+	defaultMailer    Mailer = &Memory{}
+	defaultTemplates        = NewTemplates("templates/email")
+	defaultMutex     sync.RWMutex
+)
+
+//Configure builds the mailer and template set described by cfg and makes them the default
+func Configure(cfg *config.Config) {
+	var m Mailer
+	switch cfg.Mailer {
+	case config.FakeMailer:
+		m = &Memory{}
+	case config.CaptureMailer:
+		m = &Capture{Dir: cfg.MailCaptureDir}
+	default:
+		m = NewSMTP(cfg)
+	}
+	SetMailer(m)
+
+	defaultMutex.Lock()
+	defaultTemplates = NewTemplates(cfg.EmailTemplatesDir)
+	defaultMutex.Unlock()
+}
+
+//SetMailer replaces the default mailer
+func SetMailer(m Mailer) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultMailer = m
+}
+
+//Default returns the mailer messages are delivered through
+func Default() Mailer {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultMailer
+}
+
+//Render renders the named template in the closest available locale into a message for recipient
+func Render(recipient, locale, name string, data interface{}) (*Message, error) {
+	defaultMutex.RLock()
+	templates := defaultTemplates
+	defaultMutex.RUnlock()
+	return templates.Render(recipient, locale, name, data)
+}
+
+//SendTemplate renders the named template and delivers it through the default mailer
+func SendTemplate(recipient, locale, name string, data interface{}) error {
+	msg, err := Render(recipient, locale, name, data)
+	if err != nil {
+		return err
+	}
+	return Default().Send(msg)
+}
+
+//SMTP delivers messages through an smtp server
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	//TLS is one of config.TLSImplicit, config.TLSStartTLS or config.TLSNone
+	TLS string
+}
+
+//NewSMTP returns an smtp mailer for the server described in cfg
+func NewSMTP(cfg *config.Config) *SMTP {
+	return &SMTP{
+		Host:     cfg.SMTPHost,
+		Port:     cfg.SMTPPort,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.EmailSender,
+		TLS:      cfg.SMTPTLS,
+	}
+}
+
+//Send delivers the message over smtp
+func (s *SMTP) Send(msg *Message) error {
+	d := gomail.NewDialer(s.Host, s.Port, s.Username, s.Password)
+	switch s.TLS {
+	case config.TLSImplicit:
+		d.SSL = true
+	case config.TLSStartTLS:
+		d.SSL = false
+		d.StartTLSPolicy = gomail.MandatoryStartTLS
+	case config.TLSNone:
+		d.SSL = false
+		d.StartTLSPolicy = gomail.NoStartTLS
+	}
+	if s.Username == "" {
+		d.Auth = nil
+	}
+	return d.DialAndSend(newGomailMessage(s.From, msg))
+}
+
+//Capture writes every message as an .eml file into Dir instead of delivering it.
+//Files are written to Dir/tmp and renamed into Dir/new the way a maildir does, so readers never see partial files
+type Capture struct {
+	Dir string
+}
+
+//Send writes the message into the capture directory
+func (cp *Capture) Send(msg *Message) error {
+	for _, sub := range []string{"tmp", "new"} {
+		if err := os.MkdirAll(filepath.Join(cp.Dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	name := fmt.Sprintf("%d.%s.eml", time.Now().UnixNano(), sanitizeRecipient(msg.To))
+	tmpPath := filepath.Join(cp.Dir, "tmp", name)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := newGomailMessage("capture@localhost", msg).WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(cp.Dir, "new", name))
+}
+
+//Memory records messages in memory instead of delivering them. Only meant for tests
+type Memory struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+//Send records the message
+func (m *Memory) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, *msg)
+	return nil
+}
+
+//Sent returns every message recorded so far
+func (m *Memory) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message{}, m.sent...)
+}
+
+func newGomailMessage(from string, msg *Message) *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", msg.To)
+	m.SetHeader("Subject", msg.Subject)
+	if msg.Text != "" {
+		m.SetBody("text/plain", msg.Text)
+		if msg.HTML != "" {
+			m.AddAlternative("text/html", msg.HTML)
+		}
+	} else {
+		m.SetBody("text/html", msg.HTML)
+	}
+	return m
+}
+
+func sanitizeRecipient(to string) string {
+	out := []rune{}
+	for _, r := range to {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' || r == '@' {
+			out = append(out, r)
+		} else {
+			out = append(out, '_')
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,141 @@
+package mailer
+
+import (
+	"context"
+	"log/slog"
+	"properlyauth/config"
+	"properlyauth/metrics"
+	"properlyauth/models"
+	"properlyauth/tracing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//Enqueue renders the named template and persists it to the outbox. The email is delivered
+//later by a Worker, so a slow or failing smtp server never fails the request that sent it
+func Enqueue(ctx context.Context, recipient, locale, name string, data interface{}) (*models.OutboxEmail, error) {
+	msg, err := Render(recipient, locale, name, data)
+	if err != nil {
+		return nil, err
+	}
+	email := &models.OutboxEmail{
+		To:       msg.To,
+		Template: name,
+		Subject:  msg.Subject,
+		HTML:     msg.HTML,
+		Text:     msg.Text,
+
+		TraceContext: tracing.Carrier(ctx),
+	}
+	if err := models.InsertOutboxEmail(ctx, email); err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
+//Worker delivers outbox emails with exponential backoff between attempts
+type Worker struct {
+	//PollInterval is how long the worker sleeps when nothing is due
+	PollInterval time.Duration
+	//MaxAttempts is the number of failed attempts after which an email is dead lettered
+	MaxAttempts int
+	//BaseDelay is the wait after the first failure, it doubles on every further failure
+	BaseDelay time.Duration
+	//MaxDelay caps the wait between two attempts
+	MaxDelay time.Duration
+	//Lease is how long a claimed email is reserved before another worker may retry it
+	Lease time.Duration
+}
+
+//NewWorker returns a worker using the outbox settings in cfg
+func NewWorker(cfg *config.Config) *Worker {
+	return &Worker{
+		PollInterval: cfg.OutboxPollInterval,
+		MaxAttempts:  cfg.OutboxMaxAttempts,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     6 * time.Hour,
+		Lease:        5 * time.Minute,
+	}
+}
+
+//Run delivers due emails until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	for {
+		delivered, err := w.RunOnce(ctx)
+		if err != nil {
+			slog.Error("outbox delivery failed", slog.String("error", err.Error()))
+		}
+		if delivered > 0 && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.PollInterval):
+		}
+	}
+}
+
+//RunOnce attempts every email that is currently due and returns how many were attempted.
+//Once ctx is cancelled it finishes the email being delivered and stops
+func (w *Worker) RunOnce(ctx context.Context) (int, error) {
+	attempted := 0
+	for ctx.Err() == nil {
+		now := time.Now()
+		email, err := models.ClaimOutboxEmail(ctx, now, w.Lease)
+		if err == mongo.ErrNoDocuments {
+			return attempted, nil
+		}
+		if err != nil {
+			return attempted, err
+		}
+		attempted++
+		//recording the outcome must not be cut short by shutdown or the email would be sent again
+		if err := w.deliver(context.WithoutCancel(ctx), email, now); err != nil {
+			return attempted, err
+		}
+	}
+	return attempted, nil
+}
+
+//deliver sends a claimed email and records the outcome. Each delivery is its own trace, linked to the
+//request that queued the email since the request has usually finished by then
+func (w *Worker) deliver(ctx context.Context, email *models.OutboxEmail, now time.Time) error {
+	ctx, span := tracing.Tracer().Start(ctx, "deliver email",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(tracing.LinkTo(email.TraceContext)),
+		trace.WithAttributes(
+			attribute.String("email.template", email.Template),
+			attribute.Int("email.attempt", email.Attempts+1),
+		),
+	)
+	defer span.End()
+
+	sendErr := Default().Send(&Message{To: email.To, Subject: email.Subject, HTML: email.HTML, Text: email.Text})
+	if sendErr == nil {
+		metrics.EmailSent()
+		return models.MarkOutboxEmailSent(ctx, email)
+	}
+	span.RecordError(sendErr)
+	span.SetStatus(codes.Error, sendErr.Error())
+	dead := email.Attempts+1 >= w.MaxAttempts
+	metrics.EmailFailed(dead)
+	return models.MarkOutboxEmailFailed(ctx, email, sendErr, now.Add(w.backoff(email.Attempts)), dead)
+}
+
+//backoff returns the delay before the next attempt of an email that already failed attempts times
+func (w *Worker) backoff(attempts int) time.Duration {
+	delay := w.BaseDelay
+	for i := 0; i < attempts && delay < w.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.MaxDelay {
+		delay = w.MaxDelay
+	}
+	return delay
+}
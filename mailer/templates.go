@@ -0,0 +1,104 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+//DefaultLocale is used when no template exists for the requested locale
+const DefaultLocale = "en"
+
+//Templates loads email templates from Dir. Every email named N in locale L is made of
+//L/N.html and L/N.txt, and the text template defines the subject with {{define "subject"}}
+type Templates struct {
+	Dir string
+
+	mu    sync.Mutex
+	cache map[string]*emailTemplate
+}
+
+type emailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+//NewTemplates returns a template set rooted at dir
+func NewTemplates(dir string) *Templates {
+	return &Templates{Dir: dir, cache: make(map[string]*emailTemplate)}
+}
+
+//Render executes the named template for the closest locale to the requested one
+func (t *Templates) Render(recipient, locale, name string, data interface{}) (*Message, error) {
+	tmpl, err := t.lookup(locale, name)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{To: recipient}
+	buf := &bytes.Buffer{}
+	if err := tmpl.text.ExecuteTemplate(buf, "subject", data); err != nil {
+		return nil, fmt.Errorf("email template %s has no usable subject: %v", name, err)
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := tmpl.text.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	msg.Text = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := tmpl.html.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	msg.HTML = buf.String()
+	return msg, nil
+}
+
+//Locales returns the candidate locales for a requested locale, most specific first
+//i.e Locales("fr-CA") returns fr-ca, fr and en
+func Locales(locale string) []string {
+	locale = strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+	candidates := []string{}
+	if locale != "" {
+		candidates = append(candidates, locale)
+		if i := strings.Index(locale, "-"); i > 0 {
+			candidates = append(candidates, locale[:i])
+		}
+	}
+	return append(candidates, DefaultLocale)
+}
+
+func (t *Templates) lookup(locale, name string) (*emailTemplate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, candidate := range Locales(locale) {
+		key := filepath.Join(candidate, name)
+		if tmpl, ok := t.cache[key]; ok {
+			return tmpl, nil
+		}
+		htmlPath := filepath.Join(t.Dir, candidate, name+".html")
+		textPath := filepath.Join(t.Dir, candidate, name+".txt")
+		if _, err := os.Stat(htmlPath); err != nil {
+			continue
+		}
+		html, err := htmltemplate.ParseFiles(htmlPath)
+		if err != nil {
+			return nil, err
+		}
+		text, err := texttemplate.ParseFiles(textPath)
+		if err != nil {
+			return nil, err
+		}
+		tmpl := &emailTemplate{html: html, text: text}
+		t.cache[key] = tmpl
+		return tmpl, nil
+	}
+	return nil, fmt.Errorf("no email template %s for locale %s in %s", name, locale, t.Dir)
+}
@@ -1,87 +1,205 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"properlyauth/config"
+	"properlyauth/database"
+	"properlyauth/mailer"
+	"properlyauth/models"
+	"properlyauth/retention"
 	"properlyauth/routes"
-
-	"github.com/joho/godotenv"
+	"properlyauth/storage"
+	"properlyauth/tracing"
+	"properlyauth/upload"
+	"sync"
+	"syscall"
 
 	"properlyauth/docs"
 )
 
-// @title Swagger Example API
-// @version 1.0
-// @description properly backend.
-// @termsOfService http://swagger.io/terms/
-
-// @contact.name API Support
-// @contact.url http://www.swagger.io/support
-// @contact.email support@swagger.io
+//go:generate go run github.com/swaggo/swag/cmd/swag@v1.16.4 init -g main.go -o docs
 
-// @license.name Apache 2.0
-// @license.url http://www.apache.org/licenses/LICENSE-2.0.html
+// @title Properly API
+// @version 2.0
+// @description Properly backend. This documents the version 2 routes, which take ids in the path and answer failures
+// @description with RFC 7807 problems. The version 1 routes under /v1 are deprecated: every response from them carries
+// @description a Deprecation header and a Link header pointing at the route that replaces it.
+// @description Field errors are translated into the language asked for in Accept-Language, English or French.
 
 // @host localhost:8080
 // @BasePath /
 
-// @securityDefinitions.basic BasicAuth
-
 // @securityDefinitions.apikey ApiKeyAuth
 // @in header
 // @name Authorization
+// @description The token returned on sign up and sign in, as Bearer <token>
 
-// @securitydefinitions.oauth2.application OAuth2Application
-// @tokenUrl https://example.com/oauth/token
-// @scope.write Grants write access
-// @scope.admin Grants read and write access to administrative information
-
-// @securitydefinitions.oauth2.implicit OAuth2Implicit
-// @authorizationUrl https://example.com/oauth/authorize
-// @scope.write Grants write access
-// @scope.admin Grants read and write access to administrative information
-
-// @securitydefinitions.oauth2.password OAuth2Password
-// @tokenUrl https://example.com/oauth/token
-// @scope.read Grants read access
-// @scope.write Grants write access
-// @scope.admin Grants read and write access to administrative information
-
-// @securitydefinitions.oauth2.accessCode OAuth2AccessCode
-// @tokenUrl https://example.com/oauth/token
-// @authorizationUrl https://example.com/oauth/authorize
-// @scope.admin Grants read and write access to administrative information
-// @securityDefinitions.apikey ApiKeyAuth
+// @securityDefinitions.apikey SupportKey
 // @in header
-// @name Authorization
+// @name X-Support-Key
+// @description The support api key
+
+// @tag.name accounts
+// @tag.description Sign up, sign in, profiles and passwords
+// @tag.name properties
+// @tag.description Properties and the landlords and tenants attached to them
+// @tag.name property media
+// @tag.description Images and documents of a property
+// @tag.name media
+// @tag.description Downloads of uploaded images and documents
+// @tag.name support
+// @tag.description Tools for support staff
+// @tag.name admin
+// @tag.description Management of user accounts and the audit log, for admins
+// @tag.name health
+// @tag.description Liveness and readiness probes
 
 func main() {
-	err := godotenv.Load(".env")
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	repairIDs := fs.Bool("repair-ids", false, "copy _id into id for documents missing it and exit")
+	moveDocuments := fs.Bool("move-documents", false, "move property documents from public to private storage and exit")
+	processImages := fs.Bool("process-images", false, "strip metadata from and generate variants of images uploaded before they were processed and exit")
+	verifyAudit := fs.Bool("verify-audit", false, "check the hash chain of the audit log and exit, with status 1 when it is broken")
+	grantAdmin := fs.String("grant-admin", "", "make the user with this email an admin and exit. Admins can't sign up, the first one is made this way")
+	cfg, err := config.Load(fs, os.Args[1:])
 	if err != nil {
-		log.Fatalf("Error loading .env file")
+		log.Fatal(err)
 	}
 
-	dir, err := os.Getwd()
+	shutdownTracing, err := tracing.Configure(cfg)
 	if err != nil {
-		log.Fatalf("Can't get current working directory due to error :%v", err)
+		log.Fatalf("Can't export traces to %s: %v", cfg.OTLPEndpoint, err)
+	}
+
+	router := routes.Router(cfg)
+	if err := storage.Configure(cfg); err != nil {
+		log.Fatalf("Can't open %s storage: %v", cfg.StorageBackend, err)
+	}
+
+	if *repairIDs {
+		repaired, err := models.RepairMissingIDs(context.Background())
+		if err != nil {
+			log.Fatalf("Repairing ids failed after %d documents: %v", repaired, err)
+		}
+		log.Printf("Repaired %d documents", repaired)
+		return
+	}
+
+	if *moveDocuments {
+		moved, err := models.MoveDocumentsToPrivateStorage(context.Background(), storage.Default(), storage.Private())
+		if err != nil {
+			log.Fatalf("Moving documents failed after %d documents: %v", moved, err)
+		}
+		log.Printf("Moved %d documents to private storage", moved)
+		return
+	}
+
+	if *processImages {
+		process := func(ctx context.Context, key string) (models.Image, error) {
+			file, err := upload.Default().Reprocess(ctx, storage.Default(), key, storage.MediaPrefix)
+			if err != nil {
+				return models.Image{}, err
+			}
+			return file.Image(), nil
+		}
+		isProcessed := func(ctx context.Context, key string) (bool, error) {
+			_, err := storage.Default().Stat(ctx, upload.VariantKey(key, upload.ImageVariants[0].Name, false))
+			if err == storage.ErrNotFound {
+				return false, nil
+			}
+			return err == nil, err
+		}
+		processed, err := models.ProcessLegacyImages(context.Background(), storage.Default(), process, isProcessed)
+		if err != nil {
+			log.Fatalf("Processing images failed after %d images: %v", processed, err)
+		}
+		log.Printf("Processed %d images", processed)
+		return
 	}
-	os.Setenv("ROOTDIR", dir)
-	if _, err := os.Stat(fmt.Sprintf("%s/public/media", dir)); err != nil {
-		err := os.Mkdir(fmt.Sprintf("%s/public/media", dir), 0755)
+
+	if *verifyAudit {
+		verification, err := models.VerifyAuditLog(context.Background())
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Verifying the audit log failed: %v", err)
 		}
+		if !verification.Valid {
+			log.Fatalf("The audit log is broken at entry %d: %s", verification.BrokenAt, verification.Problem)
+		}
+		log.Printf("The audit log is intact, %d entries checked", verification.Checked)
+		return
 	}
 
-	router := routes.Router()
+	if *grantAdmin != "" {
+		user, err := models.FetchUserByCriterion(context.Background(), "email", *grantAdmin)
+		if err != nil {
+			log.Fatalf("Can't find the user with email %s: %v", *grantAdmin, err)
+		}
+		before := user.Type
+		if err := models.SetUserType(context.Background(), user, models.Admin); err != nil {
+			log.Fatalf("Making %s an admin failed: %v", *grantAdmin, err)
+		}
+		entry := &models.AuditEntry{Actor: models.CLIActor, Action: models.AuditUserTypeChanged, Target: user.ID,
+			Before: map[string]string{"type": before}, After: map[string]string{"type": models.Admin}}
+		if err := models.InsertAuditEntry(context.Background(), entry); err != nil {
+			log.Fatalf("%s is an admin but the change couldn't be audited: %v", *grantAdmin, err)
+		}
+		log.Printf("%s is now an admin", *grantAdmin)
+		return
+	}
 
-	docs.SwaggerInfo.Title = "Properly Swagger Docs"
-	docs.SwaggerInfo.Description = "This is a  Properly  API."
-	docs.SwaggerInfo.Version = "1.0"
-	docs.SwaggerInfo.Host = os.Getenv("HOST")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var workers sync.WaitGroup
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		mailer.NewWorker(cfg).Run(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		retention.NewPruner(cfg).Run(ctx)
+	}()
+
+	docs.SwaggerInfo.Host = cfg.Host
 	docs.SwaggerInfo.BasePath = "/"
 	docs.SwaggerInfo.Schemes = []string{"http", "https"}
-	router.Static("/public", "public")
-	router.Run()
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%s", cfg.Port),
+		Handler:           router,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		log.Fatalf("Server stopped: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+	log.Printf("Shutting down, waiting up to %s for requests in progress", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Requests were still in progress at shutdown: %v", err)
+	}
+	workers.Wait()
+	if err := database.Close(shutdownCtx); err != nil {
+		log.Printf("Closing the database connection failed: %v", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Flushing traces failed: %v", err)
+	}
 }
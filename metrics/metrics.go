@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "properly_http_requests_total",
+		Help: "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "properly_http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "properly_mongo_operation_duration_seconds",
+		Help:    "Mongo command latency by collection and command.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"collection", "command"})
+	mongoErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "properly_mongo_operation_errors_total",
+		Help: "Mongo commands that failed or reported write errors, by collection and command.",
+	}, []string{"collection", "command"})
+	emails = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "properly_email_sends_total",
+		Help: "Email delivery attempts by result: sent, failed or dead once retries are exhausted.",
+	}, []string{"result"})
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "properly_logins_total",
+		Help: "Sign in attempts by result and failure reason.",
+	}, []string{"result", "reason"})
+	auditFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "properly_audit_write_failures_total",
+		Help: "Audit entries that couldn't be appended after the change they record was made. Alert on any increase.",
+	})
+)
+
+//Middleware records the count and latency of requests. Requests matching no route share the
+//unmatched route label so scanners can't blow up the number of series
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+//Handler serves the metrics in the Prometheus text format. When token is set scrapers must send it as a bearer token
+func Handler(token string) gin.HandlerFunc {
+	handler := promhttp.Handler()
+	return func(c *gin.Context) {
+		if token != "" {
+			sent := c.GetHeader("Authorization")
+			if subtle.ConstantTimeCompare([]byte(sent), []byte("Bearer "+token)) != 1 {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+//EmailSent counts an email handed to the mail server
+func EmailSent() {
+	emails.WithLabelValues("sent").Inc()
+}
+
+//EmailFailed counts a failed delivery attempt. dead is set when the email won't be retried
+func EmailFailed(dead bool) {
+	if dead {
+		emails.WithLabelValues("dead").Inc()
+		return
+	}
+	emails.WithLabelValues("failed").Inc()
+}
+
+//LoginSucceeded counts a successful sign in
+func LoginSucceeded() {
+	logins.WithLabelValues("success", "").Inc()
+}
+
+//LoginFailed counts a rejected sign in, reason is a short fixed string such as unknown_user or wrong_password
+func LoginFailed(reason string) {
+	logins.WithLabelValues("failure", reason).Inc()
+}
+
+//AuditWriteFailed counts an audit entry that couldn't be appended
+func AuditWriteFailed() {
+	auditFailures.Inc()
+}
+
+//MongoMonitor returns a command monitor recording the latency and errors of every command sent to Mongo
+func MongoMonitor() *event.CommandMonitor {
+	//commands are matched to their collection by request id since only the started event carries the command
+	var collections sync.Map
+	finished := func(e event.CommandFinishedEvent, failed bool) {
+		collection, ok := collections.LoadAndDelete(e.RequestID)
+		if !ok {
+			return
+		}
+		mongoDuration.WithLabelValues(collection.(string), e.CommandName).Observe(time.Duration(e.DurationNanos).Seconds())
+		if failed {
+			mongoErrors.WithLabelValues(collection.(string), e.CommandName).Inc()
+		}
+	}
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			//the first element of a collection command names the collection, as in {find: "User"}
+			if first, err := e.Command.IndexErr(0); err == nil {
+				if collection, ok := first.Value().StringValueOK(); ok {
+					collections.Store(e.RequestID, collection)
+				}
+			}
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			_, writeErrors := e.Reply.Lookup("writeErrors").ArrayOK()
+			finished(e.CommandFinishedEvent, writeErrors)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			finished(e.CommandFinishedEvent, true)
+		},
+	}
+}
@@ -0,0 +1,326 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"properlyauth/config"
+	"properlyauth/database"
+	"time"
+)
+
+const (
+	//AuditCollectionName holds the append-only record of security and property events
+	AuditCollectionName = "AuditLog"
+)
+
+const (
+	AuditUserCreated                = "user.created"
+	AuditUserProfileUpdated         = "user.profile_updated"
+	AuditUserPasswordChanged        = "user.password_changed"
+	AuditUserPasswordResetRequested = "user.password_reset_requested"
+	AuditUserPasswordReset          = "user.password_reset"
+	AuditUserTypeChanged            = "user.type_changed"
+	AuditUserSuspended              = "user.suspended"
+	AuditUserReactivated            = "user.reactivated"
+	AuditUserPasswordResetForced    = "user.password_reset_forced"
+	AuditUserDeleted                = "user.deleted"
+	AuditUserSessionRevoked         = "user.session_revoked"
+	AuditUserSignedOutEverywhere    = "user.signed_out_everywhere"
+	AuditPropertyCreated            = "property.created"
+	AuditPropertyUpdated            = "property.updated"
+	AuditPropertyLandlordAdded      = "property.landlord_added"
+	AuditPropertyLandlordRemoved    = "property.landlord_removed"
+	AuditPropertyTenantAdded        = "property.tenant_added"
+	AuditPropertyTenantRemoved      = "property.tenant_removed"
+	AuditPropertyImagesAdded        = "property.images_added"
+	AuditPropertyImageRemoved       = "property.image_removed"
+	AuditPropertyImageCaptioned     = "property.image_captioned"
+	AuditPropertyImagesReordered    = "property.images_reordered"
+	AuditPropertyCoverChanged       = "property.cover_changed"
+	AuditPropertyDocumentsAdded     = "property.documents_added"
+	AuditPropertyDocumentRemoved    = "property.document_removed"
+	AuditPropertyDocumentVersioned  = "property.document_version_added"
+	AuditPropertyDocumentCategory   = "property.document_categorized"
+)
+
+const (
+	//AnonymousActor is the actor of events caused by requests without a token, such as password reset requests
+	AnonymousActor = "anonymous"
+	//CLIActor is the actor of events caused from the command line
+	CLIActor = "cli"
+)
+
+//auditKey keys the hashes of audit entries
+var auditKey []byte
+
+//Configure hands models the settings it needs from cfg
+func Configure(cfg *config.Config) {
+	auditKey = []byte(cfg.AuditKey)
+}
+
+//auditAttempts is how many times an entry is appended when other entries keep taking its place in the chain
+const auditAttempts = 10
+
+//AuditEntry records who did what to which user or property, from where, and what changed.
+//Entries form a hash chain: each one carries the hash of the previous one and an HMAC keyed with the
+//audit key over its own fields, so an entry that is edited, removed or slipped in afterwards by someone
+//without the key breaks the chain from there on
+type AuditEntry struct {
+	ID string `json:"id"`
+	//Sequence numbers entries from 1 in the order they were appended, without gaps
+	Sequence int64 `json:"sequence"`
+	//Actor is the id of the user who made the change, or anonymous or cli
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	//Target is the id of the user or property acted on
+	Target string `json:"target"`
+	//Property is the id of the property the event concerns, if any
+	Property string `json:"property"`
+	//Before and After hold the fields that changed, with their old and new values
+	Before    map[string]string `json:"before"`
+	After     map[string]string `json:"after"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	RequestID string            `json:"request_id"`
+	CreatedAt int64             `json:"created_at"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+//AuditFilter narrows down the entries of the audit log. Blank fields don't filter
+type AuditFilter struct {
+	Property string
+	//User matches the entries the user made or was the target of
+	User   string
+	Action string
+	//From and To bound, in unix seconds, when the entries were made
+	From int64
+	To   int64
+}
+
+//AuditPage is one page of the audit entries matching a query
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"per_page"`
+	Total   int64        `json:"total"`
+}
+
+//AuditVerification is the result of checking the hash chain of the audit log
+type AuditVerification struct {
+	//Checked is how many entries were checked
+	Checked int64 `json:"checked"`
+	Valid   bool  `json:"valid"`
+	//BrokenAt is the sequence at which the chain breaks, when it isn't valid
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+//auditHashed lists the fields an entry's hash covers. It is kept apart from AuditEntry so fields
+//added to entries later don't change the hashes of the entries already written
+type auditHashed struct {
+	ID        string            `json:"id"`
+	Sequence  int64             `json:"sequence"`
+	Actor     string            `json:"actor"`
+	Action    string            `json:"action"`
+	Target    string            `json:"target"`
+	Property  string            `json:"property"`
+	Before    map[string]string `json:"before"`
+	After     map[string]string `json:"after"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	RequestID string            `json:"request_id"`
+	CreatedAt int64             `json:"created_at"`
+	PrevHash  string            `json:"prev_hash"`
+}
+
+//ComputeHash returns the HMAC of the entry's fields, PrevHash included
+func (e *AuditEntry) ComputeHash() string {
+	fields := auditHashed{
+		ID:        e.ID,
+		Sequence:  e.Sequence,
+		Actor:     e.Actor,
+		Action:    e.Action,
+		Target:    e.Target,
+		Property:  e.Property,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		RequestID: e.RequestID,
+		CreatedAt: e.CreatedAt,
+		PrevHash:  e.PrevHash,
+	}
+	//maps that come back empty from the database hash the same as the nil maps they were written from
+	if len(e.Before) > 0 {
+		fields.Before = e.Before
+	}
+	if len(e.After) > 0 {
+		fields.After = e.After
+	}
+	b, _ := json.Marshal(fields)
+	mac := hmac.New(sha256.New, auditKey)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//ChangedFields returns the fields whose values differ between before and after
+func ChangedFields(before, after map[string]string) (map[string]string, map[string]string) {
+	changedBefore, changedAfter := map[string]string{}, map[string]string{}
+	for field, value := range after {
+		if before[field] != value {
+			changedBefore[field] = before[field]
+			changedAfter[field] = value
+		}
+	}
+	return changedBefore, changedAfter
+}
+
+//sequenceIndex makes sequence numbers unique so two entries can't take the same place in the chain
+var sequenceIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "sequence", Value: 1}},
+	Options: options.Index().SetName("sequence_unique").SetUnique(true),
+}
+
+//appendToChain numbers entry after the latest entry of the chain and hashes it, then stores it with
+//store. Another entry taking the same place fails store with a duplicate key error and entry is
+//numbered again, up to auditAttempts times
+func appendToChain(ctx context.Context, collection *mongo.Collection, entry *AuditEntry, store func(*AuditEntry) error) error {
+	for attempt := 0; attempt < auditAttempts; attempt++ {
+		latest := &AuditEntry{}
+		err := collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"sequence": -1})).Decode(latest)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		entry.Sequence = latest.Sequence + 1
+		entry.PrevHash = latest.Hash
+		entry.Hash = entry.ComputeHash()
+		err = store(entry)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		return err
+	}
+	return errors.New("audit entry couldn't be appended, the log is too busy")
+}
+
+//InsertAuditEntry appends entry to the audit log, chaining it to the latest entry.
+//There are no functions to change or remove entries
+func InsertAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(AuditCollectionName)
+	if err := ensureIndex(ctx, collection, "sequence_unique", sequenceIndex); err != nil {
+		return err
+	}
+
+	oid := primitive.NewObjectID()
+	entry.ID = oid.Hex()
+	entry.CreatedAt = time.Now().Unix()
+	return appendToChain(ctx, collection, entry, func(entry *AuditEntry) error {
+		doc, err := documentWithID(entry, oid)
+		if err != nil {
+			return err
+		}
+		_, err = collection.InsertOne(ctx, doc)
+		return err
+	})
+}
+
+//FetchAuditEntries returns the page of audit entries matching filter, latest first, along with how many
+//match in total. Pages start at 1
+func FetchAuditEntries(ctx context.Context, filter AuditFilter, page, perPage int) ([]AuditEntry, int64, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(AuditCollectionName)
+
+	query := bson.M{}
+	if filter.Property != "" {
+		query["property"] = filter.Property
+	}
+	if filter.User != "" {
+		query["$or"] = bson.A{bson.M{"actor": filter.User}, bson.M{"target": filter.User}}
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.From != 0 || filter.To != 0 {
+		between := bson.M{}
+		if filter.From != 0 {
+			between["$gte"] = filter.From
+		}
+		if filter.To != 0 {
+			between["$lte"] = filter.To
+		}
+		query["createdat"] = between
+	}
+
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.M{"sequence": -1}).
+		SetSkip(int64((page - 1) * perPage)).
+		SetLimit(int64(perPage))
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := []AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+//VerifyAuditLog walks the audit log in order and checks that no entry is missing and that every
+//entry still hashes to its recorded hash and points at the hash of the one before it
+func VerifyAuditLog(ctx context.Context) (*AuditVerification, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(AuditCollectionName)
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"sequence": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	result := &AuditVerification{Valid: true}
+	previous := AuditEntry{}
+	for cursor.Next(ctx) {
+		entry := AuditEntry{}
+		if err := cursor.Decode(&entry); err != nil {
+			return nil, err
+		}
+		problem := ""
+		switch {
+		case entry.Sequence != previous.Sequence+1:
+			problem = fmt.Sprintf("entry %d is followed by entry %d", previous.Sequence, entry.Sequence)
+		case entry.PrevHash != previous.Hash:
+			problem = fmt.Sprintf("entry %d doesn't point at the hash of entry %d", entry.Sequence, previous.Sequence)
+		case entry.Hash != entry.ComputeHash():
+			problem = fmt.Sprintf("entry %d was changed after it was written", entry.Sequence)
+		}
+		if problem != "" {
+			result.Valid = false
+			result.BrokenAt = entry.Sequence
+			result.Problem = problem
+			return result, nil
+		}
+		result.Checked++
+		previous = entry
+	}
+	return result, cursor.Err()
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"properlyauth/database"
+	"properlyauth/storage"
+	"strings"
+	"time"
+)
+
+//Document is a file attached to a property and kept in private storage. Replacing the file adds
+//a version, earlier versions stay downloadable until the retention policy prunes them
+type Document struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Category string            `json:"category"`
+	Versions []DocumentVersion `json:"versions"`
+}
+
+//DocumentVersion is one immutable upload of a document
+type DocumentVersion struct {
+	Number     int    `json:"number"`
+	Key        string `json:"key"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	UploadedBy string `json:"uploaded_by"`
+	UploadedAt int64  `json:"uploaded_at"`
+	//ReplacedAt is when a newer version was uploaded, zero for the current version
+	ReplacedAt int64 `json:"replaced_at,omitempty"`
+}
+
+//DocumentLink is a signed url to download a document version without an Authorization header
+type DocumentLink struct {
+	URL string `json:"url"`
+	//ExpiresIn is how many seconds the url works for
+	ExpiresIn int64 `json:"expires_in"`
+	Version   int   `json:"version"`
+}
+
+//Current returns the latest version of the document
+func (d *Document) Current() DocumentVersion {
+	if len(d.Versions) == 0 {
+		return DocumentVersion{}
+	}
+	return d.Versions[len(d.Versions)-1]
+}
+
+//Version returns the version numbered number
+func (d *Document) Version(number int) (DocumentVersion, bool) {
+	for _, version := range d.Versions {
+		if version.Number == number {
+			return version, true
+		}
+	}
+	return DocumentVersion{}, false
+}
+
+//AddVersion appends version as the new current version of the document, noting that the version it
+//replaces was replaced when version was uploaded
+func (d *Document) AddVersion(version DocumentVersion) {
+	version.Number = d.Current().Number + 1
+	if len(d.Versions) > 0 {
+		d.Versions[len(d.Versions)-1].ReplacedAt = version.UploadedAt
+	}
+	d.Versions = append(d.Versions, version)
+}
+
+//replacedAt returns when the i-th version was replaced. Versions stored before replacements were
+//noted were replaced when the version after them was uploaded
+func (d *Document) replacedAt(i int) int64 {
+	if d.Versions[i].ReplacedAt != 0 || i+1 >= len(d.Versions) {
+		return d.Versions[i].ReplacedAt
+	}
+	return d.Versions[i+1].UploadedAt
+}
+
+//storedDocument is a document as stored by any revision of the schema
+type storedDocument struct {
+	ID       string
+	Name     string
+	Category string
+	Versions []DocumentVersion
+	//Key is the file of a document stored before documents had versions
+	Key string
+}
+
+//UnmarshalBSONValue decodes a document. Documents stored before versioning, either as a bare key
+//or with a single key, decode to a document whose only version is that key and whose id is the key
+func (d *Document) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	decoded := storedDocument{}
+	if t == bsontype.String {
+		if err := (bson.RawValue{Type: t, Value: data}).Unmarshal(&decoded.Key); err != nil {
+			return err
+		}
+		decoded.Name = decoded.Key[strings.LastIndex(decoded.Key, "/")+1:]
+	} else if err := (bson.RawValue{Type: t, Value: data}).Unmarshal(&decoded); err != nil {
+		return err
+	}
+
+	*d = Document{ID: decoded.ID, Name: decoded.Name, Category: decoded.Category, Versions: decoded.Versions}
+	if len(d.Versions) == 0 && decoded.Key != "" {
+		d.Versions = []DocumentVersion{{Number: 1, Key: decoded.Key, Name: decoded.Name}}
+	}
+	if d.ID == "" {
+		d.ID = d.Current().Key
+	}
+	return nil
+}
+
+//FindDocumentVersion returns the document version stored under key, or mongo.ErrNoDocuments
+//when no property lists it anymore
+func FindDocumentVersion(ctx context.Context, key string) (*DocumentVersion, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
+
+	property := &Property{}
+	filter := bson.M{"$or": []bson.M{
+		{"documents.versions.key": key},
+		{"documents.key": key},
+		{"documents": key},
+	}}
+	if err := collection.FindOne(ctx, filter).Decode(property); err != nil {
+		return nil, err
+	}
+	for _, document := range property.Documents {
+		for _, version := range document.Versions {
+			if version.Key == key {
+				return &version, nil
+			}
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+//PruneDocumentVersions removes document versions replaced before cutoff, keeping the current version
+//of every document, and deletes their files from store once nothing refers to them.
+//It returns the number of pruned versions
+func PruneDocumentVersions(ctx context.Context, cutoff time.Time, store storage.Storage) (int, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
+
+	//a version is replaced after it is uploaded, so only properties with versions uploaded before cutoff
+	//can have versions to prune
+	filter := bson.M{"documents.versions": bson.M{"$elemMatch": bson.M{"uploadedat": bson.M{"$lt": cutoff.Unix()}}}}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	pruned := 0
+	for cursor.Next(ctx) {
+		property := &Property{}
+		if err := cursor.Decode(property); err != nil {
+			return pruned, err
+		}
+		removed := []string{}
+		for i := range property.Documents {
+			document := &property.Documents[i]
+			current := document.Current()
+			kept := []DocumentVersion{}
+			for j, version := range document.Versions {
+				if version.Number == current.Number || document.replacedAt(j) >= cutoff.Unix() {
+					kept = append(kept, version)
+					continue
+				}
+				removed = append(removed, version.Key)
+			}
+			document.Versions = kept
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		update := bson.D{{Key: "$set", Value: bson.M{"documents": property.Documents}}}
+		//a property changed since it was read is pruned on the next run
+		if err := UpdateProperty(ctx, property, update); err == ErrVersionConflict {
+			continue
+		} else if err != nil {
+			return pruned, err
+		}
+		pruned += len(removed)
+		for _, key := range removed {
+			if err := deleteUnreferenced(ctx, store, key); err != nil {
+				return pruned, err
+			}
+		}
+	}
+	return pruned, cursor.Err()
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//documentWithID marshals v into a bson document that carries oid as its _id.
+//The hex id and the primary key are therefore written by a single insert
+func documentWithID(v interface{}, oid primitive.ObjectID) (bson.M, error) {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	doc["_id"] = oid
+	return doc, nil
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sync"
+)
+
+var (
+	indexMutex sync.Mutex
+	indexed    = map[string]bool{}
+)
+
+//ensureIndex creates the index named name on collection the first time it is asked for in the process.
+//Creating an index that already exists is a no-op in mongo, so restarts are safe
+func ensureIndex(ctx context.Context, collection *mongo.Collection, name string, index mongo.IndexModel) error {
+	key := collection.Name() + "." + name
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+	if indexed[key] {
+		return nil
+	}
+	if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+		return err
+	}
+	indexed[key] = true
+	return nil
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"properlyauth/database"
+	"properlyauth/storage"
+	"strings"
+)
+
+const (
+	//LeaseDocument is the category of tenancy agreements
+	LeaseDocument = "lease"
+	//InspectionDocument is the category of inspection reports
+	InspectionDocument = "inspection"
+	//CertificateDocument is the category of safety and compliance certificates
+	CertificateDocument = "certificate"
+)
+
+//DocumentCategories lists the categories a document can be filed under. Documents can also be left uncategorized
+var DocumentCategories = []string{LeaseDocument, InspectionDocument, CertificateDocument}
+
+//IsDocumentCategory reports whether category is blank or one of DocumentCategories
+func IsDocumentCategory(category string) bool {
+	if category == "" {
+		return true
+	}
+	for _, known := range DocumentCategories {
+		if known == category {
+			return true
+		}
+	}
+	return false
+}
+
+//Image is an uploaded image stored without its metadata, along with its resized variants
+type Image struct {
+	Key      string                  `json:"key"`
+	Caption  string                  `json:"caption"`
+	Width    int                     `json:"width"`
+	Height   int                     `json:"height"`
+	Variants map[string]ImageVariant `json:"variants"`
+}
+
+//ImageVariant is a resized copy of an image, stored in the image's format and as lossless WebP
+type ImageVariant struct {
+	Key    string `json:"key"`
+	WebP   string `json:"webp"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+//storedImage has the fields of Image without its bson decoding
+type storedImage Image
+
+//UnmarshalBSONValue decodes an image document. Images uploaded before variants existed were
+//stored as a bare key and decode to an Image with no dimensions or variants
+func (i *Image) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bsontype.String {
+		var key string
+		if err := (bson.RawValue{Type: t, Value: data}).Unmarshal(&key); err != nil {
+			return err
+		}
+		*i = Image{Key: key}
+		return nil
+	}
+	decoded := storedImage{}
+	if err := (bson.RawValue{Type: t, Value: data}).Unmarshal(&decoded); err != nil {
+		return err
+	}
+	*i = Image(decoded)
+	return nil
+}
+
+//MediaReferences counts the properties and users referring to a stored file. Uploads are stored under
+//their checksum so one file can be shared and must only be deleted once nothing refers to it
+func MediaReferences(ctx context.Context, key string) (int64, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+
+	properties, err := client.Database(database.DbName).Collection(PropertyCollectionName).CountDocuments(ctx, bson.M{"$or": []bson.M{
+		{"images.key": key},
+		{"images": key},
+		{"documents.versions.key": key},
+		{"documents.key": key},
+		{"documents": key},
+	}})
+	if err != nil {
+		return 0, err
+	}
+	users, err := client.Database(database.DbName).Collection(UserCollectionName).CountDocuments(ctx, bson.M{"profileimageurl": key})
+	if err != nil {
+		return 0, err
+	}
+	return properties + users, nil
+}
+
+//IsKnownMedia reports whether a property image or profile image is stored under key. Only those are
+//public, anything else found in public storage, such as documents not yet moved to private storage, is not served
+func IsKnownMedia(ctx context.Context, key string) (bool, error) {
+	//files uploaded before storage keys existed are referred to by their bare name
+	keys := []string{key}
+	if strings.HasPrefix(key, storage.MediaPrefix) {
+		keys = append(keys, strings.TrimPrefix(key, storage.MediaPrefix))
+	}
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+
+	users, err := client.Database(database.DbName).Collection(UserCollectionName).CountDocuments(ctx, bson.M{"profileimageurl": bson.M{"$in": keys}})
+	if err != nil || users > 0 {
+		return users > 0, err
+	}
+	properties, err := client.Database(database.DbName).Collection(PropertyCollectionName).CountDocuments(ctx, bson.M{"$or": []bson.M{
+		{"images.key": bson.M{"$in": keys}},
+		{"images": bson.M{"$in": keys}},
+	}})
+	return properties > 0, err
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"path"
+	"properlyauth/database"
+	"properlyauth/storage"
+	"strings"
+)
+
+//RepairMissingIDs copies _id into the id field of users and properties left
+//half written by the old insert-then-update flow. It returns the number of
+//repaired documents and is safe to run more than once
+func RepairMissingIDs(ctx context.Context) (int64, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"id": bson.M{"$exists": false}},
+		bson.M{"id": ""},
+		bson.M{"id": nil},
+	}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"id": bson.M{"$toString": "$_id"}}}},
+	}
+
+	var repaired int64
+	for _, name := range []string{UserCollectionName, PropertyCollectionName} {
+		collection := client.Database(database.DbName).Collection(name)
+		result, err := collection.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return repaired, err
+		}
+		repaired += result.ModifiedCount
+	}
+	return repaired, nil
+}
+
+//MoveDocumentsToPrivateStorage moves property documents uploaded before documents were private
+//out of public storage and rewrites the property to point at the new keys. It returns the number
+//of moved documents and is safe to run more than once
+func MoveDocumentsToPrivateStorage(ctx context.Context, public, private storage.Storage) (int, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
+
+	privateKey := primitive.Regex{Pattern: "^" + storage.DocumentPrefix}
+	filter := bson.M{"$or": []bson.M{
+		{"documents": bson.M{"$elemMatch": bson.M{"$type": "string", "$not": privateKey}}},
+		{"documents": bson.M{"$elemMatch": bson.M{"key": bson.M{"$exists": true, "$not": privateKey}}}},
+		{"documents.versions": bson.M{"$elemMatch": bson.M{"key": bson.M{"$not": privateKey}}}},
+	}}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	moved := 0
+	for cursor.Next(ctx) {
+		property := &Property{}
+		if err := cursor.Decode(property); err != nil {
+			return moved, err
+		}
+		for i := range property.Documents {
+			for j, version := range property.Documents[i].Versions {
+				if strings.HasPrefix(version.Key, storage.DocumentPrefix) {
+					continue
+				}
+				oldKey := storage.MediaKey(version.Key)
+				newKey := storage.DocumentPrefix + path.Base(version.Key)
+				object, info, err := public.Get(ctx, oldKey)
+				if err != nil {
+					return moved, err
+				}
+				err = private.Put(ctx, newKey, object, info.Size, info.ContentType)
+				object.Close()
+				if err != nil {
+					return moved, err
+				}
+				property.Documents[i].Versions[j].Key = newKey
+				update := bson.D{{Key: "$set", Value: bson.M{"documents": property.Documents}}}
+				if err := UpdateProperty(ctx, property, update); err != nil {
+					return moved, err
+				}
+				if err := public.Delete(ctx, oldKey); err != nil {
+					return moved, err
+				}
+				moved++
+			}
+		}
+	}
+	return moved, cursor.Err()
+}
+
+//ImageProcessor stores the image under key without metadata and with resized variants
+type ImageProcessor func(ctx context.Context, key string) (Image, error)
+
+//ImageChecker reports whether the image stored under key was already processed
+type ImageChecker func(ctx context.Context, key string) (bool, error)
+
+//ProcessLegacyImages runs property and profile images uploaded before images were processed
+//through process, rewrites the documents to describe the processed images and deletes the
+//originals. Profile images are only described by their key, so isProcessed tells which of them
+//still need processing. It returns the number of processed images and is safe to run more than once
+func ProcessLegacyImages(ctx context.Context, public storage.Storage, process ImageProcessor, isProcessed ImageChecker) (int, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	processed := 0
+
+	properties := client.Database(database.DbName).Collection(PropertyCollectionName)
+	//legacy images are bare keys, or documents without variants once the property was saved again
+	cursor, err := properties.Find(ctx, bson.M{"$or": []bson.M{
+		{"images": bson.M{"$type": "string"}},
+		{"images": bson.M{"$elemMatch": bson.M{"variants": nil}}},
+	}})
+	if err != nil {
+		return processed, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		property := &Property{}
+		if err := cursor.Decode(property); err != nil {
+			return processed, err
+		}
+		originals := []string{}
+		changed := false
+		for i, image := range property.Images {
+			if image.Variants != nil {
+				continue
+			}
+			oldKey := storage.MediaKey(image.Key)
+			processedImage, err := process(ctx, oldKey)
+			if err != nil {
+				return processed, err
+			}
+			processedImage.Caption = image.Caption
+			property.Images[i] = processedImage
+			changed = true
+			if processedImage.Key != oldKey {
+				originals = append(originals, oldKey)
+				if property.CoverImage == image.Key {
+					property.CoverImage = processedImage.Key
+				}
+			}
+			processed++
+		}
+		if !changed {
+			continue
+		}
+		update := bson.D{{Key: "$set", Value: bson.M{"images": property.Images, "coverimage": property.CoverImage}}}
+		if err := UpdateProperty(ctx, property, update); err != nil {
+			return processed, err
+		}
+		for _, key := range originals {
+			if err := deleteUnreferenced(ctx, public, key); err != nil {
+				return processed, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return processed, err
+	}
+
+	users := client.Database(database.DbName).Collection(UserCollectionName)
+	userCursor, err := users.Find(ctx, bson.M{"profileimageurl": bson.M{"$ne": ""}})
+	if err != nil {
+		return processed, err
+	}
+	defer userCursor.Close(ctx)
+	for userCursor.Next(ctx) {
+		user := &User{}
+		if err := userCursor.Decode(user); err != nil {
+			return processed, err
+		}
+		oldKey := storage.MediaKey(user.ProfileImageURL)
+		done, err := isProcessed(ctx, oldKey)
+		if err != nil {
+			return processed, err
+		}
+		if done {
+			continue
+		}
+		image, err := process(ctx, oldKey)
+		if err != nil {
+			return processed, err
+		}
+		user.ProfileImageURL = image.Key
+		update := bson.D{{Key: "$set", Value: bson.M{"profileimageurl": image.Key}}}
+		if err := UpdateUser(ctx, user, update); err != nil {
+			return processed, err
+		}
+		if image.Key != oldKey {
+			if err := deleteUnreferenced(ctx, public, oldKey); err != nil {
+				return processed, err
+			}
+		}
+		processed++
+	}
+	return processed, userCursor.Err()
+}
+
+//deleteUnreferenced deletes the file stored under key once no property or user refers to it
+func deleteUnreferenced(ctx context.Context, store storage.Storage, key string) error {
+	references, err := MediaReferences(ctx, key)
+	if err != nil || references > 0 {
+		return err
+	}
+	if err := store.Delete(ctx, key); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package models
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"properlyauth/database"
+	"time"
+)
+
+const (
+	//OutboxCollectionName holds emails waiting to be delivered
+	OutboxCollectionName = "EmailOutbox"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+//OutboxEmail is an email persisted before delivery so it survives smtp failures and restarts
+type OutboxEmail struct {
+	ID       string `json:"id"`
+	To       string `json:"to"`
+	Template string `json:"template"`
+	Subject  string `json:"subject"`
+	//HTML and Text are cleared once the email is sent
+	HTML          string `json:"-"`
+	Text          string `json:"-"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	LastError     string `json:"last_error"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	LeaseUntil    int64  `json:"-"`
+	CreatedAt     int64  `json:"created_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+	SentAt        int64  `json:"sent_at"`
+	//TraceContext is the trace context of the request that queued the email, delivery spans link to it
+	TraceContext map[string]string `json:"-"`
+}
+
+func outboxCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(database.DbName).Collection(OutboxCollectionName)
+}
+
+//dueIndex serves the query the worker polls the outbox with
+var dueIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nextattemptat", Value: 1}},
+	Options: options.Index().SetName("status_nextattemptat"),
+}
+
+//InsertOutboxEmail queues an email for delivery
+func InsertOutboxEmail(ctx context.Context, email *OutboxEmail) error {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	oid := primitive.NewObjectID()
+	email.ID = oid.Hex()
+	email.Status = OutboxPending
+	email.CreatedAt = time.Now().Unix()
+	email.UpdatedAt = email.CreatedAt
+	if email.NextAttemptAt == 0 {
+		email.NextAttemptAt = email.CreatedAt
+	}
+	doc, err := documentWithID(email, oid)
+	if err != nil {
+		return err
+	}
+	_, err = outboxCollection(client).InsertOne(ctx, doc)
+	return err
+}
+
+//ClaimOutboxEmail marks the next email that is due as being sent and returns it.
+//An email whose lease ran out, because the worker sending it died, is due again.
+//It returns mongo.ErrNoDocuments when nothing is due
+func ClaimOutboxEmail(ctx context.Context, now time.Time, lease time.Duration) (*OutboxEmail, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	if err := ensureIndex(ctx, outboxCollection(client), "status_nextattemptat", dueIndex); err != nil {
+		return nil, err
+	}
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": OutboxPending, "nextattemptat": bson.M{"$lte": now.Unix()}},
+		bson.M{"status": OutboxSending, "leaseuntil": bson.M{"$lt": now.Unix()}},
+	}}
+	update := bson.M{"$set": bson.M{
+		"status":     OutboxSending,
+		"leaseuntil": now.Add(lease).Unix(),
+		"updatedat":  now.Unix(),
+	}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"nextattemptat": 1}).
+		SetReturnDocument(options.After)
+
+	email := &OutboxEmail{}
+	err := outboxCollection(client).FindOneAndUpdate(ctx, filter, update, opts).Decode(email)
+	if err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
+//MarkOutboxEmailSent records a successful delivery. The bodies are cleared so reset codes and
+//signed links don't outlive the email; the subject and delivery details are kept for support
+func MarkOutboxEmailSent(ctx context.Context, email *OutboxEmail) error {
+	now := time.Now().Unix()
+	email.Status = OutboxSent
+	email.Attempts++
+	email.SentAt = now
+	email.LastError = ""
+	email.HTML = ""
+	email.Text = ""
+	return updateOutboxEmail(ctx, email, bson.M{
+		"status":    email.Status,
+		"attempts":  email.Attempts,
+		"sentat":    now,
+		"lasterror": "",
+		"html":      "",
+		"text":      "",
+		"updatedat": now,
+	})
+}
+
+//MarkOutboxEmailFailed records a failed delivery. The email is retried at next,
+//or moved to the dead letter state when dead is true
+func MarkOutboxEmailFailed(ctx context.Context, email *OutboxEmail, sendErr error, next time.Time, dead bool) error {
+	email.Attempts++
+	email.LastError = sendErr.Error()
+	email.Status = OutboxPending
+	email.NextAttemptAt = next.Unix()
+	if dead {
+		email.Status = OutboxDead
+	}
+	return updateOutboxEmail(ctx, email, bson.M{
+		"status":        email.Status,
+		"attempts":      email.Attempts,
+		"lasterror":     email.LastError,
+		"nextattemptat": email.NextAttemptAt,
+		"updatedat":     time.Now().Unix(),
+	})
+}
+
+//RequeueOutboxEmail moves a dead email back to pending so it is delivered again
+func RequeueOutboxEmail(ctx context.Context, email *OutboxEmail) error {
+	now := time.Now().Unix()
+	email.Status = OutboxPending
+	email.NextAttemptAt = now
+	return updateOutboxEmail(ctx, email, bson.M{
+		"status":        email.Status,
+		"nextattemptat": now,
+		"updatedat":     now,
+	})
+}
+
+func updateOutboxEmail(ctx context.Context, email *OutboxEmail, set bson.M) error {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	s, err := primitive.ObjectIDFromHex(email.ID)
+	if err != nil {
+		return err
+	}
+	_, err = outboxCollection(client).UpdateOne(ctx, bson.M{"_id": s}, bson.M{"$set": set})
+	return err
+}
+
+//FetchOutboxEmailByID returns a queued email by its id
+func FetchOutboxEmailByID(ctx context.Context, id string) (*OutboxEmail, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	s, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	email := &OutboxEmail{}
+	err = outboxCollection(client).FindOne(ctx, bson.M{"_id": s}).Decode(email)
+	if err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
+//FetchOutboxEmails returns the most recent emails queued for a recipient, optionally filtered by status
+func FetchOutboxEmails(ctx context.Context, recipient, status string, limit int64) ([]OutboxEmail, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	filter := bson.M{}
+	if recipient != "" {
+		filter["to"] = recipient
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().SetSort(bson.M{"createdat": -1}).SetLimit(limit)
+	cursor, err := outboxCollection(client).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	emails := []OutboxEmail{}
+	if err := cursor.All(ctx, &emails); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
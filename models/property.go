@@ -2,9 +2,12 @@ package models
 
 import (
 	"context"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"properlyauth/apierr"
 	"properlyauth/database"
 )
 
@@ -15,55 +18,127 @@ const (
 
 //Propertu decribes user property on properly
 type Property struct {
-	ID        string            `json:"id"`
-	Name      string            `json:"name"`
-	Type      string            `json:"type"`
-	Status    string            `json:"status"`
-	Address   string            `json:"address"`
-	Images    []string          `json:"images"`
-	Documents []string          `json:"documents"`
-	Landlord  map[string]string `json:"landlord"`
-	Tenants   map[string]string `json:"tenants"`
-	CreatedAt int64             `json:"created_at"`
-	CreatedBy string            `json:"created_by"`
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Status     string            `json:"status"`
+	Address    string            `json:"address"`
+	Images     []Image           `json:"images"`
+	CoverImage string            `json:"cover_image"`
+	Documents  []Document        `json:"documents"`
+	Landlord   map[string]string `json:"landlord"`
+	Tenants    map[string]string `json:"tenants"`
+	CreatedAt  int64             `json:"created_at"`
+	CreatedBy  string            `json:"created_by"`
+	Version    int64             `json:"version"`
+}
+
+//ImageIndex returns the position of the image stored under key in the gallery, or -1
+func (p *Property) ImageIndex(key string) int {
+	for i, image := range p.Images {
+		if image.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+//DocumentIndex returns the position of the document with id, or -1
+func (p *Property) DocumentIndex(id string) int {
+	for i, document := range p.Documents {
+		if document.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+//ETag returns the entity tag identifying this revision of the property
+func (p *Property) ETag() string {
+	return fmt.Sprintf(`"%s-%d"`, p.ID, p.Version)
 }
 
 //InsertProperty insert a property into the database
-func InsertProperty(property *Property) error {
+func InsertProperty(ctx context.Context, property *Property) error {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
 	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
-	result, err := collection.InsertOne(context.TODO(), property)
+	oid := primitive.NewObjectID()
+	property.ID = oid.Hex()
+	doc, err := documentWithID(property, oid)
 	if err != nil {
+		property.ID = ""
 		return err
 	}
-	property.ID = result.InsertedID.(primitive.ObjectID).Hex()
-	update := bson.D{{Key: "$set", Value: bson.D{{Key: "id", Value: property.ID}}}}
-	err = UpdateProperty(property, update)
-	return err
+	if _, err = collection.InsertOne(ctx, doc); err != nil {
+		property.ID = ""
+		return err
+	}
+	return nil
 }
 
-//UpdateProperty update a property into the database
-func UpdateProperty(property *Property, update interface{}) error {
+//UpdateProperty update a property into the database.
+//The update only applies if the stored property is still at property.Version, otherwise ErrVersionConflict is returned
+func UpdateProperty(ctx context.Context, property *Property, update bson.D) error {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
 	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
-	s, err := primitive.ObjectIDFromHex(property.ID)
+	if err := compareAndSwap(ctx, collection, property.ID, property.Version, update); err != nil {
+		return err
+	}
+	property.Version++
+	return nil
+}
+
+//ErrNotMember is returned when removing a user from a property they aren't a member of
+var ErrNotMember = apierr.UserNotFound.Withf("the user isn't a member of the property")
+
+//SetPropertyMember atomically adds or removes userID from one of the property member maps
+//(landlord or tenants) without touching the rest of the document. Removing a user who isn't
+//a member returns ErrNotMember
+func SetPropertyMember(ctx context.Context, propertyID, field, userID string, add bool) error {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
+	s, err := primitive.ObjectIDFromHex(propertyID)
 	if err != nil {
 		return err
 	}
+	key := fmt.Sprintf("%s.%s", field, userID)
 	filter := bson.M{"_id": s}
+	update := bson.D{{Key: "$unset", Value: bson.M{key: ""}}}
+	if add {
+		update = bson.D{{Key: "$set", Value: bson.M{key: userID}}}
+	} else {
+		filter[key] = bson.M{"$exists": true}
+	}
+	update = append(update, bson.E{Key: "$inc", Value: bson.M{"version": 1}})
 
-	opts := options.Update().SetUpsert(false)
-
-	_, err = collection.UpdateOne(context.TODO(), filter, update, opts)
-	return err
+	result, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(false))
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+	if add {
+		return mongo.ErrNoDocuments
+	}
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": s})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return ErrNotMember
 }
 
 //DeleteProperty remove a property from the db
-func DeleteProperty(user *User) error {
+func DeleteProperty(ctx context.Context, user *User) error {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
@@ -80,13 +155,13 @@ func DeleteProperty(user *User) error {
 		CaseLevel: false,
 	})
 
-	_, err = collection.DeleteOne(context.TODO(), filter, opts)
+	_, err = collection.DeleteOne(ctx, filter, opts)
 	return err
 }
 
 //FetchPropertyByCriterion returns a property struct that matches the particular criteria
 // i.e FetchPropertyByCriterion("Name","abraham") returns a user struct where Name is abraham
-func FetchPropertyByCriterion(criteria, value string) (*Property, error) {
+func FetchPropertyByCriterion(ctx context.Context, criteria, value string) (*Property, error) {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
@@ -94,10 +169,84 @@ func FetchPropertyByCriterion(criteria, value string) (*Property, error) {
 	filter := bson.M{criteria: value}
 	property := &Property{}
 
-	err := collection.FindOne(context.TODO(), filter).Decode(property)
+	err := collection.FindOne(ctx, filter).Decode(property)
+
+	if err != nil {
+		return nil, err
+	}
+	return property, nil
+}
+
+//FetchPropertyByID returns the property whose primary key matches the hex id
+func FetchPropertyByID(ctx context.Context, id string) (*Property, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
+	s, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	property := &Property{}
+
+	err = collection.FindOne(ctx, bson.M{"_id": s}).Decode(property)
 
 	if err != nil {
 		return nil, err
 	}
 	return property, nil
 }
+
+//CountManagedProperties returns how many properties userID created and manages
+func CountManagedProperties(ctx context.Context, userID string) (int64, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
+	return collection.CountDocuments(ctx, bson.M{"createdby": userID})
+}
+
+//RemovePropertyMember removes userID as a landlord or tenant from every property and returns how
+//many properties changed
+func RemovePropertyMember(ctx context.Context, userID string) (int64, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
+	landlord, tenant := fmt.Sprintf("landlord.%s", userID), fmt.Sprintf("tenants.%s", userID)
+	filter := bson.M{"$or": bson.A{
+		bson.M{landlord: bson.M{"$exists": true}},
+		bson.M{tenant: bson.M{"$exists": true}},
+	}}
+	update := bson.D{
+		{Key: "$unset", Value: bson.M{landlord: "", tenant: ""}},
+		{Key: "$inc", Value: bson.M{"version": 1}},
+	}
+	result, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+//FetchUserProperties returns the properties userID manages, owns or rents
+func FetchUserProperties(ctx context.Context, userID string) ([]Property, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(PropertyCollectionName)
+	filter := bson.M{"$or": bson.A{
+		bson.M{"createdby": userID},
+		bson.M{fmt.Sprintf("landlord.%s", userID): bson.M{"$exists": true}},
+		bson.M{fmt.Sprintf("tenants.%s", userID): bson.M{"$exists": true}},
+	}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdat": -1}))
+	if err != nil {
+		return nil, err
+	}
+	properties := []Property{}
+	if err := cursor.All(ctx, &properties); err != nil {
+		return nil, err
+	}
+	return properties, nil
+}
@@ -1,19 +1,42 @@
 package models
 
 type CreateProperty struct {
-	Name    string
-	Type    string
-	Address string
+	Name    string `json:"name" binding:"required,max=200"`
+	Type    string `json:"type" binding:"required,max=100"`
+	Address string `json:"address" binding:"required,max=500"`
 }
 
+//UpdatePropertyModel holds the property fields to change. Fields left out are kept as they are
 type UpdatePropertyModel struct {
-	Name    string
-	Type    string
-	Address string
-	ID      string
+	Name    *string `json:"name" binding:"omitempty,min=1,max=200"`
+	Type    *string `json:"type" binding:"omitempty,min=1,max=100"`
+	Address *string `json:"address" binding:"omitempty,min=1,max=500"`
+	ID      string  `json:"id" uri:"id" swaggerignore:"true" binding:"required,hexadecimal,len=24"`
 }
 
 type AddLandlord struct {
-	UserID     string
-	PropertyID string
+	UserID     string `json:"userid" uri:"userId" binding:"required,hexadecimal,len=24"`
+	PropertyID string `json:"propertyid" uri:"id" swaggerignore:"true" binding:"required,hexadecimal,len=24"`
+}
+
+type PropertyMedia struct {
+	PropertyID string `json:"propertyid" uri:"id" swaggerignore:"true" binding:"required,hexadecimal,len=24"`
+	Key        string `json:"key" binding:"required"`
+}
+
+type ReorderImages struct {
+	PropertyID string   `json:"propertyid" uri:"id" swaggerignore:"true" binding:"required,hexadecimal,len=24"`
+	Keys       []string `json:"keys" binding:"required,min=1,dive,required"`
+}
+
+type ImageCaption struct {
+	PropertyID string `json:"propertyid" uri:"id" swaggerignore:"true" binding:"required,hexadecimal,len=24"`
+	Key        string `json:"key" uri:"key" swaggerignore:"true" binding:"required"`
+	Caption    string `json:"caption" binding:"max=500"`
+}
+
+type DocumentCategory struct {
+	PropertyID string `json:"propertyid" uri:"id" swaggerignore:"true" binding:"required,hexadecimal,len=24"`
+	DocumentID string `json:"documentid" uri:"documentId" swaggerignore:"true" binding:"required"`
+	Category   string `json:"category" binding:"omitempty,oneof=lease inspection certificate"`
 }
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+	"properlyauth/apierr"
+	"properlyauth/logging"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	//APIVersionHeader lets clients of a route group opt in to a newer response format
+	APIVersionHeader = "X-API-Version"
+	//LatestAPIVersion answers with a success envelope and RFC 7807 problems
+	LatestAPIVersion = 2
+	//apiVersionKey holds the response format version in the gin context
+	apiVersionKey = "api_version"
+	//problemContentType is the media type of failure responses from version 2
+	problemContentType = "application/problem+json"
+)
+
+//HTTPRes is the body of every version 1 response, successful or not
+type HTTPRes struct {
+	Code    int         `json:"code" example:"200"`
+	Message string      `json:"message" example:"status bad request"`
+	Data    interface{} `json:"data"`
+	//Error is the stable code of a failure, see ProblemRes
+	Error     string `json:"error,omitempty" example:"invalid_credentials"`
+	RequestID string `json:"request_id,omitempty" example:"4bf92f3577b34da6a3ce929d0e0e4736"`
+}
+
+//SuccessRes is the body of successful responses from version 2
+type SuccessRes struct {
+	Data      interface{} `json:"data"`
+	Message   string      `json:"message,omitempty" example:"User signed in"`
+	RequestID string      `json:"request_id,omitempty" example:"4bf92f3577b34da6a3ce929d0e0e4736"`
+}
+
+//ProblemRes is the RFC 7807 body of failed responses from version 2. Code is stable, Title and Detail may be reworded
+type ProblemRes struct {
+	Type      string              `json:"type" example:"urn:properly:problem:invalid_credentials"`
+	Title     string              `json:"title" example:"Invalid login details"`
+	Status    int                 `json:"status" example:"401"`
+	Detail    string              `json:"detail,omitempty"`
+	Instance  string              `json:"instance,omitempty" example:"/v2/sessions"`
+	Code      string              `json:"code" example:"invalid_credentials"`
+	Errors    []apierr.FieldError `json:"errors,omitempty"`
+	RequestID string              `json:"request_id,omitempty" example:"4bf92f3577b34da6a3ce929d0e0e4736"`
+}
+
+//FieldChanges describes, by field name, what an update changed
+type FieldChanges map[string][]string
+
+//UseAPIVersion sets the response format of a route group. Clients can ask for a newer format than the
+//group's with X-API-Version, so mobile apps can move to it before moving to the newer routes
+func UseAPIVersion(version int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chosen := version
+		requested, err := strconv.Atoi(c.GetHeader(APIVersionHeader))
+		if err == nil && requested > version && requested <= LatestAPIVersion {
+			chosen = requested
+		}
+		c.Set(apiVersionKey, chosen)
+		c.Next()
+	}
+}
+
+//APIVersion returns the response format version of the request, 1 unless the route group or client chose another
+func APIVersion(c *gin.Context) int {
+	if version := c.GetInt(apiVersionKey); version > 0 {
+		return version
+	}
+	return 1
+}
+
+//Success writes a successful response carrying data
+func Success(c *gin.Context, status int, message string, data interface{}) {
+	requestID := c.GetString(logging.RequestIDKey)
+	if APIVersion(c) >= 2 {
+		c.JSON(status, SuccessRes{Data: data, Message: message, RequestID: requestID})
+		return
+	}
+	c.JSON(status, HTTPRes{Code: status, Message: message, Data: data, RequestID: requestID})
+}
+
+//Fail writes the failure err is reported as in the catalog. Errors outside the catalog are server errors whose
+//text is logged but never sent, and so is the cause of any server error
+func Fail(c *gin.Context, err error) {
+	problem := apierr.From(err)
+	if problem.Status >= http.StatusInternalServerError {
+		c.Error(problem.Cause())
+	}
+	requestID := c.GetString(logging.RequestIDKey)
+	if APIVersion(c) >= 2 {
+		body, err := json.Marshal(ProblemRes{
+			Type:      "urn:properly:problem:" + problem.Code,
+			Title:     problem.Title,
+			Status:    problem.Status,
+			Detail:    problem.Detail,
+			Instance:  c.Request.URL.Path,
+			Code:      problem.Code,
+			Errors:    problem.Fields,
+			RequestID: requestID,
+		})
+		if err != nil {
+			c.Error(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Data(problem.Status, problemContentType, body)
+		return
+	}
+	//version 1 clients are sent the status, message and data they got before the catalog and read field
+	//errors as a map of field to messages in data
+	status, message, data, ok := problem.V1Response()
+	if !ok && len(problem.Fields) > 0 {
+		fields := map[string][]string{}
+		for _, field := range problem.Fields {
+			fields[field.Field] = append(fields[field.Field], field.Message)
+		}
+		data = fields
+	}
+	c.JSON(status, HTTPRes{
+		Code:      status,
+		Message:   message,
+		Data:      data,
+		Error:     problem.Code,
+		RequestID: requestID,
+	})
+}
@@ -0,0 +1,246 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"properlyauth/database"
+	"strings"
+	"time"
+)
+
+const (
+	//SessionCollectionName holds a session for every token issued when signing up or in
+	SessionCollectionName = "Session"
+	//SessionTouchInterval is how often the last time a session was used is written down
+	SessionTouchInterval = time.Minute
+	//KnownDeviceCollectionName holds, for every user, the devices they signed in from
+	KnownDeviceCollectionName = "KnownDevice"
+)
+
+//Session is where a user is signed in: the device a token was issued to and when it was last used.
+//Revoked sessions are kept so the devices a user signed in from are remembered
+type Session struct {
+	ID     string `json:"id"`
+	UserID string `json:"-"`
+	//Platform is the platform the client named when signing in, web or mobile
+	Platform  string `json:"platform"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	//Device identifies the platform and user agent family, to tell when a user signs in from a new device
+	Device     string `json:"-"`
+	CreatedAt  int64  `json:"created_at"`
+	LastSeenAt int64  `json:"last_seen_at"`
+	RevokedAt  int64  `json:"-"`
+}
+
+//SessionInfo is a session as listed to its user
+type SessionInfo struct {
+	Session
+	//Current is set on the session of the token the list was asked with
+	Current bool `json:"current"`
+}
+
+//userAgentOSes and userAgentBrowsers map tokens of user agents to the operating system or browser
+//they name, checked in order since browsers name the browsers they are compatible with too
+var (
+	userAgentOSes = [][2]string{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Macintosh", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+	userAgentBrowsers = [][2]string{
+		{"Edg/", "Edge"}, {"EdgA/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"FxiOS/", "Firefox"}, {"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	}
+)
+
+//UserAgentFamily names the browser or app and the operating system of userAgent without their
+//versions, such as Firefox on Windows, so updating either doesn't make a device look new. Apps are
+//named by the first product of their user agent
+func UserAgentFamily(userAgent string) string {
+	browser := strings.SplitN(strings.TrimSpace(userAgent), "/", 2)[0]
+	for _, known := range userAgentBrowsers {
+		if strings.Contains(userAgent, known[0]) {
+			browser = known[1]
+			break
+		}
+	}
+	for _, known := range userAgentOSes {
+		if strings.Contains(userAgent, known[0]) {
+			return browser + " on " + known[1]
+		}
+	}
+	return browser
+}
+
+//DeviceKey identifies the device a client on platform with userAgent runs on
+func DeviceKey(platform, userAgent string) string {
+	sum := sha256.Sum256([]byte(platform + "\n" + UserAgentFamily(userAgent)))
+	return hex.EncodeToString(sum[:])
+}
+
+//Active tells whether the session's token can still be used
+func (s *Session) Active() bool {
+	return s.RevokedAt == 0
+}
+
+//InsertSession records a new session
+func InsertSession(ctx context.Context, session *Session) error {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(SessionCollectionName)
+	oid := primitive.NewObjectID()
+	session.ID = oid.Hex()
+	doc, err := documentWithID(session, oid)
+	if err != nil {
+		session.ID = ""
+		return err
+	}
+	if _, err = collection.InsertOne(ctx, doc); err != nil {
+		session.ID = ""
+		return err
+	}
+	return nil
+}
+
+//FetchSession returns the session whose primary key matches the hex id, revoked or not
+func FetchSession(ctx context.Context, id string) (*Session, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(SessionCollectionName)
+	s, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err := collection.FindOne(ctx, bson.M{"_id": s}).Decode(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+//FetchUserSessions returns the active sessions of the user, the most recently used first
+func FetchUserSessions(ctx context.Context, userID string) ([]Session, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(SessionCollectionName)
+	opts := options.Find().SetSort(bson.D{{Key: "lastseenat", Value: -1}, {Key: "_id", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{"userid": userID, "revokedat": 0}, opts)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+//RememberDevice notes that the user signed in from device and reports whether it is new to them.
+//The first device a user is seen on isn't new, since there is nothing to compare it with. The
+//devices of a user are added to in one atomic update, so concurrent sign ins from a new device
+//report it as new only once
+func RememberDevice(ctx context.Context, userID, device string) (bool, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(KnownDeviceCollectionName)
+	update := bson.M{"$addToSet": bson.M{"devices": device}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+	known := struct{ Devices []string }{}
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": userID}, update, opts).Decode(&known)
+	//two upserts of a user's first device race to insert the document, the loser retries as an update
+	if mongo.IsDuplicateKeyError(err) {
+		err = collection.FindOneAndUpdate(ctx, bson.M{"_id": userID}, update, opts).Decode(&known)
+	}
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, d := range known.Devices {
+		if d == device {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//TouchSession writes down that the session was used at now. Writes are skipped when the session
+//was used less than SessionTouchInterval ago
+func TouchSession(ctx context.Context, session *Session, now time.Time) error {
+	if now.Unix()-session.LastSeenAt < int64(SessionTouchInterval/time.Second) {
+		return nil
+	}
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(SessionCollectionName)
+	s, err := primitive.ObjectIDFromHex(session.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": s}, bson.M{"$set": bson.M{"lastseenat": now.Unix()}}); err != nil {
+		return err
+	}
+	session.LastSeenAt = now.Unix()
+	return nil
+}
+
+//RevokeSession revokes the active session id of the user. mongo.ErrNoDocuments is returned when
+//the user has no such active session
+func RevokeSession(ctx context.Context, userID, id string) error {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(SessionCollectionName)
+	s, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return mongo.ErrNoDocuments
+	}
+	filter := bson.M{"_id": s, "userid": userID, "revokedat": 0}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revokedat": time.Now().Unix()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+//RevokeUserSessions revokes every active session of the user and returns how many there were
+func RevokeUserSessions(ctx context.Context, userID string) (int64, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(SessionCollectionName)
+	filter := bson.M{"userid": userID, "revokedat": 0}
+	result, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revokedat": time.Now().Unix()}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+//DeleteUserSessions removes every session of the user, revoked ones included, and the devices they
+//signed in from
+func DeleteUserSessions(ctx context.Context, userID string) error {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(SessionCollectionName)
+	if _, err := collection.DeleteMany(ctx, bson.M{"userid": userID}); err != nil {
+		return err
+	}
+	_, err := client.Database(database.DbName).Collection(KnownDeviceCollectionName).DeleteOne(ctx, bson.M{"_id": userID})
+	return err
+}
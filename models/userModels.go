@@ -1,40 +1,52 @@
 package models
 
 import (
-	"github.com/gin-gonic/gin"
+	"strings"
+	"time"
 )
 
 type LoginData struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
 }
 
 type SignUpData struct {
-	Type            string `json:"type"`
-	FirstName       string `json:"firstname"`
-	LastName        string `json:"lastname"`
-	Email           string `json:"email"`
-	Password        string `json:"password"`
-	ConfirmPassword string `json:"confirmpassword"`
+	Type            string `json:"type" binding:"required,oneof=manager landlord tenant vendor"`
+	FirstName       string `json:"firstname" binding:"required,max=100"`
+	LastName        string `json:"lastname" binding:"required,max=100"`
+	Email           string `json:"email" binding:"required,email"`
+	Password        string `json:"password" binding:"required,max=128"`
+	ConfirmPassword string `json:"confirmpassword" binding:"required,eqfield=Password"`
+}
+
+//Normalize lowercases and trims the account type, which version 1 accepted written either way
+func (d *SignUpData) Normalize() {
+	d.Type = strings.ToLower(strings.TrimSpace(d.Type))
 }
 
 type ResetPassword struct {
-	Email string `json:"email"`
+	Email string `json:"email" binding:"required,email"`
 }
+
+//PasswordReset is the answer version 1 gives to a password reset request
+type PasswordReset struct {
+	Token string `json:"Token"`
+}
+
 type TokenAndPhoneData struct {
 	Phone string `json:"phone"`
 	Token string `json:"token"`
 }
 
 type ChangeUserPassword struct {
-	OldPassword string `json:"oldpassword"`
-	Password    string `json:"password"`
+	OldPassword string `json:"oldpassword" binding:"required"`
+	Password    string `json:"password" binding:"required,max=128"`
 }
 
 type ChangeUserPasswordFromToken struct {
-	Email    string `json:"email"`
-	Token    string `json:"token"`
-	Password string `json:"password"`
+	Email    string `json:"email" binding:"required,email"`
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,max=128"`
 }
 
 type SignupResponse struct {
@@ -52,31 +64,46 @@ type CompleteSignUp struct {
 	Region   string
 }
 
+//UpdateUserModel holds the profile fields to change. Fields left out are kept as they are,
+//and dob and phonenumber are cleared when sent blank
 type UpdateUserModel struct {
-	FirstName   string
-	LastName    string
-	Dob         string
-	PhoneNumber string
-	Address     string
+	FirstName   *string `json:"firstname" binding:"omitempty,min=1,max=100"`
+	LastName    *string `json:"lastname" binding:"omitempty,min=1,max=100"`
+	Dob         *string `json:"dob" binding:"omitempty,date"`
+	PhoneNumber *string `json:"phonenumber" binding:"omitempty,phone"`
 }
 
 type ProfileImage struct {
 	Image []byte
 }
 
-// NewResponse example
-func NewResponse(ctx *gin.Context, status int, err error, data interface{}) {
-	er := HTTPRes{
-		Code:    status,
-		Message: err.Error(),
-		Data:    data,
-	}
-	ctx.JSON(status, er)
+//UserSearch is the query of an admin listing users. Pages start at 1 and hold 20 users unless per_page says otherwise
+type UserSearch struct {
+	Query     string `form:"q" json:"q" binding:"max=100"`
+	Type      string `form:"type" json:"type" binding:"omitempty,oneof=manager landlord tenant vendor admin"`
+	Suspended *bool  `form:"suspended" json:"suspended"`
+	Page      int    `form:"page" json:"page" binding:"omitempty,min=1"`
+	PerPage   int    `form:"per_page" json:"per_page" binding:"omitempty,min=1,max=100"`
+}
+
+//ChangeUserType holds the type an admin gives a user
+type ChangeUserType struct {
+	Type string `json:"type" binding:"required,oneof=manager landlord tenant vendor admin"`
+}
+
+//SuspendUser holds why an admin suspends a user
+type SuspendUser struct {
+	Reason string `json:"reason" binding:"max=500"`
 }
 
-// HTTPRes example
-type HTTPRes struct {
-	Code    int         `json:"code" example:""`
-	Message string      `json:"message" example:"status bad request"`
-	Data    interface{} `json:"data"`
+//AuditSearch is the query of an admin reading the audit log. from and to are RFC 3339 times and
+//pages hold 50 entries unless per_page says otherwise
+type AuditSearch struct {
+	Property string    `form:"property" json:"property"`
+	User     string    `form:"user" json:"user"`
+	Action   string    `form:"action" json:"action"`
+	From     time.Time `form:"from" json:"from"`
+	To       time.Time `form:"to" json:"to" binding:"omitempty,gtefield=From"`
+	Page     int       `form:"page" json:"page" binding:"omitempty,min=1"`
+	PerPage  int       `form:"per_page" json:"per_page" binding:"omitempty,min=1,max=200"`
 }
@@ -6,6 +6,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"properlyauth/database"
+	"regexp"
 	"time"
 )
 
@@ -20,6 +21,8 @@ const (
 	Landlord = "landlord"
 	Tenant   = "tenant"
 	Vendor   = "vendor"
+	//Admin users manage the accounts of everyone else. Nobody can sign up as one
+	Admin = "admin"
 )
 
 //User decribes user on properly
@@ -33,46 +36,150 @@ type User struct {
 	CreatedAt       int64  `json:"created_at"`
 	PhoneNumber     string `json:"phoneNumber"`
 	Password        string `json:"password"`
-	Type            string `json:"type"`
+	//PasswordHistory holds the hashes of the latest passwords, newest last, so they aren't chosen again
+	PasswordHistory []string `json:"-"`
+	Type            string   `json:"type"`
+	PUMCCode        string   `json:"pumccode"`
+	//Suspended accounts can't sign in and their tokens are refused
+	Suspended        bool   `json:"suspended"`
+	SuspendedAt      int64  `json:"suspended_at"`
+	SuspensionReason string `json:"suspension_reason"`
+	//PasswordResetRequired is set by admins to lock the account until its password is reset by email
+	PasswordResetRequired bool `json:"password_reset_required"`
+	//SignedOutAt is when the user last signed out everywhere. Tokens issued before sessions were
+	//recorded stop working from then on
+	SignedOutAt int64 `json:"signed_out_at"`
+	Version     int64 `json:"version"`
+}
+
+//Profile is a user as version 2 routes send it to its owner, without its password hashes
+type Profile struct {
+	ID              string `json:"id"`
+	Email           string `json:"email"`
+	FirstName       string `json:"firstname"`
+	LastName        string `json:"lastname"`
+	Type            string `json:"type" enums:"manager,landlord,tenant,vendor,admin"`
+	ProfileImageURL string `json:"profile_image_url"`
+	Dob             string `json:"dob"`
+	PhoneNumber     string `json:"phoneNumber"`
 	PUMCCode        string `json:"pumccode"`
+	CreatedAt       int64  `json:"created_at"`
+	Version         int64  `json:"version"`
+}
+
+//SignedInProfile is the profile of a user who just signed up or in, with the token to authenticate as them
+type SignedInProfile struct {
+	Profile
+	Token string `json:"token"`
+}
+
+//Profile returns what the user's owner gets to see of them
+func (u *User) Profile() Profile {
+	return Profile{
+		ID:              u.ID,
+		Email:           u.Email,
+		FirstName:       u.FirstName,
+		LastName:        u.LastName,
+		Type:            u.Type,
+		ProfileImageURL: u.ProfileImageURL,
+		Dob:             u.Dob,
+		PhoneNumber:     u.PhoneNumber,
+		PUMCCode:        u.PUMCCode,
+		CreatedAt:       u.CreatedAt,
+		Version:         u.Version,
+	}
+}
+
+//Account is a user as admins see it, with the state of the account on top of its profile
+type Account struct {
+	Profile
+	Suspended             bool   `json:"suspended"`
+	SuspendedAt           int64  `json:"suspended_at"`
+	SuspensionReason      string `json:"suspension_reason"`
+	PasswordResetRequired bool   `json:"password_reset_required"`
+}
+
+//UserPage is one page of the users matching an admin search
+type UserPage struct {
+	Users   []Account `json:"users"`
+	Page    int       `json:"page"`
+	PerPage int       `json:"per_page"`
+	Total   int64     `json:"total"`
+}
+
+//UserFilter narrows down the users listed to admins. Blank fields don't filter
+type UserFilter struct {
+	//Search matches part of the email, first name or last name, ignoring case
+	Search    string
+	Type      string
+	Suspended *bool
+}
+
+//Account returns what admins get to see of the user
+func (u *User) Account() Account {
+	return Account{
+		Profile:               u.Profile(),
+		Suspended:             u.Suspended,
+		SuspendedAt:           u.SuspendedAt,
+		SuspensionReason:      u.SuspensionReason,
+		PasswordResetRequired: u.PasswordResetRequired,
+	}
+}
+
+//RecentPasswords returns the hashes of the user's latest passwords, newest last. Users that signed up
+//before passwords were remembered only have their current one
+func (u *User) RecentPasswords() []string {
+	if len(u.PasswordHistory) > 0 || u.Password == "" {
+		return u.PasswordHistory
+	}
+	return []string{u.Password}
 }
 
 //InsertUser insert a user into the database
-func InsertUser(user *User) error {
+func InsertUser(ctx context.Context, user *User) error {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
 	collection := client.Database(database.DbName).Collection(UserCollectionName)
-	result, err := collection.InsertOne(context.TODO(), user)
+	oid := primitive.NewObjectID()
+	user.ID = oid.Hex()
+	doc, err := documentWithID(user, oid)
 	if err != nil {
+		user.ID = ""
 		return err
 	}
-	user.ID = result.InsertedID.(primitive.ObjectID).Hex()
-	update := bson.D{{Key: "$set", Value: bson.D{{Key: "id", Value: user.ID}}}}
-	err = UpdateUser(user, update)
-	return err
+	if _, err = collection.InsertOne(ctx, doc); err != nil {
+		user.ID = ""
+		return err
+	}
+	return nil
 }
 
-//UpdateUser update a user into the database
-func UpdateUser(user *User, update interface{}) error {
+//UpdateUser update a user into the database.
+//The update only applies if the stored user is still at user.Version, otherwise ErrVersionConflict is returned
+func UpdateUser(ctx context.Context, user *User, update bson.D) error {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
 	collection := client.Database(database.DbName).Collection(UserCollectionName)
-	s, err := primitive.ObjectIDFromHex(user.ID)
-	if err != nil {
+	if err := compareAndSwap(ctx, collection, user.ID, user.Version, update); err != nil {
 		return err
 	}
-	filter := bson.M{"_id": s}
-
-	opts := options.Update().SetUpsert(false)
+	user.Version++
+	return nil
+}
 
-	_, err = collection.UpdateOne(context.TODO(), filter, update, opts)
-	return err
+//SetUserType changes the type of user, only if it is still at user.Version
+func SetUserType(ctx context.Context, user *User, typed string) error {
+	if err := UpdateUser(ctx, user, bson.D{{Key: "$set", Value: bson.M{"type": typed}}}); err != nil {
+		return err
+	}
+	user.Type = typed
+	return nil
 }
 
 //DeleteUser remove a user from the db
-func DeleteUser(user *User) error {
+func DeleteUser(ctx context.Context, user *User) error {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
@@ -89,32 +196,32 @@ func DeleteUser(user *User) error {
 		CaseLevel: false,
 	})
 
-	_, err = collection.DeleteOne(context.TODO(), filter, opts)
+	_, err = collection.DeleteOne(ctx, filter, opts)
 	return err
 }
 
 //SaveToken saves an token  for authentication later on
-func SaveToken(key, value, platform string) error {
+func SaveToken(ctx context.Context, key, value, platform string) error {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
 	opts := options.Update().SetUpsert(true)
 	filter := bson.D{{Key: key}}
-	update := bson.D{{"$set", bson.M{"key": key, "value": value, "platform": platform, "time": time.Now().Unix()}}}
+	update := bson.D{{Key: "$set", Value: bson.M{"key": key, "value": value, "platform": platform, "time": time.Now().Unix()}}}
 	collection := client.Database(database.DbName).Collection(phoneNoTempTokenCollectionName)
-	_, err := collection.UpdateOne(context.TODO(), filter, update, opts)
+	_, err := collection.UpdateOne(ctx, filter, update, opts)
 	return err
 }
 
 //FetchToken retrieve the phone and stored token value
-func FetchToken(email string) (map[string]interface{}, error) {
+func FetchToken(ctx context.Context, email string) (map[string]interface{}, error) {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
 	collection := client.Database(database.DbName).Collection(phoneNoTempTokenCollectionName)
 	filter := bson.M{"key": email}
 	res := make(map[string]interface{})
-	err := collection.FindOne(context.TODO(), filter).Decode(res)
+	err := collection.FindOne(ctx, filter).Decode(res)
 
 	if err != nil {
 		return nil, err
@@ -123,7 +230,7 @@ func FetchToken(email string) (map[string]interface{}, error) {
 }
 
 //TakeOutToken removes the  phone number token out of db
-func TakeOutToken(email string) error {
+func TakeOutToken(ctx context.Context, email string) error {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
@@ -134,13 +241,13 @@ func TakeOutToken(email string) error {
 		Strength:  1,
 		CaseLevel: false,
 	})
-	_, err := collection.DeleteOne(context.TODO(), filter, opts)
+	_, err := collection.DeleteOne(ctx, filter, opts)
 	return err
 }
 
 //FetchUserByCriterion returns a user struct that tha matches the particular criteria
 // i.e FetchUserByCriterion("username","abraham") returns a user struct where username is abraham
-func FetchUserByCriterion(criteria, value string) (*User, error) {
+func FetchUserByCriterion(ctx context.Context, criteria, value string) (*User, error) {
 	db := database.GetMongoDB()
 	client := db.GetClient()
 	defer database.PutDBBack(db)
@@ -148,10 +255,77 @@ func FetchUserByCriterion(criteria, value string) (*User, error) {
 	filter := bson.M{criteria: value}
 	user := &User{}
 
-	err := collection.FindOne(context.TODO(), filter).Decode(user)
+	err := collection.FindOne(ctx, filter).Decode(user)
 
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
+
+//FetchUserByID returns the user whose primary key matches the hex id
+func FetchUserByID(ctx context.Context, id string) (*User, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(UserCollectionName)
+	s, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{}
+
+	err = collection.FindOne(ctx, bson.M{"_id": s}).Decode(user)
+
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+//FetchUsers returns the page of users matching filter, newest first, along with how many match in total.
+//Pages start at 1
+func FetchUsers(ctx context.Context, filter UserFilter, page, perPage int) ([]User, int64, error) {
+	db := database.GetMongoDB()
+	client := db.GetClient()
+	defer database.PutDBBack(db)
+	collection := client.Database(database.DbName).Collection(UserCollectionName)
+
+	query := bson.M{}
+	if filter.Search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(filter.Search), Options: "i"}
+		query["$or"] = bson.A{
+			bson.M{"email": pattern},
+			bson.M{"firstname": pattern},
+			bson.M{"lastname": pattern},
+		}
+	}
+	if filter.Type != "" {
+		query["type"] = filter.Type
+	}
+	if filter.Suspended != nil {
+		if *filter.Suspended {
+			query["suspended"] = true
+		} else {
+			query["suspended"] = bson.M{"$ne": true}
+		}
+	}
+
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64((page - 1) * perPage)).
+		SetLimit(int64(perPage))
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"properlyauth/apierr"
+)
+
+//ErrVersionConflict is returned when a document changed between being read and written
+var ErrVersionConflict = apierr.VersionConflict.Withf("the document was modified by another request, reload and try again")
+
+//versionFilter matches the document with the given id only while it is still at version.
+//Documents written before versioning have no version field and count as version 0
+func versionFilter(id primitive.ObjectID, version int64) bson.M {
+	if version == 0 {
+		return bson.M{"_id": id, "$or": bson.A{
+			bson.M{"version": 0},
+			bson.M{"version": bson.M{"$exists": false}},
+		}}
+	}
+	return bson.M{"_id": id, "version": version}
+}
+
+//compareAndSwap applies update to the document only if it is still at version and bumps
+//its version on success
+func compareAndSwap(ctx context.Context, collection *mongo.Collection, id string, version int64, update bson.D) error {
+	s, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	update = append(update, bson.E{Key: "$inc", Value: bson.M{"version": 1}})
+	opts := options.Update().SetUpsert(false)
+
+	result, err := collection.UpdateOne(ctx, versionFilter(s, version), update, opts)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": s})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return ErrVersionConflict
+}
@@ -0,0 +1,138 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+//prefixLength is how many hex characters of a SHA-1 hash a range is looked up by, as in the
+//Have I Been Pwned range API
+const prefixLength = 5
+
+//BreachedList answers range queries over the SHA-1 hashes of leaked passwords. Only the first five
+//characters of a hash are asked for, so an implementation backed by a remote service never sees
+//enough of a hash to tell which password is being checked
+type BreachedList interface {
+	//Range returns the upper case hash suffixes, in order, of the leaked passwords whose hash starts with prefix
+	Range(prefix string) ([]string, error)
+}
+
+//FileList is a BreachedList searched on disk, so lists of any size take no memory. The file holds
+//one SHA-1 hash per line sorted by hash, as in the Have I Been Pwned downloads ordered by hash.
+//Lines may carry a count after a colon, and blank lines and lines starting with # are skipped
+type FileList struct {
+	path string
+}
+
+//NewFileList returns the list of hashes in path. The file is only read when a range is asked for
+func NewFileList(path string) *FileList {
+	return &FileList{path: path}
+}
+
+//Range binary searches the file for the first hash starting with prefix and returns the suffixes
+//of the hashes from there on that start with it
+func (f *FileList) Range(prefix string) ([]string, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = strings.ToUpper(prefix)
+	//find the smallest offset the next hash from which doesn't sort before prefix
+	low, high := int64(0), info.Size()
+	for low < high {
+		middle := low + (high-low)/2
+		reader, err := f.linesFrom(file, middle)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := f.nextHash(reader)
+		if err != nil {
+			return nil, err
+		}
+		if hash != "" && hash[:prefixLength] < prefix {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+
+	reader, err := f.linesFrom(file, low)
+	if err != nil {
+		return nil, err
+	}
+	suffixes := []string{}
+	for {
+		hash, err := f.nextHash(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(hash, prefix) {
+			return suffixes, nil
+		}
+		suffixes = append(suffixes, hash[prefixLength:])
+	}
+}
+
+//linesFrom returns a reader of the file from the first line starting at offset or later
+func (f *FileList) linesFrom(file *os.File, offset int64) (*bufio.Reader, error) {
+	if offset == 0 {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return bufio.NewReader(file), nil
+	}
+	//the line the byte before offset is on starts before offset, skip it
+	if _, err := file.Seek(offset-1, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	if _, err := reader.ReadString('\n'); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return reader, nil
+}
+
+//nextHash returns the upper case hash on the next line of reader that has one, blank at the end of the file
+func (f *FileList) nextHash(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		hash := strings.TrimSpace(line)
+		if i := strings.Index(hash, ":"); i >= 0 {
+			hash = hash[:i]
+		}
+		if hash != "" && !strings.HasPrefix(hash, "#") {
+			if len(hash) != 2*sha1.Size {
+				return "", fmt.Errorf("%s has a line that is not a SHA-1 hash: %q", f.path, hash)
+			}
+			return strings.ToUpper(hash), nil
+		}
+		if err == io.EOF {
+			return "", nil
+		}
+	}
+}
+
+//Breached reports whether password is in list
+func Breached(list BreachedList, password string) (bool, error) {
+	hash := strings.ToUpper(fmt.Sprintf("%x", sha1.Sum([]byte(password))))
+	suffixes, err := list.Range(hash[:prefixLength])
+	if err != nil {
+		return false, err
+	}
+	i := sort.SearchStrings(suffixes, hash[prefixLength:])
+	return i < len(suffixes) && suffixes[i] == hash[prefixLength:], nil
+}
@@ -0,0 +1,177 @@
+package password
+
+import (
+	"fmt"
+	"properlyauth/apierr"
+	"properlyauth/config"
+	"properlyauth/utils"
+	"properlyauth/validation"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//Field is the request field policy violations are reported against
+const Field = "password"
+
+//Policy is what new passwords are held to
+type Policy struct {
+	MinLength int
+	//MinClasses is how many of lowercase letters, uppercase letters, digits and symbols must be mixed
+	MinClasses int
+	//History is how many of the latest passwords can't be chosen again
+	History int
+	//Breached, when set, holds leaked passwords that are refused
+	Breached BreachedList
+}
+
+var policy = Policy{MinLength: 10, MinClasses: 3, History: 5}
+
+//messages are the texts of policy violations, by locale and violation code
+var messages = map[string]map[string]string{
+	"en": {
+		"too_short":     "{0} must be at least {1} characters long",
+		"too_simple":    "{0} must mix at least {1} of lowercase letters, uppercase letters, digits and symbols",
+		"personal_info": "{0} must not contain your name or email address",
+		"breached":      "{0} has appeared in a data breach, choose a different one",
+		"reused":        "{0} must differ from your last {1} passwords",
+	},
+	"fr": {
+		"too_short":     "{0} doit contenir au moins {1} caractères",
+		"too_simple":    "{0} doit combiner au moins {1} types de caractères parmi minuscules, majuscules, chiffres et symboles",
+		"personal_info": "{0} ne doit pas contenir votre nom ou votre adresse email",
+		"breached":      "{0} figure dans une fuite de données, choisissez-en un autre",
+		"reused":        "{0} doit être différent de vos {1} derniers mots de passe",
+	},
+}
+
+func init() {
+	prefixed := map[string]map[string]string{}
+	for locale, texts := range messages {
+		prefixed[locale] = map[string]string{}
+		for code, text := range texts {
+			prefixed[locale][messageKey(code)] = text
+		}
+	}
+	if err := validation.AddMessages(prefixed); err != nil {
+		panic(fmt.Sprintf("password: %v", err))
+	}
+}
+
+func messageKey(code string) string {
+	return "password_" + code
+}
+
+//Configure sets the policy from cfg and the breached password list it points to
+func Configure(cfg *config.Config) {
+	configured := Policy{
+		MinLength:  cfg.PasswordMinLength,
+		MinClasses: cfg.PasswordMinClasses,
+		History:    cfg.PasswordHistory,
+	}
+	if cfg.BreachedPasswordsFile != "" {
+		configured.Breached = NewFileList(cfg.BreachedPasswordsFile)
+	}
+	SetPolicy(configured)
+}
+
+//SetPolicy replaces the policy passwords are checked against
+func SetPolicy(p Policy) {
+	policy = p
+}
+
+//Check returns, with messages in locale, every way password falls short of the policy.
+//history holds the hashes of the user's latest passwords and personal the email address and
+//names the password must not contain
+func Check(locale, password string, history []string, personal ...string) ([]apierr.FieldError, error) {
+	problems := []apierr.FieldError{}
+	violation := func(code string, params ...string) {
+		params = append([]string{Field}, params...)
+		problems = append(problems, apierr.Field(Field, code, validation.Message(locale, messageKey(code), params...)))
+	}
+
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		violation("too_short", strconv.Itoa(policy.MinLength))
+	}
+	if characterClasses(password) < policy.MinClasses {
+		violation("too_simple", strconv.Itoa(policy.MinClasses))
+	}
+	if containsPersonalInfo(password, personal) {
+		violation("personal_info")
+	}
+	if policy.Breached != nil {
+		breached, err := Breached(policy.Breached, password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violation("breached")
+		}
+	}
+	if Reused(password, history) {
+		violation("reused", strconv.Itoa(policy.History))
+	}
+	return problems, nil
+}
+
+//Reused reports whether password is one of the latest in history
+func Reused(password string, history []string) bool {
+	hash := utils.SHA256Hash(password)
+	for _, previous := range latest(history) {
+		if previous == hash {
+			return true
+		}
+	}
+	return false
+}
+
+//Remember adds hash, the hash of a newly set password, to history and forgets the passwords
+//the policy no longer needs
+func Remember(history []string, hash string) []string {
+	return latest(append(history, hash))
+}
+
+func latest(history []string) []string {
+	if len(history) <= policy.History {
+		return history
+	}
+	return history[len(history)-policy.History:]
+}
+
+//characterClasses counts which of lowercase letters, uppercase letters, digits and symbols password uses
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+//containsPersonalInfo reports whether password contains one of personal, or the part of an
+//email address before the @. Values shorter than three characters are ignored
+func containsPersonalInfo(password string, personal []string) bool {
+	password = strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		candidates := []string{value}
+		if i := strings.Index(value, "@"); i >= 0 {
+			candidates = append(candidates, value[:i])
+		}
+		for _, candidate := range candidates {
+			if utf8.RuneCountInString(candidate) >= 3 && strings.Contains(password, candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
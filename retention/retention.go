@@ -0,0 +1,46 @@
+package retention
+
+import (
+	"context"
+	"log/slog"
+	"properlyauth/config"
+	"properlyauth/models"
+	"properlyauth/storage"
+	"time"
+)
+
+//Pruner removes property document versions once they were replaced longer ago than the retention period.
+//The current version of a document is always kept
+type Pruner struct {
+	//Retention is how long a version is kept after it was replaced
+	Retention time.Duration
+	//Interval is how long the pruner sleeps between two runs
+	Interval time.Duration
+}
+
+//NewPruner returns a pruner using the document retention settings in cfg
+func NewPruner(cfg *config.Config) *Pruner {
+	return &Pruner{Retention: cfg.DocumentRetention, Interval: cfg.DocumentPruneInterval}
+}
+
+//Run prunes document versions every interval until ctx is cancelled. It does nothing when versions are kept forever
+func (p *Pruner) Run(ctx context.Context) {
+	if p.Retention <= 0 {
+		return
+	}
+	for {
+		if _, err := p.RunOnce(ctx, time.Now()); err != nil {
+			slog.Error("pruning document versions failed", slog.String("error", err.Error()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.Interval):
+		}
+	}
+}
+
+//RunOnce prunes the versions that are past retention at now and returns how many were pruned
+func (p *Pruner) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	return models.PruneDocumentVersions(ctx, now.Add(-p.Retention), storage.Private())
+}
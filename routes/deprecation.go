@@ -0,0 +1,23 @@
+package routes
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+//deprecated marks every response of a route group as coming from a deprecated API version
+func deprecated() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Next()
+	}
+}
+
+//successor points clients of a deprecated route at the route that replaces it
+func successor(path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", path))
+		c.Next()
+	}
+}
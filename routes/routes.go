@@ -1,50 +1,141 @@
 package routes
 
 import (
-	"fmt"
 	"github.com/gin-gonic/gin"
-	"os"
+	"properlyauth/config"
 	"properlyauth/controllers"
+	"properlyauth/database"
+	"properlyauth/logging"
+	"properlyauth/mailer"
+	"properlyauth/metrics"
+	"properlyauth/models"
+	"properlyauth/password"
+	"properlyauth/tracing"
+	"properlyauth/upload"
+	"properlyauth/utils"
 
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
 
-//Router instanciate all routes in the application
-func Router() *gin.Engine {
+//Router instanciate all routes in the application and hands cfg to the packages that need it
+func Router(cfg *config.Config) *gin.Engine {
+	database.Configure(cfg)
+	utils.Configure(cfg)
+	controllers.Configure(cfg)
+	mailer.Configure(cfg)
+	upload.Configure(cfg)
+	logging.Configure(cfg)
+	password.Configure(cfg)
+	models.Configure(cfg)
+	database.AddMonitor(metrics.MongoMonitor())
+	database.AddMonitor(tracing.MongoMonitor())
 
-	app := gin.Default()
+	app := gin.New()
+	//ClientIP only believes forwarding headers from the configured load balancers, none when there are none.
+	//config.Load already rejected proxies that don't parse
+	if err := app.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		panic(err)
+	}
+	app.TrustedPlatform = cfg.TrustedPlatform
+	app.Use(tracing.Middleware(), logging.Middleware(), metrics.Middleware(), models.UseAPIVersion(1))
+	app.GET("/metrics", metrics.Handler(cfg.MetricsToken))
+	app.GET("/healthz", controllers.Healthz)
+	app.GET("/readyz", controllers.Readyz)
 
-	v1 := app.Group("/v1")
+	v1 := app.Group("/v1", deprecated())
 
 	v1.GET("/", func(c *gin.Context) {
 		c.String(200, "Welcome to properly")
 	})
-	v1.GET("/serve/media/:filename", func(c *gin.Context) {
-		name := c.Param("filename")
-		rootDir := os.Getenv("ROOTDIR")
-		c.File(fmt.Sprintf("%s/public/media/%s", rootDir, name))
-	})
+	v1.GET("/serve/media/:filename", successor("/v2/media"), controllers.ServeMedia)
+	v1.GET("/serve/document/", successor("/v2/documents"), controllers.ServeDocument)
 
-	v1.POST("/signup/", controllers.SignUp)
-	v1.PUT("/reset/update-password/", controllers.ResetPassword)
-	v1.PUT("/user/change-password/", controllers.ChangePasswordAuth)
-	v1.POST("/reset/validate-token/", controllers.ChangePasswordFromToken)
-	v1.POST("/login/", controllers.SignIn)
-	v1.GET("/user/", controllers.UserProfile)
+	v1.POST("/signup/", successor("/v2/users"), controllers.SignUp)
+	v1.PUT("/reset/update-password/", successor("/v2/password-resets"), controllers.ResetPassword)
+	v1.PUT("/user/change-password/", successor("/v2/users/me/password"), controllers.ChangePasswordAuth)
+	v1.POST("/reset/validate-token/", successor("/v2/password-resets/confirmation"), controllers.ChangePasswordFromToken)
+	v1.POST("/login/", successor("/v2/sessions"), controllers.SignIn)
+	v1.GET("/user/", successor("/v2/users/me"), controllers.UserProfile)
+	v1.GET("/user/sessions/", successor("/v2/users/me/sessions"), controllers.ListSessions)
+	v1.DELETE("/user/sessions/", successor("/v2/users/me/sessions"), controllers.RevokeAllSessions)
+	v1.DELETE("/user/sessions/:id", successor("/v2/users/me/sessions"), controllers.RevokeSession)
 
-	v1.PUT("/user/update/", controllers.UpdateProfile)
-	v1.PUT("/user/update-profile-image/", controllers.UpdateProfileImage)
+	v1.PUT("/user/update/", successor("/v2/users/me"), controllers.UpdateProfile)
+	v1.PUT("/user/update-profile-image/", successor("/v2/users/me/profile-image"), controllers.UpdateProfileImage)
 
-	v1.PUT("/create/property/", controllers.CreateProperty)
-	v1.PUT("/update/property/", controllers.UpdatePropertyRoute)
+	v1.PUT("/create/property/", successor("/v2/properties"), controllers.CreateProperty)
+	v1.PUT("/update/property/", successor("/v2/properties"), controllers.UpdatePropertyRoute)
+	v1.GET("/property/", successor("/v2/properties"), controllers.GetProperty)
+	v1.GET("/property/document-url/", successor("/v2/properties"), controllers.DocumentURL)
+	v1.PUT("/property/images/", successor("/v2/properties"), controllers.AddPropertyImages)
+	v1.DELETE("/property/images/", successor("/v2/properties"), controllers.DeletePropertyImage)
+	v1.PUT("/property/images/order/", successor("/v2/properties"), controllers.ReorderPropertyImages)
+	v1.PUT("/property/images/caption/", successor("/v2/properties"), controllers.CaptionPropertyImage)
+	v1.PUT("/property/cover/", successor("/v2/properties"), controllers.SetPropertyCover)
+	v1.PUT("/property/documents/", successor("/v2/properties"), controllers.AddPropertyDocuments)
+	v1.DELETE("/property/documents/", successor("/v2/properties"), controllers.DeletePropertyDocument)
+	v1.PUT("/property/documents/category/", successor("/v2/properties"), controllers.CategorizePropertyDocument)
+	v1.PUT("/property/documents/versions/", successor("/v2/properties"), controllers.AddDocumentVersion)
 
-	v1.PUT("/property/add-landlord/", controllers.AddLandlordToProperty)
-	v1.PUT("/property/remove-landlord/", controllers.RemoveLandlordFromProperty)
-	v1.PUT("/property/add-tenant/", controllers.AddTenantToProperty)
-	v1.PUT("/property/remove-tenant/", controllers.RemoveTenantFromProperty)
+	v1.PUT("/property/add-landlord/", successor("/v2/properties"), controllers.AddLandlordToProperty)
+	v1.PUT("/property/remove-landlord/", successor("/v2/properties"), controllers.RemoveLandlordFromProperty)
+	v1.PUT("/property/add-tenant/", successor("/v2/properties"), controllers.AddTenantToProperty)
+	v1.PUT("/property/remove-tenant/", successor("/v2/properties"), controllers.RemoveTenantFromProperty)
 
 	v1.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
+	//v2 names resources in the path, uses verbs for what they mean and takes the client
+	//platform from the X-Client-Platform header, assuming web when it is missing
+	v2 := app.Group("/v2", models.UseAPIVersion(2), controllers.DefaultPlatform("web"))
+
+	v2.GET("/media/:filename", controllers.ServeMedia)
+	v2.GET("/documents", controllers.ServeDocument)
+
+	v2.POST("/users", controllers.SignUp)
+	v2.GET("/users/me", controllers.UserProfile)
+	v2.PATCH("/users/me", controllers.UpdateProfile)
+	v2.PUT("/users/me/password", controllers.ChangePasswordAuth)
+	v2.PUT("/users/me/profile-image", controllers.UpdateProfileImage)
+	v2.GET("/users/me/sessions", controllers.ListSessions)
+	v2.DELETE("/users/me/sessions", controllers.RevokeAllSessions)
+	v2.DELETE("/users/me/sessions/:id", controllers.RevokeSession)
+	v2.POST("/sessions", controllers.SignIn)
+	v2.POST("/password-resets", controllers.ResetPassword)
+	v2.POST("/password-resets/confirmation", controllers.ChangePasswordFromToken)
+
+	v2.POST("/properties", controllers.CreateProperty)
+	v2.GET("/properties/:id", controllers.GetProperty)
+	v2.PATCH("/properties/:id", controllers.UpdatePropertyRoute)
+	v2.PUT("/properties/:id/cover", controllers.SetPropertyCover)
+	v2.POST("/properties/:id/images", controllers.AddPropertyImages)
+	v2.PUT("/properties/:id/images/order", controllers.ReorderPropertyImages)
+	v2.PATCH("/properties/:id/images/*key", controllers.CaptionPropertyImage)
+	v2.DELETE("/properties/:id/images/*key", controllers.DeletePropertyImage)
+	v2.POST("/properties/:id/documents", controllers.AddPropertyDocuments)
+	v2.PATCH("/properties/:id/documents/:documentId", controllers.CategorizePropertyDocument)
+	v2.DELETE("/properties/:id/documents/:documentId", controllers.DeletePropertyDocument)
+	v2.GET("/properties/:id/documents/:documentId/url", controllers.DocumentURL)
+	v2.POST("/properties/:id/documents/:documentId/versions", controllers.AddDocumentVersion)
+	v2.POST("/properties/:id/landlords", controllers.AddLandlordToProperty)
+	v2.DELETE("/properties/:id/landlords/:userId", controllers.RemoveLandlordFromProperty)
+	v2.POST("/properties/:id/tenants", controllers.AddTenantToProperty)
+	v2.DELETE("/properties/:id/tenants/:userId", controllers.RemoveTenantFromProperty)
+
+	v2.GET("/support/outbox", controllers.OutboxStatus)
+	v2.GET("/support/outbox/:id", controllers.OutboxEmailStatus)
+	v2.POST("/support/outbox/:id/requeue", controllers.RequeueOutboxEmail)
+
+	v2.GET("/admin/users", controllers.ListUsers)
+	v2.GET("/admin/users/:id", controllers.UserAccount)
+	v2.DELETE("/admin/users/:id", controllers.DeleteUserAccount)
+	v2.GET("/admin/users/:id/properties", controllers.UserProperties)
+	v2.PUT("/admin/users/:id/type", controllers.ChangeUserType)
+	v2.PUT("/admin/users/:id/suspension", controllers.SuspendUser)
+	v2.DELETE("/admin/users/:id/suspension", controllers.ReactivateUser)
+	v2.POST("/admin/users/:id/password-reset", controllers.ForcePasswordReset)
+	v2.GET("/admin/audit", controllers.ListAuditEntries)
+	v2.GET("/admin/audit/verification", controllers.VerifyAuditLog)
+
 	return app
 }
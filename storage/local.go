@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//Local keeps objects as files below Root
+type Local struct {
+	Root string
+}
+
+//NewLocal returns a local storage rooted at root, creating the directory if needed
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{Root: root}, nil
+}
+
+//path maps key to a file below Root, refusing keys that would escape it
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "\x00") || clean != "/"+key {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(l.Root, filepath.FromSlash(clean)), nil
+}
+
+//Put writes the object to a temporary file and renames it in place
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+//Get opens the file stored under key
+func (l *Local) Get(ctx context.Context, key string) (Object, *ObjectInfo, error) {
+	info, err := l.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, _ := l.path(key)
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+//Stat describes the file stored under key. The content type is derived from its extension
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, ErrNotFound
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(p))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	etag := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%d-%d", key, fi.Size(), fi.ModTime().UnixNano()))))
+	return &ObjectInfo{Key: key, Size: fi.Size(), ContentType: contentType, ModTime: fi.ModTime(), ETag: etag}, nil
+}
+
+//Delete removes the file stored under key
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"properlyauth/config"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+//S3 keeps objects in a bucket of an S3 compatible service such as AWS S3 or MinIO
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+//NewS3 connects to bucket on the service described in cfg, creating it when it doesn't exist
+func NewS3(cfg *config.Config, bucket string) (*S3, error) {
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: cfg.S3UseSSL,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: cfg.S3Region}); err != nil {
+			return nil, err
+		}
+	}
+	return &S3{client: client, bucket: bucket}, nil
+}
+
+//Put uploads the object
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+//Get opens the object for streaming
+func (s *S3) Get(ctx context.Context, key string) (Object, *ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, convertS3Error(err)
+	}
+	return object, info, nil
+}
+
+//Stat describes the object
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, convertS3Error(err)
+	}
+	return &ObjectInfo{
+		Key:         key,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		ModTime:     info.LastModified,
+		ETag:        info.ETag,
+	}, nil
+}
+
+//Delete removes the object
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return convertS3Error(s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func convertS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
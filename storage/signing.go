@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//SignedURL returns path with the key, an expiry and an HMAC signature over both as query parameters.
+//Anyone holding the url can download the object until it expires, so keep ttl short
+func SignedURL(secret []byte, path, key string, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{}
+	query.Set("key", key)
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", signature(secret, key, expires))
+	return fmt.Sprintf("%s?%s", path, query.Encode())
+}
+
+//VerifySignature checks a signature produced by SignedURL and that it hasn't expired
+func VerifySignature(secret []byte, key, expires, sig string) bool {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	expected := signature(secret, key, expiresAt)
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
+
+func signature(secret []byte, key string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
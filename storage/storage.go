@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"properlyauth/config"
+	"sync"
+	"time"
+)
+
+var (
+	//ErrNotFound is returned when no object is stored under a key
+	ErrNotFound = errors.New("object not found")
+	//ErrInvalidKey is returned for keys that can't name an object, such as ones escaping the storage root
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+//ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+	ETag        string
+}
+
+//Object is a stored object opened for reading. It can seek so it can serve range requests
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+//Storage keeps blobs such as uploaded images and documents under string keys
+type Storage interface {
+	//Put stores size bytes read from r under key, replacing any previous object
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	//Get opens the object stored under key
+	Get(ctx context.Context, key string) (Object, *ObjectInfo, error)
+	//Stat describes the object stored under key without opening it
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	//Delete removes the object stored under key. Deleting a missing object is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	defaultStorage Storage
+	privateStorage Storage
+	defaultMutex   sync.RWMutex
+)
+
+//New returns the storage backend described by cfg. Private storage is kept apart from public
+//media, in its own directory or bucket, and is never exposed without an access check
+func New(cfg *config.Config, private bool) (Storage, error) {
+	switch cfg.StorageBackend {
+	case config.S3Storage:
+		if private {
+			return NewS3(cfg, cfg.S3PrivateBucket)
+		}
+		return NewS3(cfg, cfg.S3Bucket)
+	case config.LocalStorage:
+		if private {
+			return NewLocal(cfg.StoragePrivateDir)
+		}
+		return NewLocal(cfg.StorageLocalDir)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+}
+
+//Configure builds the public and private storage described by cfg and makes them the default
+func Configure(cfg *config.Config) error {
+	public, err := New(cfg, false)
+	if err != nil {
+		return err
+	}
+	private, err := New(cfg, true)
+	if err != nil {
+		return err
+	}
+	SetDefault(public)
+	SetPrivate(private)
+	return nil
+}
+
+//SetPrivate replaces the private storage
+func SetPrivate(s Storage) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	privateStorage = s
+}
+
+//Private returns the storage confidential files such as property documents are kept in
+func Private() Storage {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return privateStorage
+}
+
+//SetDefault replaces the default storage
+func SetDefault(s Storage) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultStorage = s
+}
+
+//Default returns the storage uploads are kept in
+func Default() Storage {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultStorage
+}
+
+//MediaKey returns the key a public media file is stored under. Documents written before keys
+//were introduced only hold the bare file name, which maps to the same key
+func MediaKey(name string) string {
+	if len(name) > len(MediaPrefix) && name[:len(MediaPrefix)] == MediaPrefix {
+		return name
+	}
+	return MediaPrefix + name
+}
+
+const (
+	//MediaPrefix is the key prefix of public media files
+	MediaPrefix = "media/"
+	//DocumentPrefix is the key prefix of files kept in private storage
+	DocumentPrefix = "documents/"
+)
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"properlyauth/models"
+	"testing"
+)
+
+//makeAdmin turns the owner of token into an admin straight in the database, as the -grant-admin flag does
+func makeAdmin(t *testing.T, token string) {
+	user, err := models.FetchUserByID(context.Background(), getIdFromToken(t, token))
+	if err != nil {
+		t.Fatalf("Err: %v, can't fetch the user to make admin", err)
+	}
+	if err := models.SetUserType(context.Background(), user, models.Admin); err != nil {
+		t.Fatalf("Err: %v, can't make the user admin", err)
+	}
+}
+
+func adminRequest(t *testing.T, ExpectedCode int, method, path, token string, data map[string]interface{}) map[string]interface{} {
+	w := httptest.NewRecorder()
+	var body *bytes.Reader
+	if data != nil {
+		dataByte, _ := json.Marshal(data)
+		body = bytes.NewReader(dataByte)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	if data != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return result
+}
+
+func testListUsers(t *testing.T, ExpectedCode int, token, query string, expectedTotal int) {
+	result := adminRequest(t, ExpectedCode, "GET", fmt.Sprintf("/v2/admin/users?%s", query), token, nil)
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	page := result["data"].(map[string]interface{})
+	if page["total"] != float64(expectedTotal) || len(page["users"].([]interface{})) != expectedTotal {
+		t.Fatalf("Expecting %d users for %q Got %v", expectedTotal, query, page)
+	}
+}
+
+func testAdminUserProperties(t *testing.T, ExpectedCode int, token, userID string, expected int) {
+	result := adminRequest(t, ExpectedCode, "GET", fmt.Sprintf("/v2/admin/users/%s/properties", userID), token, nil)
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	if properties := result["data"].([]interface{}); len(properties) != expected {
+		t.Fatalf("Expecting %d properties Got %d", expected, len(properties))
+	}
+}
+
+func testChangeUserType(t *testing.T, ExpectedCode int, token, userID, typed string) {
+	result := adminRequest(t, ExpectedCode, "PUT", fmt.Sprintf("/v2/admin/users/%s/type", userID), token, map[string]interface{}{"type": typed})
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	if account := result["data"].(map[string]interface{}); account["type"] != typed {
+		t.Fatalf("Expecting type %s Got %v", typed, account["type"])
+	}
+}
+
+func testSuspendUser(t *testing.T, ExpectedCode int, token, userID string, suspend bool) {
+	method := "DELETE"
+	var data map[string]interface{}
+	if suspend {
+		method = "PUT"
+		data = map[string]interface{}{"reason": "Reported for spam"}
+	}
+	result := adminRequest(t, ExpectedCode, method, fmt.Sprintf("/v2/admin/users/%s/suspension", userID), token, data)
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	if account := result["data"].(map[string]interface{}); account["suspended"] != suspend {
+		t.Fatalf("Expecting suspended to be %v Got %v", suspend, account)
+	}
+}
+
+func testForcePasswordReset(t *testing.T, ExpectedCode int, token, userID string) {
+	adminRequest(t, ExpectedCode, "POST", fmt.Sprintf("/v2/admin/users/%s/password-reset", userID), token, nil)
+}
+
+func testDeleteUser(t *testing.T, ExpectedCode int, token, userID string) {
+	adminRequest(t, ExpectedCode, "DELETE", fmt.Sprintf("/v2/admin/users/%s", userID), token, nil)
+}
+
+//testNotMember checks that userID is no longer listed in the role map of the first property
+func testNotMember(t *testing.T, role, userID string) {
+	members, _ := fetchProperty(t)[role].(map[string]interface{})
+	if _, ok := members[userID]; ok {
+		t.Fatalf("Expecting %s to be removed from the %s of the property Got %v", userID, role, members)
+	}
+}
+
+//testAccountLocked checks that token is refused with the problem errorCode
+func testAccountLocked(t *testing.T, ExpectedCode int, token, errorCode string) {
+	result := adminRequest(t, ExpectedCode, "GET", "/v2/users/me", token, nil)
+	if result["code"] != errorCode {
+		t.Fatalf("Expecting problem %s Got %v", errorCode, result)
+	}
+}
+
+//testAuditLog checks that the audit entries matching query include, in order from the latest, the actions expected
+func testAuditLog(t *testing.T, ExpectedCode int, token, query string, expected ...string) {
+	result := adminRequest(t, ExpectedCode, "GET", fmt.Sprintf("/v2/admin/audit?%s", query), token, nil)
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	entries := result["data"].(map[string]interface{})["entries"].([]interface{})
+	if len(entries) < len(expected) {
+		t.Fatalf("Expecting at least %d audit entries for %q Got %d", len(expected), query, len(entries))
+	}
+	for i, action := range expected {
+		entry := entries[i].(map[string]interface{})
+		if entry["action"] != action {
+			t.Fatalf("Expecting audit entry %d for %q to be %s Got %v", i, query, action, entry)
+		}
+		if entry["hash"] == "" || entry["request_id"] == "" {
+			t.Fatalf("Expecting audit entries to be chained and tied to their request Got %v", entry)
+		}
+	}
+}
+
+func testVerifyAuditLog(t *testing.T, ExpectedCode int, token string) {
+	result := adminRequest(t, ExpectedCode, "GET", "/v2/admin/audit/verification", token, nil)
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	if verification := result["data"].(map[string]interface{}); verification["valid"] != true || verification["checked"] == float64(0) {
+		t.Fatalf("Expecting an intact audit log Got %v", verification)
+	}
+}
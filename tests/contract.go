@@ -0,0 +1,418 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"properlyauth/docs"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+//apiSpec is the part of the served OpenAPI document the contract is checked against
+type apiSpec struct {
+	Paths       map[string]map[string]*apiOperation `json:"paths"`
+	Definitions map[string]*apiSchema               `json:"definitions"`
+}
+
+type apiOperation struct {
+	Consumes   []string               `json:"consumes"`
+	Produces   []string               `json:"produces"`
+	Parameters []apiParameter         `json:"parameters"`
+	Responses  map[string]apiResponse `json:"responses"`
+}
+
+type apiParameter struct {
+	Name     string     `json:"name"`
+	In       string     `json:"in"`
+	Required bool       `json:"required"`
+	Schema   *apiSchema `json:"schema"`
+}
+
+type apiResponse struct {
+	Schema *apiSchema `json:"schema"`
+}
+
+type apiSchema struct {
+	Ref                  string                `json:"$ref"`
+	Type                 string                `json:"type"`
+	Properties           map[string]*apiSchema `json:"properties"`
+	Required             []string              `json:"required"`
+	Items                *apiSchema            `json:"items"`
+	AdditionalProperties *apiSchema            `json:"additionalProperties"`
+	AllOf                []*apiSchema          `json:"allOf"`
+	Enum                 []interface{}         `json:"enum"`
+}
+
+//undocumented reports whether the route at path is left out of the spec on purpose: version 1 routes
+//are deprecated and metrics are scraped by Prometheus
+func undocumented(path string) bool {
+	return strings.HasPrefix(path, "/v1/") || path == "/metrics"
+}
+
+//loadAPISpec reads the spec the server hands out on /v1/swagger
+func loadAPISpec(t *testing.T) *apiSpec {
+	spec := &apiSpec{}
+	if err := json.Unmarshal([]byte(docs.SwaggerInfo.ReadDoc()), spec); err != nil {
+		t.Fatalf("The OpenAPI spec can't be read: %v", err)
+	}
+	return spec
+}
+
+//specPath turns a gin route path into its OpenAPI form, /properties/:id/images/*key into /properties/{id}/images/{key}
+func specPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+//pathParameters returns the names of the parameters in an OpenAPI path, in order
+func pathParameters(path string) []string {
+	names := []string{}
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") {
+			names = append(names, strings.Trim(segment, "{}"))
+		}
+	}
+	return names
+}
+
+func (s *apiSpec) operation(method, path string) *apiOperation {
+	return s.Paths[path][strings.ToLower(method)]
+}
+
+//testRoutesDocumented checks that every route engine serves is in the spec with the same path parameters,
+//and that the spec has nothing engine doesn't serve
+func testRoutesDocumented(t *testing.T, engine *gin.Engine, spec *apiSpec) {
+	served := map[string]bool{}
+	for _, route := range engine.Routes() {
+		if undocumented(route.Path) {
+			continue
+		}
+		path := specPath(route.Path)
+		served[route.Method+" "+path] = true
+		operation := spec.operation(route.Method, path)
+		if operation == nil {
+			t.Errorf("%s %s is served but not documented", route.Method, path)
+			continue
+		}
+		documented := []string{}
+		for _, parameter := range operation.Parameters {
+			if parameter.In == "path" {
+				documented = append(documented, parameter.Name)
+			}
+		}
+		expected := pathParameters(path)
+		sort.Strings(documented)
+		sort.Strings(expected)
+		if strings.Join(documented, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s %s documents the path parameters %v instead of %v", route.Method, path, documented, expected)
+		}
+	}
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if !served[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s %s is documented but not served", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+//contractChecker serves requests with its engine and checks every exchange on a documented route against the spec
+type contractChecker struct {
+	t      *testing.T
+	engine *gin.Engine
+	spec   *apiSpec
+}
+
+//checkContract wraps engine so that the requests the tests replay are checked against the spec
+func checkContract(t *testing.T, engine *gin.Engine) http.Handler {
+	return &contractChecker{t: t, engine: engine, spec: loadAPISpec(t)}
+}
+
+func (cc *contractChecker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var requestBody []byte
+	if req.Body != nil {
+		requestBody, _ = ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+	}
+	recorder := httptest.NewRecorder()
+	cc.engine.ServeHTTP(recorder, req)
+	for key, values := range recorder.Header() {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(recorder.Code)
+	w.Write(recorder.Body.Bytes())
+
+	//routes missing from the spec are reported by testRoutesDocumented, the rest are version 1
+	//routes or were added by the tests, such as /public
+	path, found := cc.route(req.Method, req.URL.Path)
+	if !found {
+		return
+	}
+	operation := cc.spec.operation(req.Method, specPath(path))
+	if operation == nil {
+		return
+	}
+	exchange := fmt.Sprintf("%s %s answered %d", req.Method, req.URL.Path, recorder.Code)
+	for _, problem := range cc.checkExchange(operation, req, requestBody, recorder) {
+		cc.t.Errorf("%s: %s", exchange, problem)
+	}
+}
+
+//route returns the path of the engine route that serves method and path, preferring static segments over parameters
+func (cc *contractChecker) route(method, path string) (string, bool) {
+	best, bestScore := "", -1
+	for _, route := range cc.engine.Routes() {
+		if route.Method != method {
+			continue
+		}
+		if score, matched := matchRoute(route.Path, path); matched && score > bestScore {
+			best, bestScore = route.Path, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+//matchRoute reports whether path is served by the gin route pattern and how many static segments it matched on
+func matchRoute(pattern, path string) (int, bool) {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	static := 0
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "*") {
+			return static, len(pathSegments) > i
+		}
+		if i >= len(pathSegments) {
+			return 0, false
+		}
+		if strings.HasPrefix(segment, ":") {
+			if pathSegments[i] == "" {
+				return 0, false
+			}
+			continue
+		}
+		if segment != pathSegments[i] {
+			return 0, false
+		}
+		static++
+	}
+	return static, len(patternSegments) == len(pathSegments)
+}
+
+//checkExchange returns the ways an exchange strays from operation. Requests are only held to the spec when
+//they succeeded, since the tests also send invalid ones on purpose
+func (cc *contractChecker) checkExchange(operation *apiOperation, req *http.Request, requestBody []byte, recorder *httptest.ResponseRecorder) []string {
+	problems := []string{}
+	if recorder.Code < http.StatusBadRequest {
+		problems = append(problems, cc.checkRequest(operation, req, requestBody)...)
+	}
+
+	response, documented := operation.Responses[fmt.Sprint(recorder.Code)]
+	if !documented {
+		return append(problems, fmt.Sprintf("status %d isn't documented", recorder.Code))
+	}
+	if response.Schema == nil {
+		if recorder.Body.Len() > 0 {
+			problems = append(problems, "the response has a body but none is documented")
+		}
+		return problems
+	}
+	if response.Schema.Type == "file" {
+		return problems
+	}
+	contentType, _, _ := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+	if len(operation.Produces) > 0 && !contains(operation.Produces, contentType) {
+		problems = append(problems, fmt.Sprintf("the response is %s but only %v are documented", contentType, operation.Produces))
+	}
+	var body interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		return append(problems, fmt.Sprintf("the response isn't JSON: %v", err))
+	}
+	return append(problems, cc.spec.validate("response", body, response.Schema, true)...)
+}
+
+func (cc *contractChecker) checkRequest(operation *apiOperation, req *http.Request, requestBody []byte) []string {
+	problems := []string{}
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if len(requestBody) > 0 && len(operation.Consumes) > 0 && !contains(operation.Consumes, contentType) {
+		problems = append(problems, fmt.Sprintf("the request is %s but only %v are documented", contentType, operation.Consumes))
+	}
+	for _, parameter := range operation.Parameters {
+		switch parameter.In {
+		case "query":
+			if parameter.Required && req.URL.Query().Get(parameter.Name) == "" {
+				problems = append(problems, fmt.Sprintf("the required query parameter %s wasn't sent", parameter.Name))
+			}
+		case "body":
+			if contentType != "application/json" {
+				continue
+			}
+			var body interface{}
+			if err := json.Unmarshal(requestBody, &body); err != nil {
+				problems = append(problems, fmt.Sprintf("the request isn't JSON: %v", err))
+				continue
+			}
+			problems = append(problems, cc.spec.validate("request", body, parameter.Schema, true)...)
+		}
+	}
+	return problems
+}
+
+//resolve follows schema's reference to the definition it names
+func (s *apiSpec) resolve(schema *apiSchema) *apiSchema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.Definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+	}
+	return schema
+}
+
+//declares reports whether schema, or one of the schemas it is composed of, allows an object to carry key
+func (s *apiSpec) declares(schema *apiSchema, key string) bool {
+	schema = s.resolve(schema)
+	if schema == nil || schema.AdditionalProperties != nil {
+		return true
+	}
+	if _, found := schema.Properties[key]; found {
+		return true
+	}
+	for _, part := range schema.AllOf {
+		if s.declares(part, key) {
+			return true
+		}
+	}
+	return false
+}
+
+//validate returns the ways value, found at where, doesn't match schema. When closed is set objects can't carry
+//keys the schema doesn't declare, so a field added to a response without updating the docs is caught.
+//Go encodes nil slices and maps as null, so null passes for arrays and objects
+func (s *apiSpec) validate(where string, value interface{}, schema *apiSchema, closed bool) []string {
+	schema = s.resolve(schema)
+	if schema == nil {
+		return []string{fmt.Sprintf("%s refers to a missing definition", where)}
+	}
+	problems := []string{}
+	if len(schema.AllOf) > 0 {
+		for _, part := range schema.AllOf {
+			problems = append(problems, s.validate(where, value, part, false)...)
+		}
+		if object, ok := value.(map[string]interface{}); ok && closed {
+			for key := range object {
+				if !s.declares(schema, key) {
+					problems = append(problems, fmt.Sprintf("%s.%s isn't documented", where, key))
+				}
+			}
+		}
+		return problems
+	}
+	if len(schema.Enum) > 0 && value != nil && !containsValue(schema.Enum, value) {
+		problems = append(problems, fmt.Sprintf("%s is %v, not one of %v", where, value, schema.Enum))
+	}
+
+	switch schema.Type {
+	case "object":
+		if value == nil {
+			return problems
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s should be an object, got %v", where, value))
+		}
+		for _, key := range schema.Required {
+			if _, found := object[key]; !found {
+				problems = append(problems, fmt.Sprintf("%s.%s is required", where, key))
+			}
+		}
+		for key, field := range object {
+			if property, found := schema.Properties[key]; found {
+				problems = append(problems, s.validate(where+"."+key, field, property, true)...)
+			} else if schema.AdditionalProperties != nil {
+				problems = append(problems, s.validate(where+"."+key, field, schema.AdditionalProperties, true)...)
+			} else if closed && schema.Properties != nil {
+				problems = append(problems, fmt.Sprintf("%s.%s isn't documented", where, key))
+			}
+		}
+	case "array":
+		if value == nil {
+			return problems
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s should be an array, got %v", where, value))
+		}
+		if schema.Items != nil {
+			for i, item := range items {
+				problems = append(problems, s.validate(fmt.Sprintf("%s[%d]", where, i), item, schema.Items, true)...)
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			problems = append(problems, fmt.Sprintf("%s should be a string, got %v", where, value))
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			problems = append(problems, fmt.Sprintf("%s should be an integer, got %v", where, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, fmt.Sprintf("%s should be a number, got %v", where, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s should be a boolean, got %v", where, value))
+		}
+	}
+	return problems
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+//testContractExchange replays a request to a documented route, as the user token is when set, leaving the
+//contract checks to the router
+func testContractExchange(t *testing.T, ExpectedCode int, method, path, token, body string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	if body != "" {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+}
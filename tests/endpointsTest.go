@@ -2,6 +2,7 @@ package test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,7 +10,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"properlyauth/mailer"
+	"properlyauth/models"
+	"strings"
 	"testing"
+
+	"golang.org/x/image/webp"
 )
 
 func testSignUp(t *testing.T, ExpectedCode int, password, email, typed string) string {
@@ -25,7 +31,7 @@ func testSignUp(t *testing.T, ExpectedCode int, password, email, typed string) s
 	data["lastname"] = "Akerele"
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -45,7 +51,7 @@ func testSignUp(t *testing.T, ExpectedCode int, password, email, typed string) s
 	return tokens[len(tokens)-1]
 }
 
-func testResetPassword(t *testing.T, ExpectedCode int, email, platform string) {
+func testResetPassword(t *testing.T, ExpectedCode int, email, platform, expectedToken string) {
 	w := httptest.NewRecorder()
 	req, err := http.NewRequest("PUT", fmt.Sprintf("/v1/reset/update-password/?platform=%s", platform), nil)
 	req.Header.Add("Content-Type", "application/json")
@@ -53,7 +59,7 @@ func testResetPassword(t *testing.T, ExpectedCode int, email, platform string) {
 	data["email"] = email
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -64,6 +70,14 @@ func testResetPassword(t *testing.T, ExpectedCode int, email, platform string) {
 		fmt.Printf("%s %s", responseText, w.Result().Status)
 		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
 	}
+
+	if _, err := mailer.NewWorker(testConfig).RunOnce(context.Background()); err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	sent := mailer.Default().(*mailer.Memory).Sent()
+	if len(sent) == 0 || sent[len(sent)-1].To != email || !strings.Contains(sent[len(sent)-1].Text, expectedToken) {
+		t.Fatalf("Expecting a reset email to %s carrying %s", email, expectedToken)
+	}
 }
 
 func testChangePassword(t *testing.T, ExpectedCode int, email, oldPassword, newPassword string) {
@@ -77,7 +91,7 @@ func testChangePassword(t *testing.T, ExpectedCode int, email, oldPassword, newP
 	data["password"] = newPassword
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -99,7 +113,7 @@ func testSignIn(t *testing.T, ExpectedCode int, password, email string) string {
 	data["password"] = password
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -151,7 +165,7 @@ func testChangePasswordByToken(t *testing.T, ExpectedCode int, email, password,
 	data["token"] = token
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -174,11 +188,11 @@ func testChangeUserProfile(t *testing.T, ExpectedCode int) {
 	data["email"] = "email"
 	data["password"] = "password"
 	data["token"] = "token"
-	data["phonenumber"] = "09078918596"
+	data["phonenumber"] = "+2349078918596"
 	data["firstname"] = "Adeniyi"
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -239,3 +253,313 @@ func testUploadPost(t *testing.T, ExpectedCode int) {
 		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
 	}
 }
+
+func testServeProfileImage(t *testing.T, ExpectedCode int) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v1/user/?platform=mobile", nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	key := result["data"].(map[string]interface{})["ProfileImageURL"].(string)
+	if !strings.HasPrefix(key, "media/") {
+		t.Fatalf("Expecting a storage key, got %s", key)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", fmt.Sprintf("/v1/serve/media/%s", strings.TrimPrefix(key, "media/")), nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Range", "bytes=0-9")
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	if ExpectedCode == http.StatusPartialContent && w.Body.Len() != 10 {
+		t.Fatalf("Expecting 10 bytes Got %d", w.Body.Len())
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", fmt.Sprintf("/v1/serve/media/%s?variant=thumbnail", strings.TrimPrefix(key, "media/")), nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expecting a jpeg thumbnail Got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("Exif")) {
+		t.Fatalf("Expecting the thumbnail without EXIF metadata")
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", fmt.Sprintf("/v2/media/%s?variant=thumbnail.webp", strings.TrimPrefix(key, "media/")), nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("Expecting a webp thumbnail Got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if _, err := webp.DecodeConfig(bytes.NewReader(w.Body.Bytes())); err != nil {
+		t.Fatalf("Expecting a readable webp thumbnail, %v occured", err)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", fmt.Sprintf("/v2/media/%s?variant=huge.webp", strings.TrimPrefix(key, "media/")), nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expecting %d for an unknown variant Got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func testUploadInvalidProfileImage(t *testing.T, ExpectedCode int) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("image", "../../avatar.png")
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	part.Write([]byte("#!/bin/sh\necho this is not an image\n"))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("%v occured", err)
+	}
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v1/user/update-profile-image/?platform=mobile", body)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+}
+
+func testServeMediaConditional(t *testing.T) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/user/?platform=mobile", nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	key := result["data"].(map[string]interface{})["ProfileImageURL"].(string)
+	path := fmt.Sprintf("/v1/serve/media/%s", strings.TrimPrefix(key, "media/"))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", path, nil)
+	router.ServeHTTP(w, req)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("Expecting 200 with ETag and Last-Modified Got %d %q", w.Code, etag)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline") || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("Expecting inline disposition and nosniff Got %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", path, nil)
+	req.Header.Add("If-None-Match", etag)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("Expecting %d Got %d", http.StatusNotModified, w.Code)
+	}
+}
+
+func testServeUnknownMedia(t *testing.T, ExpectedCode int, filename string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v1/serve/media/"+filename, nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+}
+
+func testRequestID(t *testing.T, requestID string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v1/user/?platform=mobile", nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	if requestID != "" {
+		req.Header.Add("X-Request-ID", requestID)
+	}
+	router.ServeHTTP(w, req)
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	echoed := w.Header().Get("X-Request-ID")
+	if echoed == "" || result["request_id"] != echoed {
+		t.Fatalf("Expecting the request id in the header and body Got %q and %v", echoed, result["request_id"])
+	}
+	if requestID != "" && echoed != requestID {
+		t.Fatalf("Expecting request id %s Got %s", requestID, echoed)
+	}
+}
+
+func testMetrics(t *testing.T, ExpectedCode int, token string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	for _, series := range []string{
+		`properly_http_requests_total{method="POST",route="/v1/login/",status="200"}`,
+		`properly_logins_total{reason="wrong_password",result="failure"}`,
+		`properly_logins_total{reason="",result="success"}`,
+		`properly_mongo_operation_duration_seconds_count{collection="User",command="find"}`,
+	} {
+		if !strings.Contains(w.Body.String(), series) {
+			t.Fatalf("Expecting %s in the metrics", series)
+		}
+	}
+}
+
+func testTracePropagation(t *testing.T, ExpectedCode int, traceID string) {
+	spans.Reset()
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v1/user/?platform=mobile", nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	req.Header.Add("traceparent", fmt.Sprintf("00-%s-00f067aa0ba902b7-01", traceID))
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+
+	var server, mongo bool
+	for _, span := range spans.GetSpans() {
+		if span.SpanContext.TraceID().String() != traceID {
+			continue
+		}
+		switch span.Name {
+		case "GET /v1/user/":
+			server = span.Parent.SpanID().String() == "00f067aa0ba902b7"
+		case "find User":
+			mongo = true
+		}
+	}
+	if !server || !mongo {
+		t.Fatalf("Expecting the request and its Mongo query in trace %s Got %d spans", traceID, len(spans.GetSpans()))
+	}
+}
+
+func testHealth(t *testing.T, ExpectedCode int, path string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+}
+
+func testSignInProblem(t *testing.T, ExpectedCode int, apiVersion, password, email, errorCode string) {
+	w := httptest.NewRecorder()
+	dataByte, _ := json.Marshal(map[string]interface{}{"email": email, "password": password})
+	req, err := http.NewRequest("POST", "/v1/login/?platform=mobile", bytes.NewReader(dataByte))
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-API-Version", apiVersion)
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if apiVersion == "2" {
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+			t.Fatalf("Expecting a problem Got %s", contentType)
+		}
+		if result["code"] != errorCode || result["status"] != float64(ExpectedCode) || result["type"] != "urn:properly:problem:"+errorCode {
+			t.Fatalf("Expecting problem %s Got %v", errorCode, result)
+		}
+		return
+	}
+	if result["error"] != errorCode || result["code"] != float64(ExpectedCode) {
+		t.Fatalf("Expecting error %s Got %v", errorCode, result)
+	}
+}
+
+func testSignUpValidation(t *testing.T, ExpectedCode int, locale string, data map[string]interface{}, expected ...string) {
+	w := httptest.NewRecorder()
+	dataByte, _ := json.Marshal(data)
+	req, err := http.NewRequest("POST", "/v1/signup/?platform=mobile", bytes.NewReader(dataByte))
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept-Language", locale)
+	req.Header.Add("X-API-Version", "2")
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+
+	result := struct {
+		Code   string `json:"code"`
+		Errors []struct {
+			Field   string `json:"field"`
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Code != "validation_failed" || len(result.Errors) != len(expected) {
+		t.Fatalf("Expecting %d field errors Got %s", len(expected), w.Body.String())
+	}
+	for i, fieldError := range result.Errors {
+		if got := fmt.Sprintf("%s: %s", fieldError.Field, fieldError.Message); got != expected[i] {
+			t.Fatalf("Expecting %q Got %q", expected[i], got)
+		}
+	}
+}
+
+//testSentBodiesCleared checks that the emails delivered to email no longer keep their bodies in the outbox
+func testSentBodiesCleared(t *testing.T, email string) {
+	sent, err := models.FetchOutboxEmails(context.Background(), email, models.OutboxSent, 100)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	if len(sent) == 0 {
+		t.Fatalf("Expecting emails sent to %s in the outbox", email)
+	}
+	for _, e := range sent {
+		if e.HTML != "" || e.Text != "" {
+			t.Fatalf("Expecting the body of sent email %s to be cleared", e.ID)
+		}
+	}
+}
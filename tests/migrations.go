@@ -0,0 +1,57 @@
+package test
+
+import (
+	"context"
+	"properlyauth/database"
+	"properlyauth/models"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//testClientIDs checks that the owner of token was written with its hex id and primary key in one insert
+func testClientIDs(t *testing.T, token string) {
+	id := getIdFromToken(t, token)
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		t.Fatalf("Err: %v, the token carries no object id", err)
+	}
+	client := database.GetMongoDB().GetClient()
+	raw := bson.M{}
+	err = client.Database(database.DbName).Collection(models.UserCollectionName).FindOne(context.Background(), bson.M{"_id": oid}).Decode(&raw)
+	if err != nil {
+		t.Fatalf("Err: %v, can't find the user by primary key", err)
+	}
+	if raw["id"] != id {
+		t.Fatalf("Expecting id %s to be stored along with the primary key Got %v", id, raw["id"])
+	}
+}
+
+//testRepairMissingIDs inserts a user the way the old insert-then-update flow left it, without an id,
+//and checks that the repair fills it in
+func testRepairMissingIDs(t *testing.T) {
+	client := database.GetMongoDB().GetClient()
+	collection := client.Database(database.DbName).Collection(models.UserCollectionName)
+	result, err := collection.InsertOne(context.Background(), bson.M{"email": "halfwritten@gmail.com", "type": models.Tenant})
+	if err != nil {
+		t.Fatalf("Err: %v, can't insert a user without id", err)
+	}
+	oid := result.InsertedID.(primitive.ObjectID)
+
+	repaired, err := models.RepairMissingIDs(context.Background())
+	if err != nil {
+		t.Fatalf("Err: %v, repairing ids failed", err)
+	}
+	if repaired < 1 {
+		t.Fatalf("Expecting the user without id to be repaired Got %d repaired", repaired)
+	}
+	user, err := models.FetchUserByID(context.Background(), oid.Hex())
+	if err != nil || user.ID != oid.Hex() {
+		t.Fatalf("Expecting the repaired user to have id %s Got %v %v", oid.Hex(), user, err)
+	}
+	if repaired, err := models.RepairMissingIDs(context.Background()); err != nil || repaired != 0 {
+		t.Fatalf("Expecting a second repair to change nothing Got %d %v", repaired, err)
+	}
+	collection.DeleteOne(context.Background(), bson.M{"_id": oid})
+}
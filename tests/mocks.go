@@ -1,23 +1,34 @@
 package test
 
 import (
-	"properlyauth/routes"
+	"io"
+	"net/http"
+	"properlyauth/config"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var (
-	router     = routes.Router()
+	router     http.Handler
+	testConfig *config.Config
 	tokens     = []string{}
 	propertyID = []string{}
+	spans      = tracetest.NewInMemoryExporter()
 )
 
 type mockReadCloser struct {
 	data []byte
 }
 
-func (mrc mockReadCloser) Read(data []byte) (int, error) {
-	return copy(data, mrc.data), nil
+func (mrc *mockReadCloser) Read(data []byte) (int, error) {
+	if len(mrc.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(data, mrc.data)
+	mrc.data = mrc.data[n:]
+	return n, nil
 }
 
-func (mrc mockReadCloser) Close() error {
+func (mrc *mockReadCloser) Close() error {
 	return nil
 }
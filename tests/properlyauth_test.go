@@ -2,22 +2,27 @@ package test
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"properlyauth/config"
 	"properlyauth/database"
 	"properlyauth/models"
+	"properlyauth/routes"
+	"properlyauth/storage"
+	"properlyauth/tracing"
 	"strings"
 	"syscall"
 	"testing"
 
-	"github.com/joho/godotenv"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func handleInterupt() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -28,56 +33,232 @@ func handleInterupt() {
 
 func TestScoodent(t *testing.T) {
 
-	os.Setenv("HOST", "127.0.0.1:8080")
-	os.Setenv("TESTING", "TESTING")
-	err := godotenv.Load("../.env")
-	if err != nil {
-		t.Fatalf("Error loading .env file")
-	}
 	dir, err := os.Getwd()
 	if err != nil {
 		t.Fatalf("Can't get current working directory due to error :%v", err)
 	}
 
 	dir = strings.TrimSuffix(dir, "tests")
-	os.Setenv("ROOTDIR", dir)
+	testConfig, err = config.Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-config", "../.env",
+		"-profile", config.Test,
+		"-host", "127.0.0.1:8080",
+		"-root-dir", dir,
+		"-mailer", config.FakeMailer,
+		"-random-source", config.FixedRandom,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracing.Configure(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer tracing.SetProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))(context.Background())
+	testConfig.BreachedPasswordsFile = fmt.Sprintf("%stests/breached-passwords.txt", dir)
+	testConfig.TrustedProxies = []string{"10.0.0.0/8"}
+	engine := routes.Router(testConfig)
+	if err := storage.Configure(testConfig); err != nil {
+		t.Fatal(err)
+	}
 	_, err = os.Stat(fmt.Sprintf("%spublic/media", dir))
 	if err != nil {
-		err := os.Mkdir(fmt.Sprintf("%spublic/media", dir), 0755)
+		err := os.MkdirAll(fmt.Sprintf("%spublic/media", dir), 0755)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
 	handleInterupt()
-	router.Static("/public", "public")
+	engine.Static("/public", "public")
+	router = checkContract(t, engine)
 	defer cleanUpDb()
-	testSignUp(t, http.StatusCreated, "password", "abrahamakerele38@gmail.com", models.Manager)
-	testSignUp(t, http.StatusCreated, "password", "abraham38@gmail.com", models.Landlord)
-	testSignUp(t, http.StatusCreated, "password", "abrahamak38@gmail.com", models.Tenant)
-	testSignUp(t, http.StatusCreated, "password", "niyi@gmail.com", models.Vendor)
-	testSignIn(t, http.StatusOK, "password", "abrahamakerele38@gmail.com")
+	testHealth(t, http.StatusOK, "/healthz")
+	testHealth(t, http.StatusOK, "/readyz")
+	testSignUp(t, http.StatusCreated, "Blue-Harbor-42", "abrahamakerele38@gmail.com", models.Manager)
+	testSignUp(t, http.StatusCreated, "Blue-Harbor-42", "abraham38@gmail.com", models.Landlord)
+	testSignUp(t, http.StatusCreated, "Blue-Harbor-42", "abrahamak38@gmail.com", models.Tenant)
+	testSignUp(t, http.StatusCreated, "Blue-Harbor-42", "niyi@gmail.com", models.Vendor)
+	testClientIDs(t, tokens[0])
+	testRepairMissingIDs(t)
+	testSignUpValidation(t, http.StatusBadRequest, "en-GB,en;q=0.8", map[string]interface{}{
+		"type": "owner", "firstname": "Abraham", "lastname": "Akerele", "email": "abraham", "password": "short", "confirmpassword": "short",
+	},
+		"type: type must be one of [manager landlord tenant vendor]",
+		"email: email must be a valid email address",
+	)
+	testSignUpValidation(t, http.StatusBadRequest, "fr", map[string]interface{}{},
+		"type: type est un champ obligatoire",
+		"firstname: firstname est un champ obligatoire",
+		"lastname: lastname est un champ obligatoire",
+		"email: email est un champ obligatoire",
+		"password: password est un champ obligatoire",
+		"confirmpassword: confirmpassword est un champ obligatoire",
+	)
+	testSignUpValidation(t, http.StatusBadRequest, "en", map[string]interface{}{
+		"type": "tenant", "firstname": "Abraham", "lastname": "Akerele", "email": "weak@gmail.com", "password": "abraham", "confirmpassword": "abraham",
+	},
+		"password: password must be at least 10 characters long",
+		"password: password must mix at least 3 of lowercase letters, uppercase letters, digits and symbols",
+		"password: password must not contain your name or email address",
+	)
+	testSignUpValidation(t, http.StatusBadRequest, "fr-FR", map[string]interface{}{
+		"type": "tenant", "firstname": "Abraham", "lastname": "Akerele", "email": "weak@gmail.com", "password": "Password123!", "confirmpassword": "Password123!",
+	},
+		"password: password figure dans une fuite de données, choisissez-en un autre",
+	)
+	testSignIn(t, http.StatusOK, "Blue-Harbor-42", "abrahamakerele38@gmail.com")
 	testGetProfile(t, http.StatusOK)
-	testChangePassword(t, http.StatusOK, "abrahamakerele38@gmail.com", "password", "newpassword")
-	testSignIn(t, http.StatusBadRequest, "password", "abrahamakerele38@gmail.com")
-	testSignIn(t, http.StatusOK, "newpassword", "abrahamakerele38@gmail.com")
-	testResetPassword(t, http.StatusOK, "abrahamakerele38@gmail.com", "web")
-	testChangePasswordByToken(t, http.StatusOK, "abrahamakerele38@gmail.com", "newpassword", "MTExMTEx")
-	testResetPassword(t, http.StatusOK, "abrahamakerele38@gmail.com", "mobile")
-	testChangePasswordByToken(t, http.StatusOK, "abrahamakerele38@gmail.com", "newpassword", "111111")
+	testRequestID(t, "client-supplied-id")
+	testRequestID(t, "")
+	testTracePropagation(t, http.StatusOK, "4bf92f3577b34da6a3ce929d0e0e4736")
+	testChangePassword(t, http.StatusBadRequest, "abrahamakerele38@gmail.com", "Blue-Harbor-42", "Blue-Harbor-42")
+	testChangePassword(t, http.StatusOK, "abrahamakerele38@gmail.com", "Blue-Harbor-42", "Quiet-Lantern-77")
+	testSignIn(t, http.StatusBadRequest, "Blue-Harbor-42", "abrahamakerele38@gmail.com")
+	testSignInProblem(t, http.StatusBadRequest, "1", "Blue-Harbor-42", "abrahamakerele38@gmail.com", "invalid_credentials")
+	testSignInProblem(t, http.StatusUnauthorized, "2", "Blue-Harbor-42", "abrahamakerele38@gmail.com", "invalid_credentials")
+	testSignInProblem(t, http.StatusUnauthorized, "2", "Blue-Harbor-42", "nobody@gmail.com", "invalid_credentials")
+	testSignIn(t, http.StatusOK, "Quiet-Lantern-77", "abrahamakerele38@gmail.com")
+	testMetrics(t, http.StatusOK, testConfig.MetricsToken)
+	testResetPassword(t, http.StatusOK, "abrahamakerele38@gmail.com", "web", "MTExMTExMTExMTExMTEx")
+	testChangePasswordByToken(t, http.StatusOK, "abrahamakerele38@gmail.com", "Amber-Orchard-19", "MTExMTExMTExMTExMTEx")
+	testV2ResetPassword(t, http.StatusOK, "abrahamakerele38@gmail.com")
+	testResetPassword(t, http.StatusOK, "abrahamakerele38@gmail.com", "mobile", "111111")
+	testSentBodiesCleared(t, "abrahamakerele38@gmail.com")
+	testChangePasswordByToken(t, http.StatusBadRequest, "abrahamakerele38@gmail.com", "Quiet-Lantern-77", "111111")
+	testChangePasswordByToken(t, http.StatusOK, "abrahamakerele38@gmail.com", "Silver-Meadow-63", "111111")
 	testChangeUserProfile(t, http.StatusOK)
 	testUploadPost(t, http.StatusOK)
-	testCreateProperty(t, http.StatusCreated)
+	testUploadInvalidProfileImage(t, http.StatusUnsupportedMediaType)
+	testServeProfileImage(t, http.StatusPartialContent)
+	testServeMediaConditional(t)
+	testServeUnknownMedia(t, http.StatusNotFound, "..%2f..%2fgo.mod")
+	testServeUnknownMedia(t, http.StatusNotFound, "not-uploaded.jpg")
+	testCreateProperty(t, http.StatusCreated, "/v1/create/property/?platform=mobile")
+	etag := testGetProperty(t, http.StatusOK, "")
+	testGetProperty(t, http.StatusNotModified, etag)
+	testGetProperty(t, http.StatusNotModified, "W/"+etag)
+	testUpdatePropertyIfMatch(t, http.StatusPreconditionFailed, "W/"+etag)
 	testUpdateProperty(t, http.StatusOK)
+	testUpdatePropertyIfMatch(t, http.StatusPreconditionFailed, etag)
+	testUpdatePropertyIfMatch(t, http.StatusOK, testGetProperty(t, http.StatusOK, ""))
+	testVersionConflict(t)
 	testAddLandlord(t, http.StatusOK)
 	testRemoveLandlord(t, http.StatusOK)
 	testAddTenant(t, http.StatusOK)
+	testDocumentURL(t, http.StatusOK, tokens[2])
+	testDocumentURL(t, http.StatusNotFound, tokens[3])
 	testRemoveTenant(t, http.StatusOK)
+	testV2Profile(t, http.StatusOK)
+	testV1Deprecation(t, "/v1/user/?platform=mobile", "/v2/users/me")
+	testV2UpdateProperty(t, http.StatusOK, "new post")
+	testV2PropertyMember(t, http.StatusOK, "POST", "tenants", getIdFromToken(t, tokens[2]))
+	testV2PropertyMember(t, http.StatusOK, "DELETE", "tenants", getIdFromToken(t, tokens[2]))
+	testV2PropertyMember(t, http.StatusNotFound, "DELETE", "tenants", getIdFromToken(t, tokens[2]))
+	testV2PropertyMember(t, http.StatusBadRequest, "DELETE", "landlords", "not-a-user")
+	otherManager := testSignUp(t, http.StatusCreated, "Blue-Harbor-42", "other.manager@gmail.com", models.Manager)
+	testOtherManagersProperty(t, http.StatusNotFound, otherManager)
+	testCreateProperty(t, http.StatusCreated, "/v2/properties")
+	testContractExchange(t, http.StatusOK, "GET", fmt.Sprintf("/v2/properties/%s", propertyID[1]), tokens[0], "")
+	testContractExchange(t, http.StatusOK, "POST", "/v2/sessions", "", `{"email":"abrahamakerele38@gmail.com","password":"Silver-Meadow-63"}`)
+	testContractExchange(t, http.StatusOK, "PATCH", "/v2/users/me", tokens[0], `{"lastname":"Akerele"}`)
+	testContractExchange(t, http.StatusUnauthorized, "PUT", "/v2/users/me/password", tokens[0], `{"oldpassword":"Blue-Harbor-42","password":"Quiet-Lantern-78"}`)
+	testPropertyImageCaption(t, http.StatusOK, "Living room")
+	testPropertyDocumentCategory(t, http.StatusOK, "lease")
+	testPropertyDocumentCategory(t, http.StatusBadRequest, "receipt")
+	testAddDocumentVersion(t, http.StatusOK)
+	testPruneReplacedVersions(t)
+	testReorderPropertyImages(t, http.StatusBadRequest, []string{"media/unknown.jpg"})
+	testDeletePropertyImage(t, http.StatusOK)
+
+	//version 1 accepted account types in any case and padded with spaces
+	adminToken := testSignUp(t, http.StatusCreated, "Blue-Harbor-42", "admin@gmail.com", " Tenant")
+	makeAdmin(t, adminToken)
+	vendorID := getIdFromToken(t, tokens[3])
+	testListUsers(t, http.StatusForbidden, tokens[0], "", 0)
+	testListUsers(t, http.StatusOK, adminToken, "q=NIYI", 1)
+	testListUsers(t, http.StatusOK, adminToken, "type=manager&per_page=1", 1)
+	testListUsers(t, http.StatusBadRequest, adminToken, "per_page=500", 0)
+	testAdminUserProperties(t, http.StatusOK, adminToken, getIdFromToken(t, tokens[0]), len(propertyID))
+	testChangeUserType(t, http.StatusOK, adminToken, vendorID, models.Landlord)
+	testChangeUserType(t, http.StatusForbidden, adminToken, getIdFromToken(t, adminToken), models.Manager)
+	testSuspendUser(t, http.StatusOK, adminToken, vendorID, true)
+	testAccountLocked(t, http.StatusForbidden, tokens[3], "account_suspended")
+	testSignIn(t, http.StatusForbidden, "Blue-Harbor-42", "niyi@gmail.com")
+	testListUsers(t, http.StatusOK, adminToken, "suspended=true", 1)
+	testSuspendUser(t, http.StatusOK, adminToken, vendorID, false)
+	testForcePasswordReset(t, http.StatusOK, adminToken, vendorID)
+	testAccountLocked(t, http.StatusForbidden, tokens[3], "password_reset_required")
+	testChangePasswordByToken(t, http.StatusOK, "niyi@gmail.com", "Amber-Orchard-19", "MTExMTExMTExMTExMTEx")
+	testSignIn(t, http.StatusOK, "Amber-Orchard-19", "niyi@gmail.com")
+	testDeleteUser(t, http.StatusForbidden, adminToken, getIdFromToken(t, adminToken))
+	testDeleteUser(t, http.StatusConflict, adminToken, getIdFromToken(t, tokens[0]))
+	testV2PropertyMember(t, http.StatusOK, "POST", "landlords", vendorID)
+	testDeleteUser(t, http.StatusOK, adminToken, vendorID)
+	testNotMember(t, "landlord", vendorID)
+	testAccountLocked(t, http.StatusNotFound, tokens[3], "user_not_found")
+	testAuditLog(t, http.StatusOK, adminToken, fmt.Sprintf("user=%s", vendorID),
+		models.AuditUserDeleted, models.AuditPropertyLandlordAdded, models.AuditUserPasswordReset, models.AuditUserPasswordResetForced, models.AuditUserReactivated, models.AuditUserSuspended, models.AuditUserTypeChanged)
+	testAuditLog(t, http.StatusOK, adminToken, fmt.Sprintf("property=%s&action=%s", propertyID[0], models.AuditPropertyTenantRemoved), models.AuditPropertyTenantRemoved, models.AuditPropertyTenantRemoved)
+	testAuditLog(t, http.StatusOK, adminToken, fmt.Sprintf("property=%s&from=2100-01-01T00:00:00Z", propertyID[0]))
+	testAuditLog(t, http.StatusBadRequest, adminToken, "from=2021-03-02T00:00:00Z&to=2021-03-01T00:00:00Z")
+	testAuditLog(t, http.StatusForbidden, tokens[0], "")
+	testVerifyAuditLog(t, http.StatusOK, adminToken)
+
+	phoneAgent := "Properly/2.1 (iPhone; iOS 17.4)"
+	phoneToken := testSignInFrom(t, http.StatusOK, "Blue-Harbor-42", "abraham38@gmail.com", "mobile", phoneAgent, true)
+	phoneToken = testSignInFrom(t, http.StatusOK, "Blue-Harbor-42", "abraham38@gmail.com", "mobile", phoneAgent, false)
+	testListSessions(t, http.StatusOK, phoneToken, 3)
+	testV1Deprecation(t, "/v1/user/sessions/?platform=mobile", "/v2/users/me/sessions")
+	testRevokeSession(t, http.StatusOK, phoneToken, getSessionFromToken(t, tokens[1]))
+	testAccountLocked(t, http.StatusUnauthorized, tokens[1], "session_ended")
+	testRevokeSession(t, http.StatusNotFound, phoneToken, getSessionFromToken(t, tokens[1]))
+	testRevokeSession(t, http.StatusNotFound, tokens[0], getSessionFromToken(t, phoneToken))
+	testSignOutEverywhere(t, http.StatusOK, phoneToken)
+	testAccountLocked(t, http.StatusUnauthorized, phoneToken, "session_ended")
+	testSignInFrom(t, http.StatusOK, "Blue-Harbor-42", "abraham38@gmail.com", "mobile", phoneAgent, false)
+	testSignInFrom(t, http.StatusOK, "Blue-Harbor-42", "abraham38@gmail.com", "mobile", "Properly/2.2 (iPhone; iOS 17.5)", false)
+	testConcurrentNewDevice(t, "Blue-Harbor-42", "abraham38@gmail.com", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0")
+	testSignInThrough(t, "Blue-Harbor-42", "abraham38@gmail.com", "10.0.0.2:41234", "203.0.113.7", "203.0.113.7")
+	testSignInThrough(t, "Blue-Harbor-42", "abraham38@gmail.com", "198.51.100.9:41234", "203.0.113.7", "198.51.100.9")
+	testAuditLog(t, http.StatusOK, adminToken, fmt.Sprintf("user=%s", getIdFromToken(t, phoneToken)),
+		models.AuditUserSignedOutEverywhere, models.AuditUserSessionRevoked)
+}
+
+//TestAPIContract checks the OpenAPI spec against the routes and replays requests that don't need a database through it
+func TestAPIContract(t *testing.T) {
+	engine := routes.Router(&config.Config{
+		Profile:      config.Test,
+		Host:         "127.0.0.1:8080",
+		SecretKey:    "contract",
+		Mailer:       config.FakeMailer,
+		RandomSource: config.FixedRandom,
+	})
+	testRoutesDocumented(t, engine, loadAPISpec(t))
+	router = checkContract(t, engine)
+	testHealth(t, http.StatusOK, "/healthz")
+	testContractExchange(t, http.StatusBadRequest, "POST", "/v2/users", "", "{}")
+	testContractExchange(t, http.StatusBadRequest, "POST", "/v2/users", "", "not json")
+	testContractExchange(t, http.StatusBadRequest, "POST", "/v2/sessions", "", `{"email":"abraham"}`)
+	testContractExchange(t, http.StatusBadRequest, "POST", "/v2/password-resets", "", "{}")
+	testContractExchange(t, http.StatusBadRequest, "POST", "/v2/password-resets/confirmation", "", "{}")
+	testContractExchange(t, http.StatusBadRequest, "PUT", "/v2/users/me/password", "", "{}")
+	testContractExchange(t, http.StatusUnauthorized, "GET", "/v2/users/me", "", "")
+	testContractExchange(t, http.StatusUnauthorized, "PATCH", "/v2/properties/5f8d0d55b54764421b7156c9", "", `{"name":"Akerele's house"}`)
+	testContractExchange(t, http.StatusUnauthorized, "GET", "/v2/support/outbox", "", "")
+	testContractExchange(t, http.StatusUnauthorized, "GET", "/v2/users/me/sessions", "", "")
+	testContractExchange(t, http.StatusUnauthorized, "DELETE", "/v2/users/me/sessions/5f8d0d55b54764421b7156c9", "", "")
+	testContractExchange(t, http.StatusUnauthorized, "GET", "/v2/admin/users?q=abraham", "", "")
+	testContractExchange(t, http.StatusUnauthorized, "PUT", "/v2/admin/users/5f8d0d55b54764421b7156c9/type", "", `{"type":"admin"}`)
+	testContractExchange(t, http.StatusUnauthorized, "DELETE", "/v2/admin/users/5f8d0d55b54764421b7156c9", "", "")
+	testContractExchange(t, http.StatusUnauthorized, "GET", "/v2/admin/audit?action=property.tenant_added", "", "")
+	testContractExchange(t, http.StatusUnauthorized, "GET", "/v2/admin/audit/verification", "", "")
+	testContractExchange(t, http.StatusForbidden, "GET", "/v2/documents?key=documents/lease.pdf&expires=1&signature=forged", "", "")
+	testContractExchange(t, http.StatusNotFound, "GET", "/v2/media/.env", "", "")
 }
 
 func cleanUpDb() {
 	if os.Getenv("CLEAR") == "CLEAR" {
 		client := database.GetMongoDB().GetClient()
 		log.Print(client.Database(database.DbName).Drop(context.TODO()))
-		log.Println(os.RemoveAll(fmt.Sprintf("%spublic/media/", os.Getenv("ROOTDIR"))))
+		log.Println(os.RemoveAll(fmt.Sprintf("%spublic/media/", testConfig.RootDir)))
 	}
 }
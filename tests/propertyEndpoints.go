@@ -2,15 +2,23 @@ package test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"properlyauth/apierr"
+	"properlyauth/models"
 	"properlyauth/utils"
+	"strings"
 	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func getIdFromToken(t *testing.T, token string) string {
@@ -33,7 +41,7 @@ func testUpdateProperty(t *testing.T, ExpectedCode int) {
 	data["type"] = "residential"
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -46,7 +54,55 @@ func testUpdateProperty(t *testing.T, ExpectedCode int) {
 	}
 }
 
-func testCreateProperty(t *testing.T, ExpectedCode int) {
+func testGetProperty(t *testing.T, ExpectedCode int, ifNoneMatch string) string {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", fmt.Sprintf("/v1/property/?platform=mobile&id=%s", propertyID[0]), nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	if ifNoneMatch != "" {
+		req.Header.Add("If-None-Match", ifNoneMatch)
+	}
+	router.ServeHTTP(w, req)
+	responseText, err := ioutil.ReadAll(w.Body)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", responseText, w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("Expecting an ETag header")
+	}
+	return etag
+}
+
+func testUpdatePropertyIfMatch(t *testing.T, ExpectedCode int, etag string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v1/update/property/?platform=mobile", nil)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	req.Header.Add("If-Match", etag)
+
+	data := make(map[string]interface{})
+	data["id"] = propertyID[0]
+	data["address"] = "old post"
+
+	dataByte, _ := json.Marshal(data)
+	mrc := &mockReadCloser{data: dataByte}
+	req.Body = mrc
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	router.ServeHTTP(w, req)
+	responseText, err := ioutil.ReadAll(w.Body)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", responseText, w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+}
+
+func testCreateProperty(t *testing.T, ExpectedCode int, path string) {
 	file, err := os.Open("image.jpg")
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -97,7 +153,11 @@ func testCreateProperty(t *testing.T, ExpectedCode int) {
 	}
 
 	w := httptest.NewRecorder()
-	req, err := http.NewRequest("PUT", "/v1/create/property/?platform=mobile", body)
+	method := "POST"
+	if strings.HasPrefix(path, "/v1/") {
+		method = "PUT"
+	}
+	req, err := http.NewRequest(method, path, body)
 
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -134,7 +194,7 @@ func testAddLandlord(t *testing.T, ExpectedCode int) {
 	data["userid"] = getIdFromToken(t, tokens[1])
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -158,7 +218,7 @@ func testRemoveLandlord(t *testing.T, ExpectedCode int) {
 	data["userid"] = getIdFromToken(t, tokens[1])
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -182,7 +242,7 @@ func testAddTenant(t *testing.T, ExpectedCode int) {
 	data["userid"] = getIdFromToken(t, tokens[2])
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -206,7 +266,7 @@ func testRemoveTenant(t *testing.T, ExpectedCode int) {
 	data["userid"] = getIdFromToken(t, tokens[2])
 
 	dataByte, _ := json.Marshal(data)
-	mrc := mockReadCloser{data: dataByte}
+	mrc := &mockReadCloser{data: dataByte}
 	req.Body = mrc
 	if err != nil {
 		t.Fatalf("%v occured", err)
@@ -218,3 +278,68 @@ func testRemoveTenant(t *testing.T, ExpectedCode int) {
 		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
 	}
 }
+
+func testDocumentURL(t *testing.T, ExpectedCode int, token string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", fmt.Sprintf("/v1/property/?platform=mobile&id=%s", propertyID[0]), nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	documents := result["data"].(map[string]interface{})["documents"].([]interface{})
+	document := documents[0].(map[string]interface{})["id"].(string)
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", fmt.Sprintf("/v1/property/document-url/?platform=mobile&id=%s&document=%s", propertyID[0], url.QueryEscape(document)), nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	if w.Code != http.StatusOK {
+		return
+	}
+	result = make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	signedURL := result["data"].(map[string]interface{})["url"].(string)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", signedURL, nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expecting %d Got %d for the signed url", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", strings.Replace(signedURL, "signature=", "signature=0", 1), nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expecting %d Got %d for a tampered url", http.StatusForbidden, w.Code)
+	}
+}
+
+//testVersionConflict saves a property from a stale copy and checks that the write is refused with a conflict
+func testVersionConflict(t *testing.T) {
+	fresh, err := models.FetchPropertyByID(context.Background(), propertyID[0])
+	if err != nil {
+		t.Fatalf("Err: %v, can't fetch the property", err)
+	}
+	stale := *fresh
+	if err := models.UpdateProperty(context.Background(), fresh, bson.D{{Key: "$set", Value: bson.M{"name": "fresh name"}}}); err != nil {
+		t.Fatalf("Err: %v, updating the fresh copy failed", err)
+	}
+	err = models.UpdateProperty(context.Background(), &stale, bson.D{{Key: "$set", Value: bson.M{"name": "stale name"}}})
+	if !errors.Is(err, models.ErrVersionConflict) || apierr.From(err).Status != http.StatusConflict {
+		t.Fatalf("Expecting a version conflict Got %v", err)
+	}
+	if stored, _ := models.FetchPropertyByID(context.Background(), propertyID[0]); stored == nil || stored.Name != "fresh name" {
+		t.Fatalf("Expecting the stale write to be dropped Got %v", stored)
+	}
+}
@@ -0,0 +1,179 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"properlyauth/database"
+	"properlyauth/models"
+	"properlyauth/retention"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//fetchProperty returns the data of the first property as seen by its manager
+func fetchProperty(t *testing.T) map[string]interface{} {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", fmt.Sprintf("/v1/property/?platform=mobile&id=%s", propertyID[0]), nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return result["data"].(map[string]interface{})
+}
+
+func propertyMediaRequest(t *testing.T, ExpectedCode int, method, path string, data map[string]interface{}) map[string]interface{} {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	if data != nil {
+		dataByte, _ := json.Marshal(data)
+		req.Body = &mockReadCloser{data: dataByte}
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return result
+}
+
+func testPropertyImageCaption(t *testing.T, ExpectedCode int, caption string) {
+	images := fetchProperty(t)["images"].([]interface{})
+	key := images[0].(map[string]interface{})["key"].(string)
+	result := propertyMediaRequest(t, ExpectedCode, "PUT", "/v1/property/images/caption/?platform=mobile", map[string]interface{}{
+		"propertyid": propertyID[0],
+		"key":        key,
+		"caption":    caption,
+	})
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	images = result["data"].(map[string]interface{})["images"].([]interface{})
+	if images[0].(map[string]interface{})["caption"] != caption {
+		t.Fatalf("Expecting caption %s Got %v", caption, images[0].(map[string]interface{})["caption"])
+	}
+}
+
+func testPropertyDocumentCategory(t *testing.T, ExpectedCode int, category string) {
+	documents := fetchProperty(t)["documents"].([]interface{})
+	id := documents[0].(map[string]interface{})["id"].(string)
+	propertyMediaRequest(t, ExpectedCode, "PUT", "/v1/property/documents/category/?platform=mobile", map[string]interface{}{
+		"propertyid": propertyID[0],
+		"documentid": id,
+		"category":   category,
+	})
+}
+
+func testReorderPropertyImages(t *testing.T, ExpectedCode int, keys []string) {
+	propertyMediaRequest(t, ExpectedCode, "PUT", "/v1/property/images/order/?platform=mobile", map[string]interface{}{
+		"propertyid": propertyID[0],
+		"keys":       keys,
+	})
+}
+
+func testDeletePropertyImage(t *testing.T, ExpectedCode int) {
+	property := fetchProperty(t)
+	key := property["cover_image"].(string)
+	path := fmt.Sprintf("/v1/property/images/?platform=mobile&id=%s&key=%s", propertyID[0], url.QueryEscape(key))
+	result := propertyMediaRequest(t, ExpectedCode, "DELETE", path, nil)
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	if result["data"].(map[string]interface{})["cover_image"] == key {
+		t.Fatalf("Expecting the deleted image to stop being the cover")
+	}
+	propertyMediaRequest(t, http.StatusNotFound, "DELETE", path, nil)
+}
+
+func testAddDocumentVersion(t *testing.T, ExpectedCode int) {
+	documents := fetchProperty(t)["documents"].([]interface{})
+	id := documents[0].(map[string]interface{})["id"].(string)
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("document", "lease-2021.pdf")
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	part.Write([]byte("%PDF-1.4\n% renewed lease\n%%EOF\n"))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("%v occured", err)
+	}
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", fmt.Sprintf("/v1/property/documents/versions/?platform=mobile&id=%s&document=%s", propertyID[0], url.QueryEscape(id)), body)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+
+	for _, version := range []int{1, 2} {
+		testDocumentVersionURL(t, http.StatusOK, id, version)
+	}
+}
+
+func testDocumentVersionURL(t *testing.T, ExpectedCode int, id string, version int) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/v1/property/document-url/?platform=mobile&id=%s&document=%s&version=%d", propertyID[0], url.QueryEscape(id), version), nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		t.Fatalf("Expecting %d Got %d for version %d", ExpectedCode, w.Code, version)
+	}
+}
+
+//testPruneReplacedVersions backdates the upload of the first document's first version, which was
+//just replaced, and checks that it is kept until the retention period passes from its replacement
+func testPruneReplacedVersions(t *testing.T) {
+	documents := fetchProperty(t)["documents"].([]interface{})
+	id := documents[0].(map[string]interface{})["id"].(string)
+	oid, err := primitive.ObjectIDFromHex(propertyID[0])
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	now := time.Now()
+	client := database.GetMongoDB().GetClient()
+	collection := client.Database(database.DbName).Collection(models.PropertyCollectionName)
+	backdate := bson.M{"$set": bson.M{"documents.0.versions.0.uploadedat": now.AddDate(-1, 0, 0).Unix()}}
+	if _, err := collection.UpdateOne(context.Background(), bson.M{"_id": oid}, backdate); err != nil {
+		t.Fatalf("%v occured", err)
+	}
+
+	pruner := &retention.Pruner{Retention: 30 * 24 * time.Hour}
+	if pruned, err := pruner.RunOnce(context.Background(), now); err != nil || pruned != 0 {
+		t.Fatalf("Expecting a version replaced just now to be kept Got %d pruned %v", pruned, err)
+	}
+	testDocumentVersionURL(t, http.StatusOK, id, 1)
+	if pruned, err := pruner.RunOnce(context.Background(), now.Add(31*24*time.Hour)); err != nil || pruned < 1 {
+		t.Fatalf("Expecting the replaced version to be pruned after the retention period Got %d pruned %v", pruned, err)
+	}
+	testDocumentVersionURL(t, http.StatusNotFound, id, 1)
+	testDocumentVersionURL(t, http.StatusOK, id, 2)
+}
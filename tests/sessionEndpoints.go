@@ -0,0 +1,162 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"properlyauth/mailer"
+	"properlyauth/utils"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func getSessionFromToken(t *testing.T, token string) string {
+	m, err := utils.DecodeJWTToken(token)
+	if err != nil {
+		t.Fatalf("Err: %v, can decode token", err)
+	}
+	return m["session_id"]
+}
+
+//testSignInFrom signs in from the device platform and userAgent describe and checks whether the
+//user was emailed about a new device
+func testSignInFrom(t *testing.T, ExpectedCode int, password, email, platform, userAgent string, newDevice bool) string {
+	sent := len(mailer.Default().(*mailer.Memory).Sent())
+	w := httptest.NewRecorder()
+	dataByte, _ := json.Marshal(map[string]interface{}{"email": email, "password": password})
+	req, err := http.NewRequest("POST", "/v2/sessions", bytes.NewReader(dataByte))
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Client-Platform", platform)
+	req.Header.Add("User-Agent", userAgent)
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	if w.Code >= 400 {
+		return ""
+	}
+
+	if _, err := mailer.NewWorker(testConfig).RunOnce(context.Background()); err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	notified := false
+	for _, msg := range mailer.Default().(*mailer.Memory).Sent()[sent:] {
+		if msg.To == email && strings.Contains(msg.Text, userAgent) {
+			notified = true
+		}
+	}
+	if notified != newDevice {
+		t.Fatalf("Expecting a new device email to %s to be %v Got %v", email, newDevice, notified)
+	}
+
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return result["data"].(map[string]interface{})["token"].(string)
+}
+
+//testConcurrentNewDevice signs in twice at once from a device the user never used and checks that
+//they are emailed about it once
+func testConcurrentNewDevice(t *testing.T, password, email, userAgent string) {
+	sent := len(mailer.Default().(*mailer.Memory).Sent())
+	dataByte, _ := json.Marshal(map[string]interface{}{"email": email, "password": password})
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/v2/sessions", bytes.NewReader(dataByte))
+			req.Header.Add("Content-Type", "application/json")
+			req.Header.Add("X-Client-Platform", "web")
+			req.Header.Add("User-Agent", userAgent)
+			router.ServeHTTP(w, req)
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("Expecting %d Got %v", http.StatusOK, codes)
+		}
+	}
+
+	if _, err := mailer.NewWorker(testConfig).RunOnce(context.Background()); err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	notified := 0
+	for _, msg := range mailer.Default().(*mailer.Memory).Sent()[sent:] {
+		if msg.To == email && strings.Contains(msg.Text, userAgent) {
+			notified++
+		}
+	}
+	if notified != 1 {
+		t.Fatalf("Expecting one new device email to %s Got %d", email, notified)
+	}
+}
+
+//testSignInThrough signs in over a connection from remoteAddr claiming in X-Forwarded-For to come
+//from forwardedFor, and checks that the new session records expected as its address
+func testSignInThrough(t *testing.T, password, email, remoteAddr, forwardedFor, expected string) {
+	w := httptest.NewRecorder()
+	dataByte, _ := json.Marshal(map[string]interface{}{"email": email, "password": password})
+	req, err := http.NewRequest("POST", "/v2/sessions", bytes.NewReader(dataByte))
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.RemoteAddr = remoteAddr
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Forwarded-For", forwardedFor)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", http.StatusOK, w.Code)
+	}
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	token := result["data"].(map[string]interface{})["token"].(string)
+
+	current := getSessionFromToken(t, token)
+	sessions := adminRequest(t, http.StatusOK, "GET", "/v2/users/me/sessions", token, nil)["data"].([]interface{})
+	for _, s := range sessions {
+		session := s.(map[string]interface{})
+		if session["id"] == current && session["ip"] != expected {
+			t.Fatalf("Expecting the session to be from %s Got %v", expected, session["ip"])
+		}
+	}
+}
+
+//testListSessions checks that token lists at least expected sessions, its own marked as current
+func testListSessions(t *testing.T, ExpectedCode int, token string, expected int) {
+	result := adminRequest(t, ExpectedCode, "GET", "/v2/users/me/sessions", token, nil)
+	if ExpectedCode != http.StatusOK {
+		return
+	}
+	sessions := result["data"].([]interface{})
+	if len(sessions) < expected {
+		t.Fatalf("Expecting at least %d sessions Got %v", expected, sessions)
+	}
+	current := getSessionFromToken(t, token)
+	for _, s := range sessions {
+		session := s.(map[string]interface{})
+		if (session["id"] == current) != session["current"] {
+			t.Fatalf("Expecting only session %s to be current Got %v", current, session)
+		}
+	}
+}
+
+func testRevokeSession(t *testing.T, ExpectedCode int, token, sessionID string) {
+	adminRequest(t, ExpectedCode, "DELETE", fmt.Sprintf("/v2/users/me/sessions/%s", sessionID), token, nil)
+}
+
+func testSignOutEverywhere(t *testing.T, ExpectedCode int, token string) {
+	adminRequest(t, ExpectedCode, "DELETE", "/v1/user/sessions/?platform=mobile", token, nil)
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testV2Profile(t *testing.T, ExpectedCode int) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/users/me", nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	if deprecation := w.Header().Get("Deprecation"); deprecation != "" {
+		t.Fatalf("Expecting v2 not to be deprecated Got %s", deprecation)
+	}
+}
+
+func testV1Deprecation(t *testing.T, path, successor string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	if w.Header().Get("Deprecation") != "true" {
+		t.Fatalf("Expecting %s to be deprecated", path)
+	}
+	if link := w.Header().Get("Link"); link != fmt.Sprintf("<%s>; rel=\"successor-version\"", successor) {
+		t.Fatalf("Expecting %s to point at %s Got %s", path, successor, link)
+	}
+}
+
+func testV2UpdateProperty(t *testing.T, ExpectedCode int, address string) {
+	w := httptest.NewRecorder()
+	dataByte, _ := json.Marshal(map[string]interface{}{"address": address})
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("/v2/properties/%s", propertyID[0]), bytes.NewReader(dataByte))
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+}
+
+func testV2PropertyMember(t *testing.T, ExpectedCode int, method, role, userID string) {
+	w := httptest.NewRecorder()
+	var req *http.Request
+	var err error
+	if method == "DELETE" {
+		req, err = http.NewRequest(method, fmt.Sprintf("/v2/properties/%s/%s/%s", propertyID[0], role, userID), nil)
+	} else {
+		dataByte, _ := json.Marshal(map[string]interface{}{"userid": userID})
+		req, err = http.NewRequest(method, fmt.Sprintf("/v2/properties/%s/%s", propertyID[0], role), bytes.NewReader(dataByte))
+		req.Header.Add("Content-Type", "application/json")
+	}
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tokens[0]))
+	req.Header.Add("X-Client-Platform", "mobile")
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	if ExpectedCode >= http.StatusBadRequest && w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("Expecting v2 errors as problems Got %s", w.Header().Get("Content-Type"))
+	}
+}
+
+//testOtherManagersProperty checks that the manager token signs in can't change the details or the members
+//of a property another manager created
+func testOtherManagersProperty(t *testing.T, ExpectedCode int, token string) {
+	tenantID := getIdFromToken(t, tokens[2])
+	requests := []struct {
+		method, path string
+		data         map[string]interface{}
+	}{
+		{"PATCH", fmt.Sprintf("/v2/properties/%s", propertyID[0]), map[string]interface{}{"address": "taken over"}},
+		{"POST", fmt.Sprintf("/v2/properties/%s/tenants", propertyID[0]), map[string]interface{}{"userid": tenantID}},
+		{"DELETE", fmt.Sprintf("/v2/properties/%s/landlords/%s", propertyID[0], getIdFromToken(t, tokens[1])), nil},
+		{"PUT", "/v1/update/property/?platform=mobile", map[string]interface{}{"id": propertyID[0], "address": "taken over"}},
+		{"PUT", "/v1/property/add-tenant/?platform=mobile", map[string]interface{}{"propertyid": propertyID[0], "userid": tenantID}},
+	}
+	for _, request := range requests {
+		adminRequest(t, ExpectedCode, request.method, request.path, token, request.data)
+	}
+	testNotMember(t, "tenants", tenantID)
+}
+
+//testV2ResetPassword checks that version 2 answers a password reset request without the reset token,
+//which only the email carries
+func testV2ResetPassword(t *testing.T, ExpectedCode int, email string) {
+	w := httptest.NewRecorder()
+	dataByte, _ := json.Marshal(map[string]interface{}{"email": email})
+	req, err := http.NewRequest("POST", "/v2/password-resets", bytes.NewReader(dataByte))
+	if err != nil {
+		t.Fatalf("%v occured", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Client-Platform", "mobile")
+	router.ServeHTTP(w, req)
+	if w.Code != ExpectedCode {
+		fmt.Printf("%s %s", w.Body.String(), w.Result().Status)
+		t.Fatalf("Expecting %d Got %d ", ExpectedCode, w.Code)
+	}
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result["data"] != nil {
+		t.Fatalf("Expecting no reset token in the response Got %v", result["data"])
+	}
+}
@@ -0,0 +1,163 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"properlyauth/config"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//name identifies the spans started by properly
+const name = "properlyauth"
+
+//Tracer returns the tracer spans are started with. It goes through whatever provider is set, so it can be
+//taken before tracing is configured
+func Tracer() trace.Tracer {
+	return otel.Tracer(name)
+}
+
+//Configure propagates W3C trace context and, when cfg has an OTLP endpoint, exports spans to it over http.
+//It returns a function flushing the spans not yet exported, to call before exiting
+func Configure(cfg *config.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	)
+	return SetProvider(provider), nil
+}
+
+//SetProvider makes spans go through provider, such as one writing to an in-memory exporter in tests.
+//It returns a function flushing and shutting down provider
+func SetProvider(provider *sdktrace.TracerProvider) func(context.Context) error {
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+//Middleware starts a server span for every request, continuing the trace of the caller when it sent a
+//traceparent header. The span is carried by the request context so handlers pass it on to Mongo
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := Tracer().Start(ctx, c.Request.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.UserAgentOriginal(c.Request.UserAgent()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if route := c.FullPath(); route != "" {
+			span.SetName(fmt.Sprintf("%s %s", c.Request.Method, route))
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("status %d", status))
+			if err := c.Errors.Last(); err != nil {
+				span.RecordError(err.Err)
+			}
+		}
+	}
+}
+
+//MongoMonitor returns a command monitor recording a client span for every command sent to Mongo, as a
+//child of the span in the context the command was sent with. Commands are not recorded as they hold user data
+func MongoMonitor() *event.CommandMonitor {
+	//only the started event carries the command so spans are matched to their outcome by request id
+	var spans sync.Map
+	finished := func(requestID int64, err error) {
+		span, ok := spans.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+		if err != nil {
+			span.(trace.Span).RecordError(err)
+			span.(trace.Span).SetStatus(codes.Error, err.Error())
+		}
+		span.(trace.Span).End()
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			attrs := []attribute.KeyValue{
+				semconv.DBSystemMongoDB,
+				semconv.DBNamespace(e.DatabaseName),
+				semconv.DBOperationName(e.CommandName),
+			}
+			spanName := e.CommandName
+			if collection, ok := collectionName(e); ok {
+				attrs = append(attrs, semconv.DBCollectionName(collection))
+				spanName = fmt.Sprintf("%s %s", e.CommandName, collection)
+			}
+			_, span := Tracer().Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+			spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			var err error
+			if writeErrors, ok := e.Reply.Lookup("writeErrors").ArrayOK(); ok {
+				err = fmt.Errorf("write errors: %s", writeErrors)
+			}
+			finished(e.RequestID, err)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			finished(e.RequestID, errors.New(e.Failure))
+		},
+	}
+}
+
+//Carrier returns the trace context of ctx as a map that can be stored, to link later work such as
+//delivering an email back to the request that queued it
+func Carrier(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+//LinkTo returns a link to the span whose trace context was stored with Carrier
+func LinkTo(carrier map[string]string) trace.Link {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(carrier))
+	return trace.LinkFromContext(ctx)
+}
+
+//collectionName returns the collection named by the first element of a collection command, as in {find: "User"}
+func collectionName(e *event.CommandStartedEvent) (string, bool) {
+	first, err := e.Command.IndexErr(0)
+	if err != nil {
+		return "", false
+	}
+	return first.Value().StringValueOK()
+}
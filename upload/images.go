@@ -0,0 +1,361 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"properlyauth/models"
+	"properlyauth/storage"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+//MaxPixels is the largest image, in pixels, that is decoded. It keeps a small file that
+//decompresses into a huge bitmap from exhausting memory
+const MaxPixels = 40 << 20
+
+//jpegQuality is used when re-encoding jpeg images and their variants
+const jpegQuality = 85
+
+//Variant is a resized copy generated for every uploaded image
+type Variant struct {
+	Name string
+	//MaxDimension bounds the width and height of the variant. Smaller images are not enlarged
+	MaxDimension int
+}
+
+//ImageVariants are the variants generated for property and profile images
+var ImageVariants = []Variant{
+	{Name: "thumbnail", MaxDimension: 200},
+	{Name: "medium", MaxDimension: 800},
+	{Name: "large", MaxDimension: 1600},
+}
+
+//IsVariant reports whether name is one of ImageVariants
+func IsVariant(name string) bool {
+	for _, variant := range ImageVariants {
+		if variant.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//webpSuffix is added to the name of a variant to ask for its WebP copy, as in thumbnail.webp
+const webpSuffix = ".webp"
+
+//ParseVariant splits a requested variant such as medium or medium.webp into the name of the variant
+//and whether its WebP copy is wanted. ok is false when no such variant is generated
+func ParseVariant(requested string) (name string, webp bool, ok bool) {
+	name = strings.TrimSuffix(requested, webpSuffix)
+	return name, name != requested, IsVariant(name)
+}
+
+//VariantKey returns the key a variant of the image stored under key is stored under, in the
+//image's own format or as WebP
+func VariantKey(key, variant string, webp bool) string {
+	ext := ""
+	for i := len(key) - 1; i >= 0 && key[i] != '/'; i-- {
+		if key[i] == '.' {
+			key, ext = key[:i], key[i:]
+			break
+		}
+	}
+	if webp {
+		ext = webpSuffix
+	}
+	return fmt.Sprintf("%s_%s%s", key, variant, ext)
+}
+
+//StoredVariant is a variant stored by the pipeline
+type StoredVariant struct {
+	Key    string
+	WebP   string
+	Width  int
+	Height int
+}
+
+//Image describes the stored image for the database
+func (f *File) Image() models.Image {
+	described := models.Image{
+		Key:      f.Key,
+		Width:    f.Width,
+		Height:   f.Height,
+		Variants: map[string]models.ImageVariant{},
+	}
+	for name, variant := range f.Variants {
+		described.Variants[name] = models.ImageVariant{
+			Key:    variant.Key,
+			WebP:   variant.WebP,
+			Width:  variant.Width,
+			Height: variant.Height,
+		}
+	}
+	return described
+}
+
+//saveImage decodes an image, turns it upright, and stores it re-encoded along with its variants, each
+//in the image's own format and as lossless WebP. Re-encoding drops EXIF and any other metadata the
+//image was uploaded with
+func (p *Pipeline) saveImage(ctx context.Context, file io.ReadSeeker, name, contentType, sum, ext string, variants []Variant, store storage.Storage, prefix string) (*File, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, &Error{Status: http.StatusUnsupportedMediaType, Name: name, Reason: "the image can't be read"}
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, &Error{Status: http.StatusRequestEntityTooLarge, Name: name, Reason: fmt.Sprintf("images can't be larger than %d megapixels", MaxPixels>>20)}
+	}
+
+	orientation := 1
+	if contentType == "image/jpeg" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		head := make([]byte, 256<<10)
+		n, _ := io.ReadFull(file, head)
+		orientation = jpegOrientation(head[:n])
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, &Error{Status: http.StatusUnsupportedMediaType, Name: name, Reason: "the image can't be read"}
+	}
+	img = orient(img, orientation)
+
+	key := prefix + sum + ext
+	size, err := putImage(ctx, store, key, img, contentType)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	saved := &File{
+		Key:         key,
+		Name:        name,
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      sum,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Variants:    map[string]*StoredVariant{},
+	}
+
+	for _, variant := range variants {
+		resized := resize(img, variant.MaxDimension)
+		stored := &StoredVariant{
+			Key:    VariantKey(key, variant.Name, false),
+			WebP:   VariantKey(key, variant.Name, true),
+			Width:  resized.Bounds().Dx(),
+			Height: resized.Bounds().Dy(),
+		}
+		if _, err := putImage(ctx, store, stored.Key, resized, contentType); err != nil {
+			return nil, err
+		}
+		if _, err := putImage(ctx, store, stored.WebP, resized, "image/webp"); err != nil {
+			return nil, err
+		}
+		saved.Variants[variant.Name] = stored
+	}
+	return saved, nil
+}
+
+//Reprocess runs an image stored under key before images were processed through the pipeline, so
+//it is stored without metadata and with variants under prefix. The original stays under key
+//unless the processed image takes its place; callers delete it once nothing refers to it
+func (p *Pipeline) Reprocess(ctx context.Context, store storage.Storage, key, prefix string) (*File, error) {
+	object, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(object)
+	object.Close()
+	if err != nil {
+		return nil, err
+	}
+	name := SanitizeFilename(key)
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedExtension(ImagePolicy, contentType, name)
+	if !ok {
+		return nil, &Error{Status: http.StatusUnsupportedMediaType, Name: name, Reason: fmt.Sprintf("%s files are not images", contentType)}
+	}
+
+	//uploads named after their checksum are in the way of the processed image, which would otherwise be skipped as stored
+	if prefix+sum+ext == key {
+		if err := store.Delete(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+	saved, err := p.saveImage(ctx, bytes.NewReader(data), name, contentType, sum, ext, ImageVariants, store, prefix)
+	if err != nil && prefix+sum+ext == key {
+		store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+	}
+	return saved, err
+}
+
+//putImage encodes img as contentType and stores it under key unless something is already stored there.
+//It returns the size of the stored image
+func putImage(ctx context.Context, store storage.Storage, key string, img image.Image, contentType string) (int64, error) {
+	if info, err := store.Stat(ctx, key); err == nil {
+		return info.Size, nil
+	} else if err != storage.ErrNotFound {
+		return 0, err
+	}
+
+	buf := new(bytes.Buffer)
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality})
+	case "image/png":
+		err = png.Encode(buf, img)
+	case "image/webp":
+		err = nativewebp.Encode(buf, img, nil)
+	default:
+		err = fmt.Errorf("can't encode %s images", contentType)
+	}
+	if err != nil {
+		return 0, err
+	}
+	size := int64(buf.Len())
+	return size, store.Put(ctx, key, bytes.NewReader(buf.Bytes()), size, contentType)
+}
+
+//resize scales img down so neither side exceeds max, keeping its aspect ratio
+func resize(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= max && height <= max {
+		return img
+	}
+	if width >= height {
+		width, height = max, height*max/width
+	} else {
+		width, height = width*max/height, max
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+	return resized
+}
+
+//jpegOrientation returns the EXIF orientation, 1 to 8, of the jpeg starting with data.
+//Images with no orientation, or one that can't be read, count as upright
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		//the image data starts at the start of scan marker, metadata can't follow it
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		start, end := i+4, i+2+length
+		if length < 2 || end > len(data) {
+			return 1
+		}
+		if marker == 0xE1 && end-start >= 6 && string(data[start:start+6]) == "Exif\x00\x00" {
+			return tiffOrientation(data[start+6 : end])
+		}
+		i = end
+	}
+	return 1
+}
+
+//tiffOrientation reads the orientation tag from the first directory of an EXIF tiff block
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+//orient returns img turned the way its EXIF orientation says it should be displayed,
+//since the orientation is lost with the rest of the metadata
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	oriented := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			oriented.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return oriented
+}
@@ -0,0 +1,100 @@
+package upload
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+//Verdict is the outcome of scanning a file
+type Verdict struct {
+	Clean bool
+	//Signature names what was found in a file that isn't clean
+	Signature string
+}
+
+//Scanner inspects uploaded content before it is stored
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Verdict, error)
+}
+
+//NoopScanner accepts every file
+type NoopScanner struct{}
+
+//Scan accepts the file
+func (NoopScanner) Scan(ctx context.Context, r io.Reader) (Verdict, error) {
+	return Verdict{Clean: true}, nil
+}
+
+//ClamAV scans files with a clamd daemon using the INSTREAM command.
+//Address is either unix:/path/to/clamd.sock or tcp:host:port
+type ClamAV struct {
+	Address string
+	Timeout time.Duration
+}
+
+//Scan streams the file to clamd
+func (cl *ClamAV) Scan(ctx context.Context, r io.Reader) (Verdict, error) {
+	network, address := "unix", cl.Address
+	if i := strings.Index(cl.Address, ":"); i > 0 && (cl.Address[:i] == "unix" || cl.Address[:i] == "tcp") {
+		network, address = cl.Address[:i], cl.Address[i+1:]
+	}
+	timeout := cl.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Verdict{}, err
+	}
+	chunk := make([]byte, 32*1024)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return Verdict{}, werr
+			}
+			if _, werr := conn.Write(chunk[:n]); werr != nil {
+				return Verdict{}, werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Verdict{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Verdict{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return Verdict{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return Verdict{Clean: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return Verdict{Clean: false, Signature: signature}, nil
+	}
+	return Verdict{}, fmt.Errorf("unexpected clamd reply %q", reply)
+}
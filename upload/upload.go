@@ -0,0 +1,287 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"properlyauth/apierr"
+	"properlyauth/config"
+	"properlyauth/storage"
+	"strings"
+	"sync"
+)
+
+//QuarantinePrefix is the key prefix, in private storage, of rejected uploads kept for inspection
+const QuarantinePrefix = "quarantine/"
+
+//Policy restricts what may be uploaded through one form field
+type Policy struct {
+	//MaxSize is the largest accepted file in bytes
+	MaxSize int64
+	//MaxCount is the largest number of files accepted in one request
+	MaxCount int
+	//Allowed maps each accepted sniffed content type to the extensions it may be uploaded with.
+	//The first extension is used for the stored file. Types with no extensions accept any
+	Allowed map[string][]string
+	//Variants, when set, makes uploads images that are stored without metadata along with resized variants
+	Variants []Variant
+}
+
+var (
+	//ImagePolicy applies to property images
+	ImagePolicy = Policy{
+		MaxSize:  10 << 20,
+		MaxCount: 20,
+		Allowed: map[string][]string{
+			"image/jpeg": {".jpg", ".jpeg"},
+			"image/png":  {".png"},
+			"image/webp": {".webp"},
+		},
+		Variants: ImageVariants,
+	}
+	//ProfileImagePolicy applies to user profile images
+	ProfileImagePolicy = Policy{
+		MaxSize:  5 << 20,
+		MaxCount: 1,
+		Allowed: map[string][]string{
+			"image/jpeg": {".jpg", ".jpeg"},
+			"image/png":  {".png"},
+		},
+		Variants: ImageVariants,
+	}
+	//DocumentPolicy applies to property documents such as leases, ids and title deeds
+	DocumentPolicy = Policy{
+		MaxSize:  25 << 20,
+		MaxCount: 20,
+		Allowed: map[string][]string{
+			"application/pdf": {".pdf"},
+			"image/jpeg":      {".jpg", ".jpeg"},
+			"image/png":       {".png"},
+			"application/zip": {".docx", ".xlsx", ".odt"},
+		},
+	}
+)
+
+//File is an upload that passed the pipeline and was stored
+type File struct {
+	Key         string
+	Name        string
+	ContentType string
+	Size        int64
+	SHA256      string
+	//Width, Height and Variants are only set for images
+	Width    int
+	Height   int
+	Variants map[string]*StoredVariant
+}
+
+//Error is an upload rejected by the pipeline
+type Error struct {
+	Status int
+	Name   string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Reason)
+}
+
+//Problem returns the catalog error a rejected upload is reported as
+func (e *Error) Problem() *apierr.Error {
+	problem := apierr.BadRequest
+	switch e.Status {
+	case http.StatusRequestEntityTooLarge:
+		problem = apierr.PayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		problem = apierr.UnsupportedMediaType
+	case http.StatusUnprocessableEntity:
+		problem = apierr.UnsafeUpload
+	}
+	return problem.Withf("%s", e.Error())
+}
+
+//Pipeline validates, scans and stores uploads
+type Pipeline struct {
+	Scanner Scanner
+}
+
+var (
+	defaultPipeline = &Pipeline{Scanner: NoopScanner{}}
+	defaultMutex    sync.RWMutex
+)
+
+//Configure builds the pipeline described by cfg and makes it the default
+func Configure(cfg *config.Config) {
+	var scanner Scanner = NoopScanner{}
+	if cfg.UploadScanner == config.ClamAVScanner {
+		scanner = &ClamAV{Address: cfg.ClamAVAddress}
+	}
+	defaultMutex.Lock()
+	defaultPipeline = &Pipeline{Scanner: scanner}
+	defaultMutex.Unlock()
+}
+
+//Default returns the pipeline uploads go through
+func Default() *Pipeline {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultPipeline
+}
+
+//SaveAll runs every file through Save. Nothing is stored unless the number of files is within the policy
+func (p *Pipeline) SaveAll(ctx context.Context, files []*multipart.FileHeader, policy Policy, store storage.Storage, prefix string) ([]*File, error) {
+	if len(files) > policy.MaxCount {
+		return nil, &Error{Status: http.StatusBadRequest, Name: "files", Reason: fmt.Sprintf("at most %d files can be uploaded at once", policy.MaxCount)}
+	}
+	saved := []*File{}
+	for _, fileHeader := range files {
+		file, err := p.Save(ctx, fileHeader, policy, store, prefix)
+		if err != nil {
+			return saved, err
+		}
+		saved = append(saved, file)
+	}
+	return saved, nil
+}
+
+//Save checks the size and sniffed type of an upload against policy, scans it and stores it in store
+//under prefix followed by its SHA-256, so identical uploads are only stored once.
+//Files rejected for their content are moved to quarantine in private storage
+func (p *Pipeline) Save(ctx context.Context, fileHeader *multipart.FileHeader, policy Policy, store storage.Storage, prefix string) (*File, error) {
+	name := SanitizeFilename(fileHeader.Filename)
+	if fileHeader.Size > policy.MaxSize {
+		return nil, &Error{Status: http.StatusRequestEntityTooLarge, Name: name, Reason: fmt.Sprintf("files can't be larger than %d MB", policy.MaxSize>>20)}
+	}
+	if fileHeader.Size == 0 {
+		return nil, &Error{Status: http.StatusBadRequest, Name: name, Reason: "the file is empty"}
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	hash := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	ext, ok := allowedExtension(policy, contentType, name)
+	if !ok {
+		p.quarantine(ctx, file, fileHeader.Size, contentType, sum, name)
+		return nil, &Error{Status: http.StatusUnsupportedMediaType, Name: name, Reason: fmt.Sprintf("%s files are not allowed here", contentType)}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	verdict, err := p.Scanner.Scan(ctx, file)
+	if err != nil {
+		return nil, fmt.Errorf("scanning %s failed: %v", name, err)
+	}
+	if !verdict.Clean {
+		p.quarantine(ctx, file, fileHeader.Size, contentType, sum, name)
+		return nil, &Error{Status: http.StatusUnprocessableEntity, Name: name, Reason: fmt.Sprintf("the file was rejected by the virus scanner (%s)", verdict.Signature)}
+	}
+
+	if len(policy.Variants) > 0 {
+		return p.saveImage(ctx, file, name, contentType, sum, ext, policy.Variants, store, prefix)
+	}
+
+	key := prefix + sum + ext
+	if _, err := store.Stat(ctx, key); err == storage.ErrNotFound {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := store.Put(ctx, key, file, fileHeader.Size, contentType); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &File{Key: key, Name: name, ContentType: contentType, Size: fileHeader.Size, SHA256: sum}, nil
+}
+
+//quarantine keeps a rejected upload in private storage. Failing to do so must not hide the
+//rejection from the client so errors are dropped
+func (p *Pipeline) quarantine(ctx context.Context, file io.ReadSeeker, size int64, contentType, sum, name string) {
+	quarantine := storage.Private()
+	if quarantine == nil {
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	quarantine.Put(ctx, fmt.Sprintf("%s%s-%s", QuarantinePrefix, sum, name), file, size, contentType)
+}
+
+//allowedExtension returns the extension to store a file of contentType with, and whether the
+//policy allows it under the name it was uploaded with
+func allowedExtension(policy Policy, contentType, name string) (string, bool) {
+	extensions, ok := policy.Allowed[contentType]
+	if !ok {
+		return "", false
+	}
+	if len(extensions) == 0 {
+		return strings.ToLower(filepath.Ext(name)), true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, allowed := range extensions {
+		if ext == allowed {
+			return allowed, true
+		}
+	}
+	//images and pdfs are identified by their content, a wrong or missing extension is fixed up.
+	//Zip based office documents can only be told apart by their extension
+	if contentType == "application/zip" {
+		return "", false
+	}
+	return extensions[0], true
+}
+
+//SanitizeFilename reduces an uploaded file name to a safe base name made of letters, digits, dots, dashes and underscores
+func SanitizeFilename(name string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	out := []rune{}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			out = append(out, r)
+		default:
+			out = append(out, '_')
+		}
+	}
+	clean := strings.TrimLeft(string(out), ".")
+	if len(clean) > 100 {
+		ext := filepath.Ext(clean)
+		if len(ext) > 10 {
+			ext = ""
+		}
+		clean = clean[:100-len(ext)] + ext
+	}
+	if clean == "" {
+		clean = "file"
+	}
+	return clean
+}
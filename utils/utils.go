@@ -4,30 +4,61 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
-	"os"
+	"io"
+	"properlyauth/config"
+	"properlyauth/logging"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
-	gomail "gopkg.in/mail.v2"
+)
 
-	"github.com/haibeey/struct2Map"
+var (
+	cfg                    = &config.Config{}
+	randomSource io.Reader = rand.Reader
 )
 
+//Configure sets the configuration used to sign tokens and picks the random source
+//the configuration asks for
+func Configure(c *config.Config) {
+	cfg = c
+	if c.RandomSource == config.FixedRandom {
+		SetRandomSource(FixedReader('1'))
+	} else {
+		SetRandomSource(rand.Reader)
+	}
+}
+
+//SetRandomSource replaces the reader random codes and tokens are generated from
+func SetRandomSource(r io.Reader) {
+	randomSource = r
+}
+
+//FixedReader is a deterministic random source that yields the same byte forever. Only meant for tests
+type FixedReader byte
+
+func (f FixedReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(f)
+	}
+	return len(b), nil
+}
+
 //BearerTokenHeader header token for jwt
 type BearerTokenHeader struct {
 	Token string `header:"Authorization"`
 }
 
-//CreateToken returns a jwt string used for authetication
-func CreateToken(userid string) (string, error) {
+//CreateToken returns a jwt string used for authetication, tied to the session it was issued for
+func CreateToken(userid, sessionID string) (string, error) {
 	atClaims := jwt.MapClaims{}
 	atClaims["authorized"] = true
 	atClaims["user_id"] = userid
+	atClaims["session_id"] = sessionID
 	atClaims["exp"] = time.Now().Add(time.Minute * 131400).Unix()
 	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	token, err := at.SignedString([]byte(os.Getenv("SECRET_KEY")))
+	token, err := at.SignedString([]byte(cfg.SecretKey))
 	if err != nil {
 		return "", err
 	}
@@ -49,7 +80,7 @@ func DecodeJWTToken(tokenString string) (map[string]string, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(os.Getenv("SECRET_KEY")), nil
+		return []byte(cfg.SecretKey), nil
 	})
 
 	if err != nil {
@@ -67,6 +98,10 @@ func DecodeJWTToken(tokenString string) (map[string]string, error) {
 
 	res := make(map[string]string)
 	res["user_id"] = claims["user_id"].(string)
+	//tokens issued before sessions were recorded carry no session
+	if sessionID, ok := claims["session_id"].(string); ok {
+		res["session_id"] = sessionID
+	}
 
 	return res, nil
 }
@@ -92,17 +127,15 @@ func DecodeJWT(c *gin.Context) (map[string]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't parse token %v", err)
 	}
+	c.Set(logging.UserIDKey, res["user_id"])
 	return res, nil
 }
 
 //GenerateRandomDigit genrates random strings of numbers
 //Values generated are exclusively digit
 func GenerateRandomDigit(size int) string {
-	if len(os.Getenv("TESTING")) > 0 {
-		return "111111"
-	}
 	b := make([]byte, size)
-	rand.Read(b)
+	io.ReadFull(randomSource, b)
 
 	result := ""
 	for i := 0; i < size; i++ {
@@ -124,7 +157,7 @@ func GenerateRandomDigit(size int) string {
 //Values generated are exclusively digit and characters
 func GeneratePUMCCode(size int) string {
 	b := make([]byte, size)
-	rand.Read(b)
+	io.ReadFull(randomSource, b)
 
 	result := ""
 	for i := 0; i < size; i++ {
@@ -145,45 +178,9 @@ func GeneratePUMCCode(size int) string {
 	return result
 }
 
-//SendMail use to authenticate user
-func SendMail(emailRecipent, subject, body string) error {
-	if os.Getenv("TESTING") == "TESTING" {
-		return nil
-	}
-	m := gomail.NewMessage()
-
-	// Set E-Mail sender
-	m.SetHeader("From", os.Getenv("EMAIL_SENDER"))
-	m.SetHeader("To", emailRecipent)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body)
-
-	d := gomail.NewDialer("smtp.gmail.com", 465, os.Getenv("EMAIL_SENDER"), os.Getenv("EMAIL_SENDER_PASSWORD"))
-	if err := d.DialAndSend(m); err != nil {
-		return err
-	}
-	return nil
-}
-
 //SHA256Hash hash of a string
 func SHA256Hash(data string) string {
 	h := sha256.New()
 	h.Write([]byte(data))
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
-
-//MissingDataResponse returns the required field for fil that are nil
-func MissingDataResponse(dataModel interface{}) (map[string][]string, error) {
-	response := make(map[string][]string)
-	value, err := struct2map.Struct2Map(dataModel)
-	if err != nil {
-		return nil, err
-	}
-
-	for i, v := range value {
-		if v == 0 || v == "" || v == nil {
-			response[i] = []string{fmt.Sprintf("%s cannot be blank.", i)}
-		}
-	}
-	return response, nil
-}
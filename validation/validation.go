@@ -0,0 +1,151 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"properlyauth/apierr"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fr"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	fr_translations "github.com/go-playground/validator/v10/translations/fr"
+)
+
+//DefaultLocale is the language messages fall back to when the client asks for one we don't speak
+const DefaultLocale = "en"
+
+//aliases are the tags request models can use on top of the validator's baked in ones.
+//Both accept a blank value so a field can be cleared by sending ""
+var aliases = map[string]string{
+	"date":  "len=0|datetime=2006-01-02",
+	"phone": "len=0|e164",
+}
+
+//messages holds the translations the validator's locale packages don't ship, by locale and tag
+var messages = map[string]map[string]string{
+	"en": {
+		"date":  "{0} must be a date in the YYYY-MM-DD format",
+		"phone": "{0} must be a valid E.164 formatted phone number",
+	},
+	"fr": {
+		"date":     "{0} doit être une date au format AAAA-MM-JJ",
+		"phone":    "{0} doit être un numéro de téléphone valide au format E.164",
+		"e164":     "{0} doit être un numéro de téléphone valide au format E.164",
+		"datetime": "{0} ne respecte pas le format {1}",
+	},
+}
+
+var translators *ut.UniversalTranslator
+
+func init() {
+	if err := register(binding.Validator.Engine().(*validator.Validate)); err != nil {
+		panic(fmt.Sprintf("validation: %v", err))
+	}
+}
+
+//register names fields after their json keys and installs the aliases and translations on v
+func register(v *validator.Validate) error {
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		return strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+	})
+	for alias, tags := range aliases {
+		v.RegisterAlias(alias, tags)
+	}
+
+	translators = ut.New(en.New(), en.New(), fr.New())
+	english, _ := translators.GetTranslator("en")
+	if err := en_translations.RegisterDefaultTranslations(v, english); err != nil {
+		return err
+	}
+	french, _ := translators.GetTranslator("fr")
+	if err := fr_translations.RegisterDefaultTranslations(v, french); err != nil {
+		return err
+	}
+
+	for locale, texts := range messages {
+		trans, _ := translators.GetTranslator(locale)
+		for tag, text := range texts {
+			if err := v.RegisterTranslation(tag, trans, addMessage(tag, text), translate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func addMessage(tag, text string) validator.RegisterTranslationsFunc {
+	return func(trans ut.Translator) error {
+		return trans.Add(tag, text, true)
+	}
+}
+
+func translate(trans ut.Translator, fe validator.FieldError) string {
+	message, err := trans.T(fe.Tag(), fe.Field(), fe.Param())
+	if err != nil {
+		return fe.Error()
+	}
+	return message
+}
+
+//Translator returns the translator for locale, trying its base language and then DefaultLocale
+func Translator(locale string) ut.Translator {
+	locale = strings.ToLower(strings.Replace(locale, "-", "_", -1))
+	base := strings.SplitN(locale, "_", 2)[0]
+	trans, _ := translators.FindTranslator(locale, base, DefaultLocale)
+	return trans
+}
+
+//AddMessages registers texts, by locale and key, for checks done outside of the validator.
+//Texts use {0}, {1}... for the parameters given to Message
+func AddMessages(texts map[string]map[string]string) error {
+	for locale, messages := range texts {
+		trans, found := translators.GetTranslator(locale)
+		if !found {
+			return fmt.Errorf("no translator for locale %s", locale)
+		}
+		for key, text := range messages {
+			if err := trans.Add(key, text, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Message returns the text registered under key in locale with params filled in
+func Message(locale, key string, params ...string) string {
+	message, err := Translator(locale).T(key, params...)
+	if err != nil {
+		return key
+	}
+	return message
+}
+
+//Errors turns the validation failures in err into field errors with messages in locale.
+//It returns nil when err didn't come from the validator
+func Errors(err error, locale string) []apierr.FieldError {
+	var failures validator.ValidationErrors
+	if !errors.As(err, &failures) {
+		return nil
+	}
+	trans := Translator(locale)
+	fields := make([]apierr.FieldError, 0, len(failures))
+	for _, failure := range failures {
+		fields = append(fields, apierr.Field(fieldName(failure), failure.Tag(), failure.Translate(trans)))
+	}
+	return fields
+}
+
+//fieldName is the path to the failing field without the name of the request model, e.g. keys[0]
+func fieldName(fe validator.FieldError) string {
+	namespace := fe.Namespace()
+	if i := strings.Index(namespace, "."); i >= 0 {
+		return namespace[i+1:]
+	}
+	return namespace
+}